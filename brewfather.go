@@ -21,7 +21,6 @@ func (t TempType) String() string {
 	default:
 		panic(fmt.Sprintf("Unknown temperature type: %#v", t))
 	}
-	return ""
 }
 
 //const BREWFATHER_URL="http://log.brewfather.net/stream?id=xxxxxxxxxxxxx";
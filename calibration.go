@@ -0,0 +1,166 @@
+package tmpcontrol
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SensorCalibration corrects a sensor's readings: the two-point correction is applied first, then the Offset
+type SensorCalibration struct {
+	//Offset °F added to every reading
+	Offset float32 `json:"offset,omitempty"`
+	//Points a two-point linear correction: a reading of Points[i].Raw becomes Points[i].Actual, e.g. in ice water and
+	//at a rolling boil
+	Points []CalibrationPoint `json:"points,omitempty"`
+}
+
+// CalibrationPoint what the sensor read (Raw) when the temperature was Actual, both in °F
+type CalibrationPoint struct {
+	Raw    float32 `json:"raw"`
+	Actual float32 `json:"actual"`
+}
+
+func (c *SensorCalibration) apply(raw float32) float32 {
+	if c == nil {
+		return raw
+	}
+	corrected := raw
+	if len(c.Points) == 2 {
+		low, high := c.Points[0], c.Points[1]
+		corrected = low.Actual + (raw-low.Raw)*(high.Actual-low.Actual)/(high.Raw-low.Raw)
+	}
+	return corrected + c.Offset
+}
+
+// SensorFilter discards implausible readings before they reach the control decision
+type SensorFilter struct {
+	//Median how many of the latest readings we take the median of. 0 or 1 doesn't smooth
+	Median int `json:"median,omitempty"`
+	//MaxRate the most °F per minute a reading may move from the last one we accepted. Faster jumps are discarded
+	//until maxConsecutiveJumps in a row agree that the temperature really moved. 0 doesn't check
+	MaxRate float32 `json:"maxRate,omitempty"`
+}
+
+// maxSensorFilterMedian more readings than this would lag too far behind the beer
+const maxSensorFilterMedian = 15
+
+// maxConsecutiveJumps after this many discarded jumps in a row we believe the sensor
+const maxConsecutiveJumps = 3
+
+func validateSensorCorrection(path string, controllerName string, sensor ControllerSensor) ConfigErrors {
+	var errs ConfigErrors
+	add := func(path string, format string, v ...interface{}) {
+		errs = append(errs, ConfigError{Path: path, Message: fmt.Sprintf(format, v...)})
+	}
+	if sensor.Calibration != nil {
+		points := sensor.Calibration.Points
+		if len(points) != 0 && len(points) != 2 {
+			add(path+"/calibration/points", "controller %s: a calibration needs exactly two points, not %d", controllerName, len(points))
+		} else if len(points) == 2 && points[0].Raw == points[1].Raw {
+			add(path+"/calibration/points", "controller %s: the calibration points need different raw readings", controllerName)
+		}
+	}
+	if sensor.Filter != nil {
+		if sensor.Filter.Median < 0 || sensor.Filter.Median > maxSensorFilterMedian {
+			add(path+"/filter/median", "controller %s: median must be between 0 and %d", controllerName, maxSensorFilterMedian)
+		}
+		if sensor.Filter.MaxRate < 0 {
+			add(path+"/filter/maxRate", "controller %s: maxRate can't be negative", controllerName)
+		}
+	}
+	return errs
+}
+
+// sensorHistory the readings a SensorFilter has accepted from one sensor
+type sensorHistory struct {
+	recent       []float32
+	lastAccepted float32
+	lastAt       time.Time
+	jumps        int
+}
+
+// sensorFilterTracker the history of every filtered sensor, by controller and path. Controllers run on their own
+// goroutines
+type sensorFilterTracker struct {
+	mu      sync.Mutex
+	sensors map[string]*sensorHistory
+}
+
+// filter returns the filtered reading, and whether raw was discarded as a jump
+func (t *sensorFilterTracker) filter(controllerName string, sensor ControllerSensor, raw float32, now time.Time) (float32, bool) {
+	if sensor.Filter == nil {
+		return raw, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sensors == nil {
+		t.sensors = make(map[string]*sensorHistory)
+	}
+	key := controllerName + "\x00" + sensor.Path
+	history, ok := t.sensors[key]
+	if !ok {
+		history = &sensorHistory{}
+		t.sensors[key] = history
+	}
+
+	if sensor.Filter.MaxRate > 0 && !history.lastAt.IsZero() {
+		//a reading within a second of the last may still move one second's worth
+		minutes := max(now.Sub(history.lastAt).Minutes(), 1.0/60)
+		jump := raw - history.lastAccepted
+		if jump < 0 {
+			jump = -jump
+		}
+		if float64(jump) > float64(sensor.Filter.MaxRate)*minutes {
+			history.jumps++
+			if history.jumps < maxConsecutiveJumps {
+				return median(history.recent), true
+			}
+			//the temperature really did move, so the old readings no longer count
+			history.recent = nil
+		}
+	}
+	history.jumps = 0
+	history.lastAccepted, history.lastAt = raw, now
+	history.recent = append(history.recent, raw)
+	if len(history.recent) > max(sensor.Filter.Median, 1) {
+		history.recent = history.recent[len(history.recent)-max(sensor.Filter.Median, 1):]
+	}
+	return median(history.recent), false
+}
+
+func median(values []float32) float32 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// correctReadings filters and calibrates each successful reading, keeping what the sensor actually said in raw
+func (cl *ControlLooper) correctReadings(controllerName string, readings []sensorReading, now time.Time) {
+	for i := range readings {
+		reading := &readings[i]
+		if reading.err != nil {
+			continue
+		}
+		reading.raw = reading.temperature
+		filtered, discarded := cl.sensorFilters.filter(controllerName, reading.ControllerSensor, reading.raw, now)
+		if discarded {
+			cl.Logger.Printf("%s [%s]: %s jumped to %.2f, faster than %.2f°F a minute, so we're discarding it\n", cl.timestamp(), controllerName, reading.Path, reading.raw, reading.Filter.MaxRate)
+		}
+		reading.temperature = reading.Calibration.apply(filtered)
+	}
+}
+
+// uncorrected the readings as the sensors gave them, so a SensorPolicy can tell us the raw control temperature
+func uncorrected(readings []sensorReading) []sensorReading {
+	raw := slices.Clone(readings)
+	for i := range raw {
+		raw[i].temperature = raw[i].raw
+	}
+	return raw
+}
@@ -0,0 +1,142 @@
+package tmpcontrol
+
+import (
+	"context"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSensorCalibration(t *testing.T) {
+	twoPoint := &SensorCalibration{Points: []CalibrationPoint{{Raw: 33, Actual: 32}, {Raw: 210, Actual: 212}}, Offset: 0.5}
+	for raw, expected := range map[float32]float32{33: 32.5, 210: 212.5, 121.5: 122.5} {
+		if corrected := twoPoint.apply(raw); math.Abs(float64(corrected-expected)) > 0.001 {
+			t.Errorf("%.2f: expected %.2f, got %.2f", raw, expected, corrected)
+		}
+	}
+	var none *SensorCalibration
+	if none.apply(65) != 65 {
+		t.Error("expected no calibration to leave the reading alone")
+	}
+}
+
+func TestSensorFilterTracker(t *testing.T) {
+	var tracker sensorFilterTracker
+	sensor := ControllerSensor{Path: "w1:28-1", Filter: &SensorFilter{Median: 3, MaxRate: 1}}
+	start := time.Now()
+	for i, step := range []struct {
+		raw       float32
+		expected  float32
+		discarded bool
+	}{
+		{65, 65, false},
+		{65.5, 65.25, false},
+		{64.5, 65, false},
+		{185, 65, true}, //a spike
+		{66, 65.5, false},
+		{40, 65.5, true}, //the probe fell out of the fermenter, and stays out
+		{40.2, 65.5, true},
+		{40.1, 40.1, false},
+	} {
+		filtered, discarded := tracker.filter("fermenter", sensor, step.raw, start.Add(time.Duration(i)*time.Minute))
+		if filtered != step.expected || discarded != step.discarded {
+			t.Errorf("step %d, %.2f: expected %.2f (discarded %t), got %.2f (%t)", i, step.raw, step.expected, step.discarded, filtered, discarded)
+		}
+	}
+}
+
+func TestProcessTemperatureFileBytes_Sentinels(t *testing.T) {
+	if _, err := processTemperatureFileBytes([]byte("85000\n")); err != ErrDS18B20PowerOnReset {
+		t.Errorf("expected ErrDS18B20PowerOnReset, got %v", err)
+	}
+	if _, err := processTemperatureFileBytes([]byte("-127000\n")); err != ErrDS18B20Disconnected {
+		t.Errorf("expected ErrDS18B20Disconnected, got %v", err)
+	}
+	if temperature, err := processTemperatureFileBytes([]byte("85062\n")); err != nil || math.Abs(float64(temperature)-185.11) > 0.01 {
+		t.Errorf("expected a real 85.062°C to be read, got %.2f, %v", temperature, err)
+	}
+}
+
+func TestControlLooper_StoresRawTemperature(t *testing.T) {
+	cl := NewControlLooper(&ConfigGopher{}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = fixedThermometer{"/fermenter": 67}
+	controller := Controller{
+		Name:                "fermenter",
+		ControlType:         "cool",
+		SwitchHosts:         []string{"fridge"},
+		TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 66},
+		Sensors:             []ControllerSensor{{Path: "/fermenter", Calibration: &SensorCalibration{Offset: -1.5}}},
+	}
+	ret := cl.temperatureControl(context.Background(), &controller)
+	if ret.err != nil || ret.tmplog.TemperatureInF != 65.5 || ret.tmplog.RawTemperatureInF != 67 || ret.tmplog.TurningOnNotOff {
+		t.Fatalf("expected to control on the calibrated 65.5°F: %+v, %v", ret.tmplog, ret.err)
+	}
+	//a controller with just a thermometerPath is calibrated the same way
+	single := Controller{
+		Name:                "single",
+		ThermometerPath:     "/fermenter",
+		ControlType:         "cool",
+		SwitchHosts:         []string{"fridge"},
+		TemperatureSchedule: controller.TemperatureSchedule,
+		Calibration:         &SensorCalibration{Offset: -1.5},
+	}
+	if ret := cl.temperatureControl(context.Background(), &single); ret.err != nil || ret.tmplog.TemperatureInF != 65.5 || ret.tmplog.RawTemperatureInF != 67 {
+		t.Errorf("expected the thermometerPath to be calibrated to 65.5°F: %+v, %v", ret.tmplog, ret.err)
+	}
+	if ret.tmplog.SensorReadings != "beer /fermenter 65.50 (raw 67.00)" {
+		t.Errorf("unexpected sensor readings: %#v", ret.tmplog.SensorReadings)
+	}
+
+	db, err := NewSqliteDbFromFilename(filepath.Join(t.TempDir(), "tmplog.dbo"), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PersistTmpLog(ret.tmplog); err != nil {
+		t.Fatal(err)
+	}
+	tmplogs, err := db.FetchTmpLogsNotYetSentToServer()
+	if err != nil || len(tmplogs) != 1 || tmplogs[0].TemperatureInF != 65.5 || tmplogs[0].RawTemperatureInF != 67 {
+		t.Errorf("expected the raw and corrected temperatures to be stored: %+v, %v", tmplogs, err)
+	}
+}
+
+func TestValidateConfig_SensorCorrection(t *testing.T) {
+	config := ControllersConfig{Controllers: []Controller{{
+		Name:        "fermenter",
+		ControlType: "cool",
+		Sensors: []ControllerSensor{
+			{Path: "w1:28-1", Calibration: &SensorCalibration{Points: []CalibrationPoint{{Raw: 33, Actual: 32}}}},
+			{Path: "w1:28-2", Calibration: &SensorCalibration{Points: []CalibrationPoint{{Raw: 33, Actual: 32}, {Raw: 33, Actual: 212}}}},
+			{Path: "w1:28-3", Filter: &SensorFilter{Median: 99, MaxRate: -1}},
+			{Path: "w1:28-4", Calibration: &SensorCalibration{Offset: -0.5}, Filter: &SensorFilter{Median: 5, MaxRate: 2}},
+		},
+	}}}
+	var paths []string
+	for _, err := range validateConfigSemantics(config) {
+		paths = append(paths, err.Path)
+	}
+	expected := "/controllers/0/sensors/0/calibration/points /controllers/0/sensors/1/calibration/points /controllers/0/sensors/2/filter/median /controllers/0/sensors/2/filter/maxRate"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("expected errors at %s, got %s", expected, strings.Join(paths, " "))
+	}
+
+	//a lone thermometerPath is corrected by the controller's calibration and filter, which are validated the same way
+	config = ControllersConfig{Controllers: []Controller{
+		{Name: "fermenter", ThermometerPath: "w1:28-1", ControlType: "cool", Calibration: &SensorCalibration{Points: []CalibrationPoint{{Raw: 33, Actual: 32}}}, Filter: &SensorFilter{Median: -1}},
+		{Name: "lager", ThermometerPath: "w1:28-2", ControlType: "cool", Calibration: &SensorCalibration{Offset: -0.5}, Filter: &SensorFilter{Median: 5, MaxRate: 2}},
+		{Name: "kveik", ControlType: "heat", Sensors: []ControllerSensor{{Path: "w1:28-3"}}, Calibration: &SensorCalibration{Offset: 1}},
+	}}
+	paths = nil
+	for _, err := range validateConfigSemantics(config) {
+		paths = append(paths, err.Path)
+	}
+	expected = "/controllers/0/calibration/points /controllers/0/filter/median /controllers/2/calibration"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("expected errors at %s, got %s", expected, strings.Join(paths, " "))
+	}
+}
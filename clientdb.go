@@ -11,6 +11,9 @@ import (
 	"time"
 )
 
+// defaultDbFileName where the control loop logs its readings, relative to the working directory
+const defaultDbFileName = "tmplog.dbo"
+
 type ClientDb interface {
 	PersistTmpLog(tmplog TmpLog) error
 	io.Closer
@@ -67,21 +70,67 @@ func NewSqliteDbFromFilename(filename string, logger Logger) (SqliteClientDb, er
 			return SqliteClientDb{}, err
 		}
 	}
+	//columns added since the table was first created
+	for column, definition := range map[string]string{"DeviceStateDiscrepancies": "TEXT NULL", "SpecificGravity": "REAL NULL", "SensorReadings": "TEXT NULL", "RawTemperatureInF": "REAL NULL"} {
+		if err := addColumnIfMissing(db, "tmplog", column, definition); err != nil {
+			logger.Printf("Failed to add a column to the database: %s", err)
+			return SqliteClientDb{}, err
+		}
+	}
 
 	return SqliteClientDb{db: db, logger: logger, currentExecutionIdentifier: generateRandomExecutionIdentifier()}, nil
 }
 
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Close checkpoints the write-ahead log into the main database file before closing, so nothing is left pending
 func (dbo SqliteClientDb) Close() error {
+	if _, err := dbo.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		dbo.logger.Printf("Failed to checkpoint the database before closing: %s", err)
+	}
 	return dbo.db.Close()
 }
 
+// CheckWritable writes a row and rolls it back, so a read-only file or a full disk shows up before we need to log
+func (dbo SqliteClientDb) CheckWritable() error {
+	tx, err := dbo.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO tmplog (ExecutionIdentifier, ControllerName, Timestamp, IsHeatingNotCooling, TurningOnNotOff, HasBeenSentToServer) VALUES (?, ?, ?, ?, ?, ?)", dbo.currentExecutionIdentifier, "doctor", time.Now().Unix(), false, false, true)
+	return err
+}
+
 func generateRandomExecutionIdentifier() string {
 	return randString(8)
 }
 
 func (dbo SqliteClientDb) PersistTmpLog(tmplog TmpLog) error {
-	statement, _ := dbo.db.Prepare("INSERT INTO tmplog (ExecutionIdentifier, ControllerName, Timestamp, TemperatureInF, DesiredTemperatureInF, IsHeatingNotCooling, TurningOnNotOff, HostsPipeSeparated, HasBeenSentToServer) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
-	_, err := statement.Exec(dbo.currentExecutionIdentifier, tmplog.ControllerName, tmplog.Timestamp.Unix(), tmplog.TemperatureInF, tmplog.DesiredTemperatureInF, tmplog.IsHeatingNotCooling, tmplog.TurningOnNotOff, tmplog.HostsPipeSeparated, false)
+	statement, _ := dbo.db.Prepare("INSERT INTO tmplog (ExecutionIdentifier, ControllerName, Timestamp, TemperatureInF, DesiredTemperatureInF, IsHeatingNotCooling, TurningOnNotOff, HostsPipeSeparated, DeviceStateDiscrepancies, SpecificGravity, SensorReadings, RawTemperatureInF, HasBeenSentToServer) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	//no gravity is stored as NULL
+	specificGravity := sql.NullFloat64{Float64: tmplog.SpecificGravity, Valid: tmplog.SpecificGravity != 0}
+	_, err := statement.Exec(dbo.currentExecutionIdentifier, tmplog.ControllerName, tmplog.Timestamp.Unix(), tmplog.TemperatureInF, tmplog.DesiredTemperatureInF, tmplog.IsHeatingNotCooling, tmplog.TurningOnNotOff, tmplog.HostsPipeSeparated, tmplog.DeviceStateDiscrepancies, specificGravity, tmplog.SensorReadings, tmplog.RawTemperatureInF, false)
 	if err != nil {
 		return err
 	}
@@ -89,13 +138,13 @@ func (dbo SqliteClientDb) PersistTmpLog(tmplog TmpLog) error {
 }
 
 func (dbo SqliteClientDb) FetchTmpLogsNotYetSentToServer() ([]TmpLog, error) {
-	rows, _ := dbo.db.Query("SELECT Id, ExecutionIdentifier, ControllerName, Timestamp, TemperatureInF, DesiredTemperatureInF, IsHeatingNotCooling, TurningOnNotOff, HostsPipeSeparated FROM tmplog WHERE HasBeenSentToServer = 0")
+	rows, _ := dbo.db.Query("SELECT Id, ExecutionIdentifier, ControllerName, Timestamp, TemperatureInF, DesiredTemperatureInF, IsHeatingNotCooling, TurningOnNotOff, HostsPipeSeparated, COALESCE(DeviceStateDiscrepancies, ''), COALESCE(SpecificGravity, 0), COALESCE(SensorReadings, ''), COALESCE(RawTemperatureInF, TemperatureInF) FROM tmplog WHERE HasBeenSentToServer = 0")
 	//30 is just a guess of how many rows we're getting
 	tmpLogs := make([]TmpLog, 0, 30)
 	var tempTmpLog TmpLog
 	var tempTimestampStr int64
 	for rows.Next() {
-		rows.Scan(&tempTmpLog.DbAutoId, &tempTmpLog.ExecutionIdentifier, &tempTmpLog.ControllerName, &tempTimestampStr, &tempTmpLog.TemperatureInF, &tempTmpLog.DesiredTemperatureInF, &tempTmpLog.IsHeatingNotCooling, &tempTmpLog.TurningOnNotOff, &tempTmpLog.HostsPipeSeparated)
+		rows.Scan(&tempTmpLog.DbAutoId, &tempTmpLog.ExecutionIdentifier, &tempTmpLog.ControllerName, &tempTimestampStr, &tempTmpLog.TemperatureInF, &tempTmpLog.DesiredTemperatureInF, &tempTmpLog.IsHeatingNotCooling, &tempTmpLog.TurningOnNotOff, &tempTmpLog.HostsPipeSeparated, &tempTmpLog.DeviceStateDiscrepancies, &tempTmpLog.SpecificGravity, &tempTmpLog.SensorReadings, &tempTmpLog.RawTemperatureInF)
 		tempTimestamp := time.Unix(tempTimestampStr, 0)
 		tempTmpLog.Timestamp = tempTimestamp
 		tmpLogs = append(tmpLogs, tempTmpLog)
@@ -0,0 +1,176 @@
+package tmpcontrol
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the control loop what time it is and when to wake up, so tests and a Simulation can run it without
+// waiting on the wall clock
+type Clock interface {
+	Now() time.Time
+	//NewTicker like time.NewTicker
+	NewTicker(d time.Duration) Ticker
+	//After like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker like a time.Ticker, whose channel is a method so a SimulatedClock can provide one
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// SimulatedClock only moves when it's told to, firing its tickers and timers on the way
+type SimulatedClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*simulatedWaiter
+	//changed is closed and replaced whenever a waiter is added, see BlockUntilWaiters
+	changed chan struct{}
+}
+
+// simulatedWaiter a ticker, or a timer if its interval is 0
+type simulatedWaiter struct {
+	clock    *SimulatedClock
+	c        chan time.Time
+	next     time.Time
+	interval time.Duration
+	stopped  bool
+}
+
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start, changed: make(chan struct{})}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *SimulatedClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for SimulatedClock.NewTicker")
+	}
+	return c.addWaiter(d, d)
+}
+
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		//like time.After, this fires right away rather than waiting for the clock to move
+		fired := make(chan time.Time, 1)
+		fired <- c.Now()
+		return fired
+	}
+	return c.addWaiter(d, 0).c
+}
+
+func (c *SimulatedClock) addWaiter(d time.Duration, interval time.Duration) *simulatedWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	//like a time.Ticker, a tick is dropped if the last one hasn't been taken yet
+	waiter := &simulatedWaiter{clock: c, c: make(chan time.Time, 1), next: c.now.Add(d), interval: interval}
+	c.waiters = append(c.waiters, waiter)
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return waiter
+}
+
+func (w *simulatedWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *simulatedWaiter) Stop() {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	w.stopped = true
+}
+
+// Set moves the clock forward to t, firing what comes due on the way. A t in the clock's past changes nothing
+func (c *SimulatedClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		live := c.waiters[:0]
+		for _, waiter := range c.waiters {
+			if !waiter.stopped {
+				live = append(live, waiter)
+			}
+		}
+		c.waiters = live
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].next.Before(c.waiters[j].next)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].next.After(t) {
+			break
+		}
+		waiter := c.waiters[0]
+		if waiter.next.After(c.now) {
+			c.now = waiter.next
+		}
+		select {
+		case waiter.c <- c.now:
+		default:
+		}
+		if waiter.interval == 0 {
+			waiter.stopped = true
+		} else {
+			waiter.next = waiter.next.Add(waiter.interval)
+		}
+	}
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// BlockUntilWaiters waits until n tickers and timers are waiting on the clock, so a test knows the goroutines it
+// started are ready for the clock to move
+func (c *SimulatedClock) BlockUntilWaiters(n int) {
+	for {
+		c.mu.Lock()
+		waiting := 0
+		for _, waiter := range c.waiters {
+			if !waiter.stopped {
+				waiting++
+			}
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		<-changed
+	}
+}
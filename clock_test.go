@@ -0,0 +1,54 @@
+package tmpcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimulatedClock(t *testing.T) {
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewSimulatedClock(start)
+	ticker := clock.NewTicker(15 * time.Second)
+	timer := clock.After(time.Minute)
+	clock.BlockUntilWaiters(2)
+
+	clock.Advance(14 * time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("expected the ticker to wait for its interval")
+	default:
+	}
+	clock.Advance(time.Second)
+	if tick := <-ticker.C(); !tick.Equal(start.Add(15 * time.Second)) {
+		t.Errorf("expected a tick at 15s, got %s", tick)
+	}
+
+	//ticks nobody takes are dropped, like a time.Ticker's
+	clock.Advance(time.Minute)
+	if tick := <-ticker.C(); !tick.Equal(start.Add(30 * time.Second)) {
+		t.Errorf("expected the first tick we missed, got %s", tick)
+	}
+	select {
+	case <-ticker.C():
+		t.Error("expected the other ticks we missed to be dropped")
+	default:
+	}
+	if fired := <-timer; !fired.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the timer to fire at 1m, got %s", fired)
+	}
+	if !clock.Now().Equal(start.Add(75 * time.Second)) {
+		t.Errorf("expected the clock to be at 1m15s, got %s", clock.Now())
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+	select {
+	case <-ticker.C():
+		t.Error("expected a stopped ticker not to tick")
+	default:
+	}
+	clock.Set(start)
+	if !clock.Now().Equal(start.Add(75*time.Second + time.Hour)) {
+		t.Errorf("expected the clock not to go back, got %s", clock.Now())
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jroedel/tmpcontrol"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	broadcastAddress string
+	timeout          time.Duration
+	outputJson       bool
+)
+
+func init() {
+	flag.StringVar(&broadcastAddress, "broadcast-address", tmpcontrol.KasaDiscoveryAddress, "Where to broadcast the discovery request")
+	flag.DurationVar(&timeout, "timeout", 3*time.Second, "How long to wait for plugs to answer")
+	flag.BoolVar(&outputJson, "json", false, "Print the plugs as JSON")
+}
+
+// discover lists the Kasa plugs on the local network. Any of them can be used in switchHosts by address, by MAC, or
+// by alias like "alias:Fermentation fridge"
+func main() {
+	flag.Parse()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	devices, err := tmpcontrol.DiscoverKasaDevices(ctx, broadcastAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if outputJson {
+		type device struct {
+			tmpcontrol.KasaDevice
+			State string `json:"state"`
+		}
+		out := make([]device, 0, len(devices))
+		for _, d := range devices {
+			out = append(out, device{KasaDevice: d, State: d.State.String()})
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(devices) == 0 {
+		fmt.Println("We didn't find any Kasa plugs :-( Plugs with the newest firmware don't answer this kind of discovery")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tALIAS\tMAC\tMODEL\tSTATE")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Host, d.Alias, d.Mac, d.Model, d.State)
+	}
+	_ = w.Flush()
+}
@@ -1,21 +1,70 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/jroedel/tmpcontrol"
 	"log"
 	"os"
-	"strings"
+	"text/tabwriter"
+	"time"
 )
 
+var (
+	root       string
+	timeout    time.Duration
+	outputJson bool
+)
+
+func init() {
+	flag.StringVar(&root, "root", tmpcontrol.ThermometerDevicesRootPath, "Where the kernel lists 1-Wire devices")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "How long to wait for the slowest thermometer")
+	flag.BoolVar(&outputJson, "json", false, "Print the thermometers as JSON")
+}
+
+// enum lists the 1-Wire thermometers, their readings and what to put in thermometerPath to use them
 func main() {
-	logger := tmpcontrol.Logger(log.New(os.Stdout, "[tmpcontrol] ", 0))
+	flag.Parse()
+	logger := tmpcontrol.Logger(log.New(os.Stderr, "[tmpcontrol] ", 0))
 	tempReader := tmpcontrol.NewDS18B20Reader(logger)
-	fmt.Printf("Assuming we're on a Raspberry Pi, we'll check %#v for connected thermometers\n", tmpcontrol.ThermometerDevicesRootPath)
-	thermometerPaths := tempReader.EnumerateThermometerPaths()
-	if len(thermometerPaths) == 0 {
-		fmt.Println("We didn't find any :-(")
-	} else {
-		fmt.Printf("We found these:\n%s\n", strings.Join(thermometerPaths, "\n"))
+	tempReader.Root = root
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	thermometers, err := tempReader.Enumerate(ctx)
+	if err != nil {
+		log.Fatalf("We couldn't list %s, is the 1-Wire interface enabled? %s", root, err)
+	}
+
+	if outputJson {
+		if thermometers == nil {
+			thermometers = []tmpcontrol.ThermometerInfo{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(thermometers); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(thermometers) == 0 {
+		fmt.Printf("We didn't find any thermometers in %s :-(\n", root)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tFAMILY\tTEMPERATURE\tRESOLUTION\tLATENCY")
+	for _, t := range thermometers {
+		if t.Err != "" {
+			fmt.Fprintf(w, "%s\t%s\terror: %s\t\t%s\n", t.Path, t.Family, t.Err, time.Duration(t.Latency).Round(time.Millisecond))
+			continue
+		}
+		resolution := "unknown"
+		if t.ResolutionBits > 0 {
+			resolution = fmt.Sprintf("%d bits", t.ResolutionBits)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2f°F\t%s\t%s\n", t.Path, t.Family, t.TemperatureInF, resolution, time.Duration(t.Latency).Round(time.Millisecond))
 	}
+	_ = w.Flush()
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jroedel/tmpcontrol"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runDoctor `tmpcontrol doctor [-json] <the flags tmpcontrol runs with>` checks the hardware, the database, the server
+// and the clock, and exits 1 if anything failed. Switch hosts are only queried, never switched
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	//we take the same flags as the control loop, so the command line it runs with can be pasted after `doctor`
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	asJson := fs.Bool("json", false, "Print the report as JSON")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long reading one thermometer, querying one switch host or reaching the server may take")
+	dbFileName := fs.String("db", "tmplog.dbo", "The control loop's database, relative to where it runs")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpcontrol doctor [-json] [the flags tmpcontrol runs with]\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if err := validateParams(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	//the report is what we're after, not the details of opening the database and such
+	logger := tmpcontrol.Logger(log.New(io.Discard, "", 0))
+	switchDrivers, closeSwitchDrivers := newSwitchDrivers()
+	defer closeSwitchDrivers()
+	cg := tmpcontrol.ConfigGopher{ServerRoot: configServerRootUrl, ClientId: clientIdentifier, LocalConfigPath: localConfigPath, Layered: layeredConfig, Logger: logger}
+	doctor := tmpcontrol.NewDoctor(&cg, tmpcontrol.DefaultTemperatureReaders(logger), switchDrivers, logger)
+	//connecting to the broker as tmpcontrol would knock the running tmpcontrol off it, hydrometers only report to
+	//the running tmpcontrol, and reading a GPIO line means claiming it as an output, which turns the relay off (or
+	//fails while tmpcontrol holds it)
+	doctor.SkipSchemes = map[string]string{
+		"mqtt":     "MQTT is only checked by the running tmpcontrol",
+		"gpio":     "GPIO lines would have to be claimed, which turns them off",
+		"tilt":     "hydrometers report to the running tmpcontrol",
+		"ispindel": "hydrometers report to the running tmpcontrol",
+	}
+	doctor.Timeout = *timeout
+	doctor.DbFileName = *dbFileName
+	if kasaDriver == "cli" {
+		doctor.KasaPath = kasaPath
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report := doctor.Run(ctx)
+
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(report)
+	} else {
+		fmt.Println(report)
+	}
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
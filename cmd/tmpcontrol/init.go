@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jroedel/tmpcontrol"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runInit `tmpcontrol init` walks through setting up this machine's controllers and writes the config to a file, or
+// uploads it to the server
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("output", "tmpcontrol-config.json", "Where to write the config")
+	serverRoot := fs.String("config-server-root-url", "", "Upload the config to this server instead of writing a file")
+	clientId := fs.String("client-identifier", "", "Who to upload the config for")
+	username := fs.String("kasa-username", "", "The TP-Link account of plugs with newer (KLAP) firmware")
+	password := fs.String("kasa-password", "", "The TP-Link account password of plugs with newer (KLAP) firmware; also read from KASA_PASSWORD")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpcontrol init [-output file | -config-server-root-url url -client-identifier name]\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *serverRoot != "" && !tmpcontrol.ClientIdentifiersRegex.MatchString(*clientId) {
+		fmt.Fprintf(os.Stderr, "To upload the config we need a -client-identifier matching %s\n", tmpcontrol.ClientIdentifiersRegex.String())
+		return 2
+	}
+	if *password == "" {
+		*password = os.Getenv("KASA_PASSWORD")
+	}
+
+	logger := tmpcontrol.Logger(log.New(os.Stderr, "[tmpcontrol] ", 0))
+	switchDrivers := tmpcontrol.NewSwitchDrivers("kasa")
+	_ = switchDrivers.Register("kasa", tmpcontrol.NewNativeKasaController(tmpcontrol.KasaCredentials{Username: *username, Password: *password}))
+	gpioController := tmpcontrol.NewGpioController()
+	defer gpioController.Close()
+	_ = switchDrivers.Register("gpio", gpioController)
+	httpController := &tmpcontrol.HttpSwitchController{}
+	_ = switchDrivers.Register("http", httpController)
+	_ = switchDrivers.Register("https", httpController)
+	_ = switchDrivers.Register("exec", tmpcontrol.ExecController{})
+
+	wizard := tmpcontrol.NewSetupWizard(os.Stdin, os.Stdout, tmpcontrol.NewDS18B20Reader(logger), tmpcontrol.DefaultTemperatureReaders(logger), switchDrivers)
+	wizard.DiscoverPlugs = func(ctx context.Context) ([]tmpcontrol.KasaDevice, error) {
+		fmt.Println("Looking for Kasa plugs...")
+		ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+		return tmpcontrol.DiscoverKasaDevices(ctx, tmpcontrol.KasaDiscoveryAddress)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	config, err := wizard.Run(ctx)
+	if errors.Is(err, tmpcontrol.ErrSetupAborted) {
+		fmt.Fprintln(os.Stderr, "We stopped without writing anything")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "The config isn't valid:\n%s\n", err)
+		return 1
+	}
+
+	if *serverRoot != "" {
+		cg := tmpcontrol.ConfigGopher{ServerRoot: *serverRoot, ClientId: *clientId}
+		if err := cg.SendConfig(config); err != nil {
+			fmt.Fprintf(os.Stderr, "We couldn't upload the config: %s\n", err)
+			return 1
+		}
+		fmt.Printf("We uploaded %d controller(s) for %s. Start tmpcontrol with -config-server-root-url %s -client-identifier %s\n", len(config.Controllers), *clientId, *serverRoot, *clientId)
+		return 0
+	}
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "We couldn't encode the config: %s\n", err)
+		return 1
+	}
+	if err := os.WriteFile(*output, append(content, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "We couldn't write the config: %s\n", err)
+		return 1
+	}
+	fmt.Printf("We wrote %s. Start tmpcontrol with -local-config-path %s\n", *output, *output)
+	return 0
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/jroedel/tmpcontrol"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,14 +21,59 @@ var (
 	clientIdentifier             string
 	localConfigPath              string
 	configFetchIntervalInSeconds int
+	layeredConfig                bool
+	shutdownState                string
+	kasaDriver                   string
+	kasaUsername                 string
+	kasaPassword                 string
+	controlInterval              time.Duration
+	tempReadAlertAfter           time.Duration
+	switchHostAlertAfter         time.Duration
+	configFetchAlertAfter        time.Duration
+	startupGracePeriod           time.Duration
+	mqttBroker                   string
+	mqttUsername                 string
+	mqttPassword                 string
+	mqttTopicPrefix              string
+	mqttDiscoveryPrefix          string
+	hydrometerListen             string
+	tiltStream                   string
+	ds18b20Resolution            int
 )
 
 func init() {
 	flag.StringVar(&kasaPath, "kasa-path", "", "The path to the kasa executable") //no default value, because we need to know if the user submitted it or not
+	flag.StringVar(&kasaDriver, "kasa-driver", "native", "How to talk to Kasa plugs: native, or cli to use the python kasa executable")
+	flag.StringVar(&kasaUsername, "kasa-username", "", "The TP-Link account of plugs with newer (KLAP) firmware")
+	flag.StringVar(&kasaPassword, "kasa-password", "", "The TP-Link account password of plugs with newer (KLAP) firmware; also read from KASA_PASSWORD")
+	flag.StringVar(&mqttBroker, "mqtt-broker", "", "The MQTT broker to publish telemetry to and take setpoint overrides from, e.g. tcp://192.168.1.10:1883")
+	flag.StringVar(&mqttUsername, "mqtt-username", "", "The MQTT broker username")
+	flag.StringVar(&mqttPassword, "mqtt-password", "", "The MQTT broker password; also read from MQTT_PASSWORD")
+	flag.StringVar(&mqttTopicPrefix, "mqtt-topic-prefix", "", "The prefix of our MQTT topics (default tmpcontrol/<client-identifier>)")
+	flag.StringVar(&mqttDiscoveryPrefix, "mqtt-discovery-prefix", "homeassistant", "The Home Assistant MQTT discovery prefix; empty to not publish discovery payloads")
+	flag.StringVar(&hydrometerListen, "hydrometer-listen", "", "The address to take iSpindel and Tilt bridge readings on, e.g. :8080; they POST to /ispindel and /tilt")
+	flag.StringVar(&tiltStream, "tilt-stream", "", "A file (or - for stdin) of BLE advertisements in hex to hear Tilts from: one per line, or the output of hcidump --raw")
+	flag.IntVar(&ds18b20Resolution, "ds18b20-resolution", 0, "Set every DS18B20 we find to this resolution, 9 to 12 bits; 0 leaves them as they are")
 	flag.StringVar(&configServerRootUrl, "config-server-root-url", "", "The root url of the control server")
 	flag.StringVar(&localConfigPath, "local-config-path", "", "The path to a local configuration file")
 	flag.StringVar(&clientIdentifier, "client-identifier", "", "The string to identify ourselves to the server")
 	flag.IntVar(&configFetchIntervalInSeconds, "config-fetch-interval", 60, "The number of seconds between polling the config file or server")
+	flag.StringVar(&shutdownState, "shutdown-state", "off", "The state (off or on) to leave every switch host in when tmpcontrol is stopped")
+	flag.BoolVar(&layeredConfig, "layered-config", false, "Use the server config as a base and apply the local config file on top of it")
+	//the config's "timing" section overrides these
+	flag.DurationVar(&controlInterval, "control-interval", 15*time.Second, "How often each controller reads its thermometer and switches its hosts")
+	flag.DurationVar(&tempReadAlertAfter, "temp-read-alert-after", time.Minute, "How long a thermometer may fail before we notify the server")
+	flag.DurationVar(&switchHostAlertAfter, "switch-host-alert-after", 5*time.Minute, "How long a switch host may be unreachable before we notify the server")
+	flag.DurationVar(&configFetchAlertAfter, "config-fetch-alert-after", 15*time.Minute, "How long fetching the config may fail before we notify the server")
+	flag.DurationVar(&startupGracePeriod, "startup-grace-period", time.Minute, "How long after starting we wait before alerting about switch hosts we've never reached")
+}
+
+// subcommands `tmpcontrol <subcommand> ...`; without one, tmpcontrol runs the control loop
+var subcommands = map[string]func(args []string) int{
+	"validate": runValidate,
+	"init":     runInit,
+	"doctor":   runDoctor,
+	"simulate": runSimulate,
 }
 
 /*
@@ -32,10 +82,21 @@ func init() {
 build for raspberry pi using `env GOOS=linux GOARCH=arm GOARM=6 go build`
 */
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
 	flag.Parse()
 	if err := validateParams(); err != nil {
 		log.Fatal(err)
 	}
+	//doctor reports this rather than stopping on it
+	if kasaDriver == "cli" {
+		if err := tmpcontrol.CheckKasaExecutable(kasaPath); err != nil {
+			log.Fatal(err)
+		}
+	}
 	logger := tmpcontrol.Logger(log.New(os.Stdout, "[tmpcontrol] ", 0))
 	//db, err := tmpcontrol.NewSqliteDbFromFilename("tmps.db", logger)
 	//if err != nil {
@@ -69,23 +130,136 @@ func main() {
 	//db.MarkTmpLogsAsSentToServer(idsToMarkSentToServer)
 	//return
 	tempReader := tmpcontrol.NewDS18B20Reader(logger)
-	fmt.Printf("Assuming we're on a Raspberry Pi, we'll check %#v for connected thermometers\n", tmpcontrol.ThermometerDevicesRootPath)
+	fmt.Printf("Assuming we're on a Raspberry Pi, we'll check %#v for connected thermometers\n", tempReader.Root)
 	thermometerPaths := tempReader.EnumerateThermometerPaths()
 	if len(thermometerPaths) == 0 {
 		fmt.Println("We didn't find any :-(")
 	} else {
 		fmt.Printf("We found these:\n%s\n", strings.Join(thermometerPaths, "\n"))
 	}
+	if ds18b20Resolution != 0 {
+		for _, path := range thermometerPaths {
+			sensorId := strings.TrimPrefix(path, "w1:")
+			if err := tempReader.SetResolution(sensorId, ds18b20Resolution); err != nil {
+				logger.Printf("We couldn't set the resolution of %s: %s\n", sensorId, err)
+			}
+		}
+	}
 
-	kasaController := tmpcontrol.HeatOrCoolController(tmpcontrol.NewKasaHeatOrCoolController(kasaPath))
+	switchDrivers, closeSwitchDrivers := newSwitchDrivers()
+	defer closeSwitchDrivers()
+	mqttBridge := newMqttBridge(logger)
+	if mqttBridge != nil {
+		defer mqttBridge.Close()
+		_ = switchDrivers.Register("mqtt", mqttBridge)
+	}
 	adminNotifier := tmpcontrol.SmsNotifier{}
-	cg := tmpcontrol.ConfigGopher{ServerRoot: configServerRootUrl, ClientId: clientIdentifier, LocalConfigPath: localConfigPath, ConfigFetchInterval: time.Duration(configFetchIntervalInSeconds) * time.Second, NotifyOutput: adminNotifier}
-	cl := tmpcontrol.NewControlLooper(&cg, kasaController, logger)
-	cl.StartControlLoop()
+	cg := tmpcontrol.ConfigGopher{ServerRoot: configServerRootUrl, ClientId: clientIdentifier, LocalConfigPath: localConfigPath, ConfigFetchInterval: time.Duration(configFetchIntervalInSeconds) * time.Second, NotifyOutput: adminNotifier, Layered: layeredConfig, Logger: logger}
+	cl := tmpcontrol.NewControlLooper(&cg, switchDrivers, logger)
+	//each controller's thermometer goes to the reader of its scheme; paths without one are DS18B20s
+	temperatureReaders := tmpcontrol.DefaultTemperatureReaders(logger)
+	if mqttBridge != nil {
+		_ = temperatureReaders.Register("mqtt", mqttBridge)
+	}
+	hydrometers := tmpcontrol.NewHydrometers(logger)
+	hydrometers.Clock = cl.Clock
+	_ = temperatureReaders.Register("tilt", hydrometers)
+	_ = temperatureReaders.Register("ispindel", hydrometers)
+	cl.TemperatureReader = temperatureReaders
+	if shutdownState == "on" {
+		cl.ShutdownState = tmpcontrol.ControlOn
+	}
+	cl.ControlInterval = controlInterval
+	cl.TempReadAlertAfter = tempReadAlertAfter
+	cl.SwitchHostAlertAfter = switchHostAlertAfter
+	cl.ConfigFetchAlertAfter = configFetchAlertAfter
+	cl.StartupGracePeriod = startupGracePeriod
+	if mqttBridge != nil {
+		cl.Telemetry = mqttBridge
+		cl.SetpointOverrides = mqttBridge
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if hydrometerListen != "" {
+		server := &http.Server{Addr: hydrometerListen, Handler: hydrometers}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Printf("We couldn't take hydrometer readings on %s: %s", hydrometerListen, err)
+			}
+		}()
+		defer server.Close()
+	}
+	if tiltStream != "" {
+		go ingestTiltStream(ctx, hydrometers, logger)
+	}
+	if err := cl.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	logger.Printf("Control loop stopped, goodbye")
+}
+
+// newSwitchDrivers each switch host goes to the driver of its scheme; hosts without one are Kasa plugs. The MQTT
+// driver is registered by the caller, see newMqttBridge
+func newSwitchDrivers() (*tmpcontrol.SwitchDrivers, func()) {
+	switchDrivers := tmpcontrol.NewSwitchDrivers("kasa")
+	if kasaDriver == "cli" {
+		_ = switchDrivers.Register("kasa", tmpcontrol.NewKasaHeatOrCoolController(kasaPath))
+	} else {
+		_ = switchDrivers.Register("kasa", tmpcontrol.NewNativeKasaController(tmpcontrol.KasaCredentials{Username: kasaUsername, Password: kasaPassword}))
+	}
+	gpioController := tmpcontrol.NewGpioController()
+	_ = switchDrivers.Register("gpio", gpioController)
+	httpController := &tmpcontrol.HttpSwitchController{}
+	_ = switchDrivers.Register("http", httpController)
+	_ = switchDrivers.Register("https", httpController)
+	_ = switchDrivers.Register("exec", tmpcontrol.ExecController{})
+	return switchDrivers, func() { _ = gpioController.Close() }
+}
+
+// newMqttBridge nil without -mqtt-broker
+func newMqttBridge(logger tmpcontrol.Logger) *tmpcontrol.MqttBridge {
+	if mqttBroker == "" {
+		return nil
+	}
+	mqttOptions := tmpcontrol.DefaultMqttOptions(mqttBroker, clientIdentifier)
+	mqttOptions.Username, mqttOptions.Password = mqttUsername, mqttPassword
+	mqttOptions.DiscoveryPrefix = mqttDiscoveryPrefix
+	if mqttTopicPrefix != "" {
+		mqttOptions.TopicPrefix = mqttTopicPrefix
+	}
+	mqttBridge := tmpcontrol.NewMqttBridge(mqttOptions, logger)
+	//we keep reconnecting in the background, so a broker that's down doesn't stop us from controlling
+	connectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := mqttBridge.Connect(connectCtx); err != nil {
+		logger.Printf("We couldn't connect to the MQTT broker yet, we'll keep trying: %s", err)
+	}
+	return mqttBridge
+}
+
+// ingestTiltStream reads -tilt-stream until it ends or we're stopped
+func ingestTiltStream(ctx context.Context, hydrometers *tmpcontrol.Hydrometers, logger tmpcontrol.Logger) {
+	stream := os.Stdin
+	if tiltStream != "-" {
+		file, err := os.Open(tiltStream)
+		if err != nil {
+			logger.Printf("We couldn't open the Tilt stream: %s", err)
+			return
+		}
+		defer file.Close()
+		stream = file
+	}
+	if err := hydrometers.IngestTiltStream(ctx, stream); err != nil && !errors.Is(err, context.Canceled) {
+		logger.Printf("We stopped reading the Tilt stream: %s", err)
+	}
 }
 
 // validate user input
 func validateParams() error {
+	if ds18b20Resolution != 0 && (ds18b20Resolution < 9 || ds18b20Resolution > 12) {
+		return fmt.Errorf("-ds18b20-resolution must be 9 to 12 bits, not %d", ds18b20Resolution)
+	}
 	//we need a clientIdentifier if a server url has been specified by user
 	if configServerRootUrl != "" {
 		//handle a blank clientIdentifier
@@ -98,6 +272,34 @@ func validateParams() error {
 		}
 	}
 
+	if shutdownState != "off" && shutdownState != "on" {
+		return fmt.Errorf("-shutdown-state must be off or on")
+	}
+
+	if controlInterval < time.Second {
+		return fmt.Errorf("-control-interval must be at least 1s")
+	}
+	if tempReadAlertAfter <= 0 || switchHostAlertAfter <= 0 || configFetchAlertAfter <= 0 || startupGracePeriod < 0 {
+		return fmt.Errorf("the alert thresholds must be positive")
+	}
+
+	if layeredConfig && (configServerRootUrl == "" || localConfigPath == "") {
+		return fmt.Errorf("-layered-config requires both -config-server-root-url and -local-config-path")
+	}
+
+	if kasaDriver != "native" && kasaDriver != "cli" {
+		return fmt.Errorf("-kasa-driver must be native or cli")
+	}
+	if mqttPassword == "" {
+		mqttPassword = os.Getenv("MQTT_PASSWORD")
+	}
+	if strings.Contains(mqttTopicPrefix, "+") || strings.Contains(mqttTopicPrefix, "#") {
+		return fmt.Errorf("-mqtt-topic-prefix can't have wildcards")
+	}
+	if kasaPassword == "" {
+		kasaPassword = os.Getenv("KASA_PASSWORD")
+	}
+
 	//set kasa path
 	if kasaPath == "" {
 		kasaPath = os.Getenv("KASA_PATH")
@@ -106,6 +308,5 @@ func validateParams() error {
 		}
 	}
 
-	//TODO check if we can execute kasa
 	return nil
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jroedel/tmpcontrol"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// runSimulate `tmpcontrol simulate [flags] <config file>` runs the config's schedules against a thermal model and writes
+// the temperature and switch trace as CSV
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	output := fs.String("output", "-", "Where to write the CSV trace, - for stdout")
+	start := fs.String("start", "", "When to start, RFC 3339 (default the earliest schedule entry)")
+	duration := fs.Duration("duration", 0, "How long to simulate, e.g. 336h (default until a day past the latest schedule entry)")
+	modelsPath := fs.String("models", "", "A JSON file of thermal models by controller name, for controllers that differ from the flags below")
+	model := tmpcontrol.DefaultThermalModel()
+	initialTemperature := fs.Float64("initial-temperature", float64(model.InitialTemperature), "The temperature at the start, °F")
+	ambient := fs.Float64("ambient", float64(model.Ambient), "The temperature around the batch, °F")
+	timeConstant := fs.Duration("time-constant", time.Duration(model.TimeConstant), "How long the batch takes to close 63% of the gap to ambient on its own")
+	heatingRate := fs.Float64("heating-rate", float64(model.HeatingRate), "How fast a heater warms the batch, °F an hour")
+	coolingRate := fs.Float64("cooling-rate", float64(model.CoolingRate), "How fast a cooler cools the batch, °F an hour")
+	lag := fs.Duration("lag", time.Duration(model.Lag), "How long after its switch hosts change the batch responds")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpcontrol simulate [flags] <config file>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	content, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config, err := tmpcontrol.DecodeConfig(fs.Arg(0), content)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+	simulation := tmpcontrol.NewSimulation(config)
+	simulation.DefaultModel = tmpcontrol.ThermalModel{
+		InitialTemperature: float32(*initialTemperature),
+		Ambient:            float32(*ambient),
+		TimeConstant:       tmpcontrol.Duration(*timeConstant),
+		HeatingRate:        float32(*heatingRate),
+		CoolingRate:        float32(*coolingRate),
+		Lag:                tmpcontrol.Duration(*lag),
+	}
+	if *modelsPath != "" {
+		content, err := os.ReadFile(*modelsPath)
+		if err == nil {
+			err = json.Unmarshal(content, &simulation.Models)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *modelsPath, err)
+			return 1
+		}
+	}
+	if *start != "" {
+		if simulation.Start, err = time.Parse(time.RFC3339, *start); err != nil {
+			fmt.Fprintf(os.Stderr, "-start: %s\n", err)
+			return 2
+		}
+	}
+	simulation.Duration = *duration
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer out.Close()
+	}
+	buffered := bufio.NewWriter(out)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	results, err := simulation.WriteCsv(ctx, buffered)
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "The simulation failed: %s\n", err)
+		return 1
+	}
+	for _, result := range results {
+		fmt.Fprintln(os.Stderr, result)
+	}
+	return 0
+}
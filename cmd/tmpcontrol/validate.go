@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jroedel/tmpcontrol"
+	"os"
+)
+
+// runValidate `tmpcontrol validate [-print-schema] <file>...` exits 1 if any file has problems, so it can run as a
+// pre-commit hook
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	printSchema := fs.Bool("print-schema", false, "Print the JSON Schema for config files and exit")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tmpcontrol validate [-print-schema] <config file>...\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *printSchema {
+		fmt.Println(string(tmpcontrol.ConfigJsonSchema()))
+		return 0
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	exitCode := 0
+	for _, path := range fs.Args() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			exitCode = 1
+			continue
+		}
+		errs := tmpcontrol.ValidateConfigFile(path, content)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%s\n", path, err.Error())
+		}
+		if len(errs) > 0 {
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s: OK\n", path)
+	}
+	return exitCode
+}
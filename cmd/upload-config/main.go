@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/jroedel/tmpcontrol"
 	"os"
 )
@@ -13,7 +14,7 @@ var (
 )
 
 func init() {
-	flag.StringVar(&configPath, "config", "", "path to config file")
+	flag.StringVar(&configPath, "config", "", "path to config file (.json, .yaml, .yml or .toml)")
 	flag.StringVar(&serverRoot, "server", "", "path to server root")
 	flag.StringVar(&clientId, "client-id", "", "client id to upload config for")
 }
@@ -24,6 +25,24 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		fmt.Printf("We couldn't read %s: %s\n", configPath, err)
+		os.Exit(1)
+	}
+	config, err := tmpcontrol.DecodeConfig(configPath, content)
+	if err != nil {
+		fmt.Printf("We couldn't decode %s as %s: %s\n", configPath, tmpcontrol.DetectConfigFormat(configPath, content), err)
+		os.Exit(1)
+	}
+	if err := tmpcontrol.ValidateConfig(config); err != nil {
+		fmt.Printf("%s isn't a valid config:\n%s\n", configPath, err)
+		os.Exit(1)
+	}
 	cg := tmpcontrol.ConfigGopher{ServerRoot: serverRoot, ClientId: clientId}
-
+	if err := cg.SendConfig(config); err != nil {
+		fmt.Printf("We couldn't upload the config: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("We uploaded %d controller(s) for %s\n", len(config.Controllers), clientId)
 }
@@ -0,0 +1,95 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type ConfigFormat int
+
+const (
+	ConfigFormatJSON ConfigFormat = iota + 1
+	ConfigFormatYAML
+	ConfigFormatTOML
+)
+
+func (f ConfigFormat) String() string {
+	switch f {
+	case ConfigFormatJSON:
+		return "json"
+	case ConfigFormatYAML:
+		return "yaml"
+	case ConfigFormatTOML:
+		return "toml"
+	default:
+		return ""
+	}
+}
+
+// tomlTableOrAssignment matches a line that's only plausible in TOML, like `[[controllers]]` or `name = "fridge"`
+var tomlTableOrAssignment = regexp.MustCompile(`(?m)^\s*(\[\[?[A-Za-z0-9_.-]+\]\]?|[A-Za-z0-9_"-]+\s*=)`)
+
+// DetectConfigFormat picks the format by the file extension, or by sniffing the content if the extension isn't one we know
+func DetectConfigFormat(path string, content []byte) ConfigFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ConfigFormatJSON
+	case ".yaml", ".yml":
+		return ConfigFormatYAML
+	case ".toml":
+		return ConfigFormatTOML
+	}
+	trimmed := bytes.TrimSpace(content)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return ConfigFormatJSON
+	}
+	if tomlTableOrAssignment.Match(trimmed) {
+		return ConfigFormatTOML
+	}
+	return ConfigFormatYAML
+}
+
+// DecodeConfig decodes a JSON, YAML or TOML config file. See DetectConfigFormat
+func DecodeConfig(path string, content []byte) (ControllersConfig, error) {
+	var config ControllersConfig
+	if err := decodeConfigInto(DetectConfigFormat(path, content), content, &config); err != nil {
+		return ControllersConfig{}, err
+	}
+	return config, nil
+}
+
+// decodeConfigInto YAML and TOML are converted to JSON first so every format maps onto our structs through the same
+// json tags, and schedule keys are parsed as RFC 3339 timestamps no matter which format they were written in
+func decodeConfigInto(format ConfigFormat, content []byte, v interface{}) error {
+	switch format {
+	case ConfigFormatYAML:
+		var generic map[string]interface{}
+		if err := yaml.Unmarshal(content, &generic); err != nil {
+			return fmt.Errorf("yaml: %w", err)
+		}
+		return convertGenericConfig(generic, v)
+	case ConfigFormatTOML:
+		var generic map[string]interface{}
+		if _, err := toml.Decode(string(content), &generic); err != nil {
+			return fmt.Errorf("toml: %w", err)
+		}
+		return convertGenericConfig(generic, v)
+	default:
+		return json.Unmarshal(content, v)
+	}
+}
+
+func convertGenericConfig(generic map[string]interface{}, v interface{}) error {
+	asJson, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(asJson, v)
+}
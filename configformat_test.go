@@ -0,0 +1,128 @@
+package tmpcontrol
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const formatTestJson = `{
+  "controllers": [
+    {
+      "name": "fermenter",
+      "thermometerPath": "/sys/bus/w1/devices/28-1/temperature",
+      "controlType": "cool",
+      "switchHosts": ["192.168.0.11"],
+      "disableFreezeProtection": true,
+      "timing": {"interval": "30s", "timeout": 20},
+      "temperatureSchedule": {
+        "2024-07-01T00:00:00Z": 68,
+        "2024-07-09T12:00:00Z": 56.5
+      }
+    }
+  ]
+}`
+
+const formatTestYaml = `
+# cold crash after a week
+controllers:
+  - name: fermenter
+    thermometerPath: /sys/bus/w1/devices/28-1/temperature
+    controlType: cool
+    switchHosts:
+      - 192.168.0.11
+    disableFreezeProtection: true
+    timing:
+      interval: 30s
+      timeout: 20
+    temperatureSchedule:
+      2024-07-01T00:00:00Z: 68
+      2024-07-09T14:00:00+02:00: 56.5
+`
+
+const formatTestToml = `
+# cold crash after a week
+[[controllers]]
+name = "fermenter"
+thermometerPath = "/sys/bus/w1/devices/28-1/temperature"
+controlType = "cool"
+switchHosts = ["192.168.0.11"]
+disableFreezeProtection = true
+
+[controllers.timing]
+interval = "30s"
+timeout = 20
+
+[controllers.temperatureSchedule]
+"2024-07-01T00:00:00Z" = 68
+"2024-07-09T12:00:00Z" = 56.5
+`
+
+// normalizedSchedules the config with every schedule time in UTC, so configs that name the same instants compare equal
+func normalizedSchedules(config ControllersConfig) ControllersConfig {
+	controllers := make([]Controller, len(config.Controllers))
+	for i, controller := range config.Controllers {
+		schedule := make(map[time.Time]float32, len(controller.TemperatureSchedule))
+		for at, temperature := range controller.TemperatureSchedule {
+			schedule[at.UTC()] = temperature
+		}
+		controller.TemperatureSchedule = schedule
+		controllers[i] = controller
+	}
+	config.Controllers = controllers
+	return config
+}
+
+func TestDecodeConfig(t *testing.T) {
+	expected, err := DecodeConfig("config.json", []byte(formatTestJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected.Controllers) != 1 || expected.Controllers[0].TemperatureSchedule[time.Date(2024, 7, 9, 12, 0, 0, 0, time.UTC)] != 56.5 ||
+		!expected.Controllers[0].DisableFreezeProtection || expected.Controllers[0].Timing == nil || expected.Controllers[0].Timing.Timeout != Duration(20*time.Second) {
+		t.Fatalf("unexpected json config: %+v", expected)
+	}
+	expected = normalizedSchedules(expected)
+
+	cases := []struct {
+		path    string
+		content string
+		format  ConfigFormat
+	}{
+		{"config.yaml", formatTestYaml, ConfigFormatYAML},
+		{"config.yml", formatTestYaml, ConfigFormatYAML},
+		{"config.toml", formatTestToml, ConfigFormatTOML},
+		{"config", formatTestJson, ConfigFormatJSON},
+		{"config", formatTestYaml, ConfigFormatYAML},
+		{"config", formatTestToml, ConfigFormatTOML},
+	}
+	for _, c := range cases {
+		if format := DetectConfigFormat(c.path, []byte(c.content)); format != c.format {
+			t.Errorf("%s: expected format %s, got %s", c.path, c.format, format)
+			continue
+		}
+		config, err := DecodeConfig(c.path, []byte(c.content))
+		if err != nil {
+			t.Errorf("%s (%s): %s", c.path, c.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(expected, normalizedSchedules(config)) {
+			t.Errorf("%s (%s): expected %+v, got %+v", c.path, c.format, expected, config)
+		}
+	}
+
+	//unquoted YAML timestamps are parsed to the exact instant, whatever their offset
+	config, err := DecodeConfig("config.yaml", []byte(formatTestYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for at := range config.Controllers[0].TemperatureSchedule {
+		if !at.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)) && !at.Equal(time.Date(2024, 7, 9, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("unexpected schedule time %s", at)
+		}
+	}
+
+	if _, err := DecodeConfig("config.yaml", []byte("controllers: [")); err == nil {
+		t.Error("expected an error decoding malformed yaml")
+	}
+}
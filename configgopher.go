@@ -1,7 +1,6 @@
 package tmpcontrol
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
@@ -23,6 +22,12 @@ type ConfigGopher struct {
 	ConfigFetchInterval time.Duration
 	//if a Writer is defined, server notifications will be written additionally to this Writer
 	NotifyOutput io.Writer
+	//Layered if both ServerRoot and LocalConfigPath are set, use the server config as the base and apply the local file on top of it
+	Layered bool
+	//Logger optional, used to report details such as which layer each value of a layered config came from
+	Logger Logger
+	//LocalConfigWatchDebounce how long LocalConfigPath must be quiet before WatchLocalConfig re-reads it. Defaults to half a second
+	LocalConfigWatchDebounce time.Duration
 }
 
 type ServerNotificationUrgency int
@@ -72,8 +77,28 @@ func (s *ServerNotificationUrgency) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// SendConfig upload config to the server for our ClientId
 func (cg *ConfigGopher) SendConfig(config ControllersConfig) error {
-	//TODO POST
+	if cg.ServerRoot == "" {
+		return fmt.Errorf("ConfigGopher: we need a ServerRoot to send config to")
+	}
+	if err := cg.HasError(); err != nil {
+		return err
+	}
+	body, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	response, err := http.Post(cg.getServerRequestUrl(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var message ApiMessage
+		_ = json.NewDecoder(response.Body).Decode(&message)
+		return fmt.Errorf("server responded with %d: %s", response.StatusCode, message.Message)
+	}
 	return nil
 }
 
@@ -88,11 +113,21 @@ func (cg *ConfigGopher) NotifyServer(message string, urgency ServerNotificationU
 	}
 }
 
+// FlushNotifications if NotifyOutput buffers notifications (it has a `Flush() error` method), make sure they're sent
+func (cg *ConfigGopher) FlushNotifications() error {
+	if flusher, ok := cg.NotifyOutput.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
 func (cg *ConfigGopher) GetSourceKind() (ConfigSource, bool) {
 	if err := cg.HasError(); err != nil {
 		return 0, false
 	}
-	if cg.ServerRoot != "" {
+	if cg.isLayered() {
+		return ConfigSourceLayered, true
+	} else if cg.ServerRoot != "" {
 		return ConfigSourceServer, true
 	} else if cg.LocalConfigPath != "" {
 		return ConfigSourceLocalFile, true
@@ -106,17 +141,29 @@ func (cg *ConfigGopher) FetchConfig() (ControllersConfig, ConfigSource, error) {
 	}
 
 	//TODO notify user/server if there are no configured switchHosts
-	if cg.ServerRoot != "" {
-		config, err := cg.fetchConfigFromServer()
-		return config, ConfigSourceServer, err
+	var config ControllersConfig
+	var source ConfigSource
+	var err error
+	if cg.isLayered() {
+		config, err = cg.fetchLayeredConfig()
+		source = ConfigSourceLayered
+	} else if cg.ServerRoot != "" {
+		config, err = cg.fetchConfigFromServer()
+		source = ConfigSourceServer
 	} else if cg.LocalConfigPath != "" {
 		//fetch from file
-		config, err := cg.fetchConfigFromFile()
-		return config, ConfigSourceLocalFile, err
+		config, err = cg.fetchConfigFromFile()
+		source = ConfigSourceLocalFile
+	} else {
+		return ControllersConfig{}, 0, fmt.Errorf("please specify a configuration file path or control server url")
 	}
-
-	//TODO validate configuration. for example, no duplicate Controller names, also "heat"/"cool"
-	return ControllersConfig{}, 0, fmt.Errorf("please specify a configuration file path or control server url")
+	if err != nil {
+		return config, source, err
+	}
+	if err := ValidateConfig(config); err != nil {
+		return ControllersConfig{}, source, fmt.Errorf("the config from %s is invalid: %w", source, err)
+	}
+	return config, source, nil
 }
 
 func (cg *ConfigGopher) HasError() error {
@@ -133,9 +180,16 @@ func (cg *ConfigGopher) HasError() error {
 	} else if cg.LocalConfigPath == "" {
 		return fmt.Errorf("ConfigGopher: we require either a ServerRoot or LocalConfigPath")
 	}
+	if cg.Layered && (cg.ServerRoot == "" || cg.LocalConfigPath == "") {
+		return fmt.Errorf("ConfigGopher: a layered config requires both a ServerRoot and a LocalConfigPath")
+	}
 	return nil
 }
 
+func (cg *ConfigGopher) isLayered() bool {
+	return cg.Layered && cg.ServerRoot != "" && cg.LocalConfigPath != ""
+}
+
 func (cg *ConfigGopher) fetchConfigFromServer() (ControllersConfig, error) {
 	err := cg.HasError()
 	if err != nil {
@@ -181,22 +235,14 @@ func (cg *ConfigGopher) getServerRequestUrl() string {
 	return url
 }
 
+// fetchConfigFromFile the file may be JSON, YAML or TOML, see DetectConfigFormat
 func (cg *ConfigGopher) fetchConfigFromFile() (ControllersConfig, error) {
-	file, err := os.Open(cg.LocalConfigPath)
+	content, err := os.ReadFile(cg.LocalConfigPath)
 	if err != nil {
 		return ControllersConfig{}, err
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			return
-		}
-	}(file)
-	rd := bufio.NewReader(file)
-
-	var config ControllersConfig
-	dec := json.NewDecoder(rd)
-	if err := dec.Decode(&config); err != nil {
+	config, err := DecodeConfig(cg.LocalConfigPath, content)
+	if err != nil {
 		return ControllersConfig{}, err
 	}
 
@@ -0,0 +1,212 @@
+package tmpcontrol
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controllerLayer mirrors Controller, but with pointer fields so we can tell which values a local
+// override file actually sets. A nil field means "keep whatever the server said"
+type controllerLayer struct {
+	Name                    string                 `json:"name"`
+	ThermometerPath         *string                `json:"thermometerPath"`
+	ControlType             *string                `json:"controlType"`
+	SwitchHosts             *[]string              `json:"switchHosts"`
+	TemperatureSchedule     *map[time.Time]float32 `json:"temperatureSchedule"`
+	DisableFreezeProtection *bool                  `json:"disableFreezeProtection"`
+	Timing                  *ControlTiming         `json:"timing"`
+	Calibration             *SensorCalibration     `json:"calibration"`
+	Filter                  *SensorFilter          `json:"filter"`
+	Sensors                 *[]ControllerSensor    `json:"sensors"`
+	SensorPolicy            *SensorPolicy          `json:"sensorPolicy"`
+}
+
+type controllersConfigLayer struct {
+	Controllers           []controllerLayer `json:"controllers"`
+	Timing                *ControlTiming    `json:"timing"`
+	ConfigFetchAlertAfter *Duration         `json:"configFetchAlertAfter"`
+}
+
+// ConfigProvenance maps a controller name to each of its config fields (by json name) and the layer that supplied it.
+// The top-level fields, like timing, are under the empty name
+type ConfigProvenance map[string]map[string]ConfigSource
+
+// fetchLayeredConfig fetches the server config and applies the local file on top of it
+func (cg *ConfigGopher) fetchLayeredConfig() (ControllersConfig, error) {
+	base, err := cg.fetchConfigFromServer()
+	if err != nil {
+		return ControllersConfig{}, fmt.Errorf("layered config: fetching the base config from the server: %w", err)
+	}
+	overlay, err := cg.fetchConfigLayerFromFile()
+	if err != nil {
+		return ControllersConfig{}, fmt.Errorf("layered config: reading the local overrides: %w", err)
+	}
+	merged, provenance, err := mergeConfigLayers(base, overlay)
+	if err != nil {
+		return ControllersConfig{}, fmt.Errorf("layered config: %w", err)
+	}
+	for _, line := range provenance.describe() {
+		cg.logf("%s layered config: %s\n", stdTimestamp(), line)
+	}
+	return merged, nil
+}
+
+func (cg *ConfigGopher) fetchConfigLayerFromFile() (controllersConfigLayer, error) {
+	content, err := os.ReadFile(cg.LocalConfigPath)
+	if err != nil {
+		return controllersConfigLayer{}, err
+	}
+	var layer controllersConfigLayer
+	if err := decodeConfigInto(DetectConfigFormat(cg.LocalConfigPath, content), content, &layer); err != nil {
+		return controllersConfigLayer{}, err
+	}
+	return layer, nil
+}
+
+// mergeConfigLayers applies overlay on top of base using these rules:
+//   - controllers are matched by name
+//   - a field set in the overlay replaces the base field entirely (schedules and host lists aren't merged entry by entry)
+//   - a field missing from the overlay keeps the base value
+//   - an overlay controller with a name the base doesn't know about is added
+//   - the top-level timing and configFetchAlertAfter follow the same rules as a controller's fields
+func mergeConfigLayers(base ControllersConfig, overlay controllersConfigLayer) (ControllersConfig, ConfigProvenance, error) {
+	provenance := make(ConfigProvenance)
+	merged := ControllersConfig{
+		Controllers:           make([]Controller, 0, len(base.Controllers)+len(overlay.Controllers)),
+		Timing:                base.Timing,
+		ConfigFetchAlertAfter: base.ConfigFetchAlertAfter,
+	}
+	provenance.setAll("", ConfigSourceServer)
+	if overlay.Timing != nil {
+		merged.Timing = overlay.Timing
+		provenance[""]["timing"] = ConfigSourceLocalFile
+	}
+	if overlay.ConfigFetchAlertAfter != nil {
+		merged.ConfigFetchAlertAfter = *overlay.ConfigFetchAlertAfter
+		provenance[""]["configFetchAlertAfter"] = ConfigSourceLocalFile
+	}
+	indexByName := make(map[string]int)
+	for _, controller := range base.Controllers {
+		indexByName[controller.Name] = len(merged.Controllers)
+		merged.Controllers = append(merged.Controllers, controller)
+		provenance.setAll(controller.Name, ConfigSourceServer)
+	}
+
+	seenInOverlay := make(map[string]bool)
+	for _, layer := range overlay.Controllers {
+		if layer.Name == "" {
+			return ControllersConfig{}, nil, fmt.Errorf("every controller in the local overrides needs a name")
+		}
+		if seenInOverlay[layer.Name] {
+			return ControllersConfig{}, nil, fmt.Errorf("controller %s appears more than once in the local overrides", layer.Name)
+		}
+		seenInOverlay[layer.Name] = true
+
+		i, ok := indexByName[layer.Name]
+		if !ok {
+			indexByName[layer.Name] = len(merged.Controllers)
+			merged.Controllers = append(merged.Controllers, Controller{Name: layer.Name})
+			i = indexByName[layer.Name]
+			provenance.setAll(layer.Name, ConfigSourceLocalFile)
+		}
+		applyControllerLayer(&merged.Controllers[i], layer, provenance[layer.Name])
+	}
+	return merged, provenance, nil
+}
+
+func applyControllerLayer(c *Controller, layer controllerLayer, fields map[string]ConfigSource) {
+	if layer.ThermometerPath != nil {
+		c.ThermometerPath = *layer.ThermometerPath
+		fields["thermometerPath"] = ConfigSourceLocalFile
+	}
+	if layer.ControlType != nil {
+		c.ControlType = *layer.ControlType
+		fields["controlType"] = ConfigSourceLocalFile
+	}
+	if layer.SwitchHosts != nil {
+		c.SwitchHosts = *layer.SwitchHosts
+		fields["switchHosts"] = ConfigSourceLocalFile
+	}
+	if layer.TemperatureSchedule != nil {
+		c.TemperatureSchedule = *layer.TemperatureSchedule
+		fields["temperatureSchedule"] = ConfigSourceLocalFile
+	}
+	if layer.DisableFreezeProtection != nil {
+		c.DisableFreezeProtection = *layer.DisableFreezeProtection
+		fields["disableFreezeProtection"] = ConfigSourceLocalFile
+	}
+	if layer.Timing != nil {
+		c.Timing = layer.Timing
+		fields["timing"] = ConfigSourceLocalFile
+	}
+	if layer.Calibration != nil {
+		c.Calibration = layer.Calibration
+		fields["calibration"] = ConfigSourceLocalFile
+	}
+	if layer.Filter != nil {
+		c.Filter = layer.Filter
+		fields["filter"] = ConfigSourceLocalFile
+	}
+	if layer.Sensors != nil {
+		c.Sensors = *layer.Sensors
+		fields["sensors"] = ConfigSourceLocalFile
+	}
+	if layer.SensorPolicy != nil {
+		c.SensorPolicy = layer.SensorPolicy
+		fields["sensorPolicy"] = ConfigSourceLocalFile
+	}
+}
+
+var layeredControllerFields = []string{"thermometerPath", "controlType", "switchHosts", "temperatureSchedule", "disableFreezeProtection", "timing", "calibration", "filter", "sensors", "sensorPolicy"}
+
+var layeredTopLevelFields = []string{"timing", "configFetchAlertAfter"}
+
+// layeredFields the fields tracked under a name in ConfigProvenance
+func layeredFields(controllerName string) []string {
+	if controllerName == "" {
+		return layeredTopLevelFields
+	}
+	return layeredControllerFields
+}
+
+func (p ConfigProvenance) setAll(controllerName string, source ConfigSource) {
+	fields := make(map[string]ConfigSource, len(layeredFields(controllerName)))
+	for _, field := range layeredFields(controllerName) {
+		fields[field] = source
+	}
+	p[controllerName] = fields
+}
+
+// describe renders one line per controller, e.g. "[fridge] server: controlType, switchHosts; local file: thermometerPath",
+// after one for the top-level fields, e.g. "[top level] server: timing, configFetchAlertAfter"
+func (p ConfigProvenance) describe() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		bySource := make(map[ConfigSource][]string)
+		for _, field := range layeredFields(name) {
+			source := p[name][field]
+			bySource[source] = append(bySource[source], field)
+		}
+		var parts []string
+		for _, source := range []ConfigSource{ConfigSourceServer, ConfigSourceLocalFile} {
+			if len(bySource[source]) > 0 {
+				parts = append(parts, fmt.Sprintf("%s: %s", source, strings.Join(bySource[source], ", ")))
+			}
+		}
+		label := name
+		if label == "" {
+			label = "top level"
+		}
+		lines = append(lines, fmt.Sprintf("[%s] %s", label, strings.Join(parts, "; ")))
+	}
+	return lines
+}
@@ -0,0 +1,163 @@
+package tmpcontrol
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestConfigGopher_FetchLayeredConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/configuration/test-client" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"controllers": [
+			{"name": "fridge", "thermometerPath": "/sys/bus/w1/devices/28-1/temperature", "controlType": "cool",
+			 "switchHosts": ["192.168.0.11"], "temperatureSchedule": {"2024-07-01T00:00:00Z": 33}},
+			{"name": "mash", "thermometerPath": "/sys/bus/w1/devices/28-2/temperature", "controlType": "heat",
+			 "switchHosts": ["192.168.0.12"], "temperatureSchedule": {"2024-07-01T00:00:00Z": 150}}
+		]}`))
+	}))
+	defer server.Close()
+
+	localPath := filepath.Join(t.TempDir(), "local.json")
+	err := os.WriteFile(localPath, []byte(`{"controllers": [
+		{"name": "fridge", "thermometerPath": "/tmp/test-thermometer", "disableFreezeProtection": true},
+		{"name": "bench", "thermometerPath": "/tmp/bench", "controlType": "heat", "switchHosts": ["192.168.0.99"]}
+	]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cg := ConfigGopher{ServerRoot: server.URL, ClientId: "test-client", LocalConfigPath: localPath, Layered: true}
+	config, source, err := cg.FetchConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != ConfigSourceLayered {
+		t.Errorf("expected source %s, got %s", ConfigSourceLayered, source)
+	}
+	if len(config.Controllers) != 3 {
+		t.Fatalf("expected 3 controllers, got %d", len(config.Controllers))
+	}
+
+	fridge := config.Controllers[0]
+	if fridge.Name != "fridge" || fridge.ThermometerPath != "/tmp/test-thermometer" || !fridge.DisableFreezeProtection {
+		t.Errorf("expected the local file to override the fridge thermometer and freeze protection: %+v", fridge)
+	}
+	if fridge.ControlType != "cool" || !slices.Equal(fridge.SwitchHosts, []string{"192.168.0.11"}) || len(fridge.TemperatureSchedule) != 1 {
+		t.Errorf("expected the fields missing from the local file to come from the server: %+v", fridge)
+	}
+	if mash := config.Controllers[1]; mash.ThermometerPath != "/sys/bus/w1/devices/28-2/temperature" {
+		t.Errorf("expected the mash controller to be untouched: %+v", mash)
+	}
+	if bench := config.Controllers[2]; bench.Name != "bench" || bench.ControlType != "heat" {
+		t.Errorf("expected the bench controller to be added from the local file: %+v", bench)
+	}
+}
+
+func TestMergeConfigLayers_Provenance(t *testing.T) {
+	path := "/tmp/override"
+	base := ControllersConfig{Controllers: []Controller{{Name: "fridge", ThermometerPath: "/a", ControlType: "cool"}}}
+	overlay := controllersConfigLayer{Controllers: []controllerLayer{{Name: "fridge", ThermometerPath: &path}}}
+
+	_, provenance, err := mergeConfigLayers(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provenance["fridge"]["thermometerPath"] != ConfigSourceLocalFile {
+		t.Errorf("expected thermometerPath to come from the local file")
+	}
+	if provenance["fridge"]["controlType"] != ConfigSourceServer {
+		t.Errorf("expected controlType to come from the server")
+	}
+	lines := provenance.describe()
+	expected := []string{
+		"[top level] server: timing, configFetchAlertAfter",
+		"[fridge] server: controlType, switchHosts, temperatureSchedule, disableFreezeProtection, timing, calibration, filter, sensors, sensorPolicy; local file: thermometerPath",
+	}
+	if !slices.Equal(lines, expected) {
+		t.Errorf("unexpected provenance description: %#v", lines)
+	}
+
+	duplicated := controllersConfigLayer{Controllers: []controllerLayer{{Name: "fridge"}, {Name: "fridge"}}}
+	if _, _, err := mergeConfigLayers(base, duplicated); err == nil {
+		t.Error("expected an error since the local overrides name the same controller twice")
+	}
+}
+
+func TestMergeConfigLayers_SensorCorrection(t *testing.T) {
+	base := ControllersConfig{Controllers: []Controller{{
+		Name:            "fridge",
+		ThermometerPath: "w1:28-1",
+		ControlType:     "cool",
+		Calibration:     &SensorCalibration{Offset: 1},
+		Filter:          &SensorFilter{Median: 3},
+	}}}
+	//the probe was recalibrated on the Pi; the server's filter stays
+	calibration := &SensorCalibration{Points: []CalibrationPoint{{Raw: 33, Actual: 32}, {Raw: 210, Actual: 212}}}
+	overlay := controllersConfigLayer{Controllers: []controllerLayer{{Name: "fridge", Calibration: calibration}}}
+
+	merged, provenance, err := mergeConfigLayers(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fridge := merged.Controllers[0]
+	if fridge.Calibration != calibration || fridge.Filter == nil || fridge.Filter.Median != 3 {
+		t.Errorf("expected the local calibration and the server's filter, got %+v, %+v", fridge.Calibration, fridge.Filter)
+	}
+	if provenance["fridge"]["calibration"] != ConfigSourceLocalFile || provenance["fridge"]["filter"] != ConfigSourceServer {
+		t.Errorf("unexpected provenance: %+v", provenance["fridge"])
+	}
+
+	//and from a local file, as decoded
+	var layer controllersConfigLayer
+	if err := decodeConfigInto(ConfigFormatJSON, []byte(`{"controllers": [{"name": "fridge", "filter": {"median": 5, "maxRate": 2}}]}`), &layer); err != nil {
+		t.Fatal(err)
+	}
+	if merged, _, err = mergeConfigLayers(base, layer); err != nil {
+		t.Fatal(err)
+	}
+	if fridge := merged.Controllers[0]; fridge.Filter == nil || *fridge.Filter != (SensorFilter{Median: 5, MaxRate: 2}) || fridge.Calibration.Offset != 1 {
+		t.Errorf("expected the local filter and the server's calibration, got %+v, %+v", fridge.Filter, fridge.Calibration)
+	}
+}
+
+func TestMergeConfigLayers_TopLevel(t *testing.T) {
+	base := ControllersConfig{
+		Controllers:           []Controller{{Name: "fridge", ThermometerPath: "/a", ControlType: "cool"}},
+		Timing:                &ControlTiming{Interval: Duration(30 * time.Second), TempReadAlertAfter: Duration(5 * time.Minute)},
+		ConfigFetchAlertAfter: Duration(time.Hour),
+	}
+
+	//the server's values are kept when the local file doesn't set them
+	merged, provenance, err := mergeConfigLayers(base, controllersConfigLayer{Controllers: []controllerLayer{{Name: "fridge"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Timing == nil || *merged.Timing != *base.Timing || merged.ConfigFetchAlertAfter != Duration(time.Hour) {
+		t.Errorf("expected the server's timing and configFetchAlertAfter, got %+v, %s", merged.Timing, time.Duration(merged.ConfigFetchAlertAfter))
+	}
+	if provenance[""]["timing"] != ConfigSourceServer || provenance[""]["configFetchAlertAfter"] != ConfigSourceServer {
+		t.Errorf("expected the top-level fields to come from the server: %+v", provenance[""])
+	}
+
+	//and replaced when it does
+	localFetchAlertAfter := Duration(10 * time.Minute)
+	overlay := controllersConfigLayer{Timing: &ControlTiming{Interval: Duration(5 * time.Second)}, ConfigFetchAlertAfter: &localFetchAlertAfter}
+	merged, provenance, err = mergeConfigLayers(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Timing == nil || *merged.Timing != *overlay.Timing || merged.ConfigFetchAlertAfter != localFetchAlertAfter {
+		t.Errorf("expected the local timing and configFetchAlertAfter, got %+v, %s", merged.Timing, time.Duration(merged.ConfigFetchAlertAfter))
+	}
+	if provenance[""]["timing"] != ConfigSourceLocalFile || provenance[""]["configFetchAlertAfter"] != ConfigSourceLocalFile {
+		t.Errorf("expected the top-level fields to come from the local file: %+v", provenance[""])
+	}
+}
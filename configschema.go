@@ -0,0 +1,215 @@
+package tmpcontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ConfigSchemaPath where tmpserver serves ConfigJsonSchema
+const ConfigSchemaPath = "/schema/controllers-config.json"
+
+// jsonSchema the subset of JSON Schema (draft 2020-12) we need to describe ControllersConfig
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"` //false or a *jsonSchema
+	PropertyNames        *jsonSchema            `json:"propertyNames,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	AnyOf                []*jsonSchema          `json:"anyOf,omitempty"`
+}
+
+// configSchemaRequired the json names of the required fields, by struct name
+var configSchemaRequired = map[string][]string{
+	"ControllersConfig": {"controllers"},
+	"Controller":        {"name", "controlType"},
+	"ControllerSensor":  {"path"},
+}
+
+// configSchemaConstraints extra constraints by "StructName.jsonName", applied on top of the generated schema
+var configSchemaConstraints = map[string]func(s *jsonSchema){
+	"Controller.name": func(s *jsonSchema) {
+		s.Pattern = ClientIdentifiersRegex.String()
+	},
+	"Controller.controlType": func(s *jsonSchema) {
+		s.Enum = []string{"heat", "cool"}
+	},
+	"ControllerSensor.role": func(s *jsonSchema) {
+		s.Enum = sensorRoles
+	},
+	"SensorPolicy.mode": func(s *jsonSchema) {
+		s.Enum = sensorPolicyModes
+	},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// durationPattern what time.ParseDuration accepts, minus the sign
+const durationPattern = `^([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+$`
+
+// ConfigJsonSchema a JSON Schema describing ControllersConfig, generated from the struct definitions
+func ConfigJsonSchema() []byte {
+	b, err := json.MarshalIndent(configJsonSchema(), "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("we couldn't marshal our own schema: %s", err))
+	}
+	return b
+}
+
+func configJsonSchema() *jsonSchema {
+	s := schemaForType(reflect.TypeOf(ControllersConfig{}))
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.Title = "tmpcontrol controllers config"
+	return s
+}
+
+func schemaForType(t reflect.Type) *jsonSchema {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	}
+	if t == durationType {
+		return &jsonSchema{AnyOf: []*jsonSchema{{Type: "string", Pattern: durationPattern}, {Type: "number"}}}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema), AdditionalProperties: false}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := jsonFieldName(field)
+			if name == "" {
+				continue
+			}
+			property := schemaForType(field.Type)
+			if constrain, ok := configSchemaConstraints[t.Name()+"."+name]; ok {
+				constrain(property)
+			}
+			s.Properties[name] = property
+		}
+		s.Required = configSchemaRequired[t.Name()]
+		return s
+	case reflect.Map:
+		s := &jsonSchema{Type: "object", AdditionalProperties: schemaForType(t.Elem())}
+		if t.Key() == timeType {
+			s.PropertyNames = &jsonSchema{Type: "string", Format: "date-time"}
+		}
+		return s
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaForType(t.Elem())}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	default:
+		return &jsonSchema{}
+	}
+}
+
+// jsonFieldName returns "" for fields encoding/json skips
+func jsonFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func validateAgainstSchema(s *jsonSchema, n *configNode, path string) ConfigErrors {
+	var errs ConfigErrors
+	fail := func(pos configPosition, path string, format string, v ...interface{}) {
+		errs = append(errs, ConfigError{Path: path, Line: pos.line, Column: pos.column, Message: fmt.Sprintf(format, v...)})
+	}
+	if s.Type != "" && !n.hasSchemaType(s.Type) {
+		fail(n.pos, path, "expected %s, got %s", s.Type, n.kind)
+		return errs
+	}
+	if len(s.AnyOf) > 0 {
+		//report against the alternative of the node's type, which gives a more useful message than listing them all
+		var types []string
+		for _, alternative := range s.AnyOf {
+			if n.hasSchemaType(alternative.Type) {
+				return append(errs, validateAgainstSchema(alternative, n, path)...)
+			}
+			types = append(types, alternative.Type)
+		}
+		fail(n.pos, path, "expected %s, got %s", strings.Join(types, " or "), n.kind)
+		return errs
+	}
+
+	switch n.kind {
+	case configObject:
+		for _, required := range s.Required {
+			if _, ok := n.fields[required]; !ok {
+				fail(n.pos, path, "missing required property %#v", required)
+			}
+		}
+		for _, key := range n.keys {
+			childPath := path + "/" + escapeJsonPointer(key)
+			keyPos := n.keyPositions[key]
+			if s.PropertyNames != nil {
+				keyNode := &configNode{kind: configString, scalar: key, pos: keyPos}
+				errs = append(errs, validateAgainstSchema(s.PropertyNames, keyNode, childPath)...)
+			}
+			if property, ok := s.Properties[key]; ok {
+				errs = append(errs, validateAgainstSchema(property, n.fields[key], childPath)...)
+			} else if additional, ok := s.AdditionalProperties.(*jsonSchema); ok {
+				errs = append(errs, validateAgainstSchema(additional, n.fields[key], childPath)...)
+			} else if allowed, ok := s.AdditionalProperties.(bool); ok && !allowed {
+				fail(keyPos, childPath, "unknown property %#v", key)
+			}
+		}
+	case configArray:
+		if s.Items != nil {
+			for i, item := range n.items {
+				errs = append(errs, validateAgainstSchema(s.Items, item, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case configString:
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, n.scalar) {
+			fail(n.pos, path, "%#v must be one of %s", n.scalar, strings.Join(s.Enum, ", "))
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(n.scalar) {
+			fail(n.pos, path, "%#v must match the regular expression %s", n.scalar, s.Pattern)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, n.scalar); err != nil {
+				fail(n.pos, path, "%#v isn't an RFC 3339 timestamp like 2024-07-01T06:00:00Z", n.scalar)
+			}
+		}
+	}
+	return errs
+}
+
+func escapeJsonPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
+
+func unescapeJsonPointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+}
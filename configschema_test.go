@@ -0,0 +1,60 @@
+package tmpcontrol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConfigJsonSchema(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(ConfigJsonSchema(), &schema); err != nil {
+		t.Fatal(err)
+	}
+	controller := schema["properties"].(map[string]interface{})["controllers"].(map[string]interface{})["items"].(map[string]interface{})
+	properties := controller["properties"].(map[string]interface{})
+	for _, field := range []string{"name", "thermometerPath", "controlType", "switchHosts", "temperatureSchedule", "disableFreezeProtection"} {
+		if _, ok := properties[field]; !ok {
+			t.Errorf("expected the schema to describe %s", field)
+		}
+	}
+	schedule := properties["temperatureSchedule"].(map[string]interface{})
+	if schedule["propertyNames"].(map[string]interface{})["format"] != "date-time" {
+		t.Errorf("expected schedule keys to be date-times: %#v", schedule)
+	}
+	if controller["additionalProperties"] != false {
+		t.Error("expected unknown controller properties to be rejected")
+	}
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	content := `{"controllers": [
+  {"name": "fridge", "thermometerPath": "/tmp/t", "controlType": "cool"},
+  {"name": "fridge", "thermometerPath": "/tmp/t", "controlType": "lukewarm",
+   "temperatureSchedule": {"tomorrow": 33}}
+]}`
+	errs := ValidateConfigFile("config.json", []byte(content))
+	expected := []ConfigError{
+		{Path: "/controllers/1/controlType", Line: 3, Column: 66},
+		{Path: "/controllers/1/temperatureSchedule/tomorrow", Line: 4, Column: 28},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %s", len(expected), errs)
+	}
+	for i := range expected {
+		if errs[i].Path != expected[i].Path || errs[i].Line != expected[i].Line || errs[i].Column != expected[i].Column {
+			t.Errorf("expected %s at %d:%d, got %s", expected[i].Path, expected[i].Line, expected[i].Column, errs[i])
+		}
+	}
+
+	//once the structure is right, the semantic rules run and are located too
+	content = "controllers:\n  - name: fridge\n    thermometerPath: /tmp/t\n    controlType: cool\n  - name: fridge\n    thermometerPath: /tmp/u\n    controlType: heat\n"
+	errs = ValidateConfigFile("config.yaml", []byte(content))
+	if len(errs) != 1 || errs[0].Path != "/controllers/1/name" || errs[0].Line != 5 || errs[0].Column != 11 {
+		t.Errorf("expected a duplicate name error at 5:11, got %s", errs)
+	}
+
+	errs = ValidateConfigFile("config.json", []byte("{\"controllers\": [\n  {\"name\": }"))
+	if len(errs) != 1 || errs[0].Line != 2 {
+		t.Errorf("expected a syntax error on line 2, got %s", errs)
+	}
+}
@@ -0,0 +1,301 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configNode a generic config document that remembers where each value was written, so validation problems can
+// point at a line and column
+type configNode struct {
+	kind         configNodeKind
+	scalar       string //strings, numbers and booleans
+	keys         []string
+	fields       map[string]*configNode
+	keyPositions map[string]configPosition
+	items        []*configNode
+	pos          configPosition
+}
+
+// configPosition 1-based; zero if the format doesn't give us positions (TOML)
+type configPosition struct {
+	line   int
+	column int
+}
+
+type configNodeKind int
+
+const (
+	configObject configNodeKind = iota + 1
+	configArray
+	configString
+	configNumber
+	configBool
+	configNull
+)
+
+func (k configNodeKind) String() string {
+	switch k {
+	case configObject:
+		return "object"
+	case configArray:
+		return "array"
+	case configString:
+		return "string"
+	case configNumber:
+		return "number"
+	case configBool:
+		return "boolean"
+	case configNull:
+		return "null"
+	default:
+		return ""
+	}
+}
+
+func (n *configNode) hasSchemaType(schemaType string) bool {
+	switch schemaType {
+	case "integer":
+		return n.kind == configNumber && !strings.ContainsAny(n.scalar, ".eE")
+	default:
+		return n.kind.String() == schemaType
+	}
+}
+
+func (n *configNode) setField(key string, keyPos configPosition, value *configNode) {
+	if _, ok := n.fields[key]; !ok {
+		n.keys = append(n.keys, key)
+	}
+	n.fields[key] = value
+	n.keyPositions[key] = keyPos
+}
+
+func newConfigObjectNode(pos configPosition) *configNode {
+	return &configNode{kind: configObject, fields: make(map[string]*configNode), keyPositions: make(map[string]configPosition), pos: pos}
+}
+
+// lookup finds the node at a JSON pointer such as /controllers/0/name
+func (n *configNode) lookup(pointer string) *configNode {
+	if pointer == "" {
+		return n
+	}
+	node := n
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		switch node.kind {
+		case configObject:
+			node = node.fields[unescapeJsonPointer(token)]
+		case configArray:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node.items) {
+				return nil
+			}
+			node = node.items[i]
+		default:
+			return nil
+		}
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func parseConfigTree(format ConfigFormat, content []byte) (*configNode, error) {
+	switch format {
+	case ConfigFormatYAML:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("yaml: %w", err)
+		}
+		if len(doc.Content) == 0 {
+			return nil, ConfigError{Message: "the file is empty"}
+		}
+		return yamlToConfigNode(doc.Content[0]), nil
+	case ConfigFormatTOML:
+		var generic map[string]interface{}
+		if _, err := toml.Decode(string(content), &generic); err != nil {
+			var parseErr toml.ParseError
+			if errors.As(err, &parseErr) {
+				pos := offsetToPosition(content, parseErr.Position.Start)
+				return nil, ConfigError{Line: pos.line, Column: pos.column, Message: parseErr.Message}
+			}
+			return nil, fmt.Errorf("toml: %w", err)
+		}
+		return genericToConfigNode(generic), nil
+	default:
+		p := jsonTreeParser{content: content, dec: json.NewDecoder(bytes.NewReader(content))}
+		p.dec.UseNumber()
+		return p.parse()
+	}
+}
+
+type jsonTreeParser struct {
+	content []byte
+	dec     *json.Decoder
+}
+
+// next returns the next token along with where it starts
+func (p *jsonTreeParser) next() (json.Token, configPosition, error) {
+	offset := int(p.dec.InputOffset())
+	for offset < len(p.content) && strings.IndexByte(" \t\r\n,:", p.content[offset]) >= 0 {
+		offset++
+	}
+	token, err := p.dec.Token()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			offset = int(syntaxErr.Offset)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		pos := offsetToPosition(p.content, offset)
+		return nil, pos, ConfigError{Line: pos.line, Column: pos.column, Message: err.Error()}
+	}
+	return token, offsetToPosition(p.content, offset), nil
+}
+
+func (p *jsonTreeParser) parse() (*configNode, error) {
+	token, pos, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			node := newConfigObjectNode(pos)
+			for p.dec.More() {
+				keyToken, keyPos, err := p.next()
+				if err != nil {
+					return nil, err
+				}
+				value, err := p.parse()
+				if err != nil {
+					return nil, err
+				}
+				node.setField(keyToken.(string), keyPos, value)
+			}
+			if _, _, err := p.next(); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+		node := &configNode{kind: configArray, pos: pos}
+		for p.dec.More() {
+			item, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+		if _, _, err := p.next(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &configNode{kind: configString, scalar: t, pos: pos}, nil
+	case json.Number:
+		return &configNode{kind: configNumber, scalar: t.String(), pos: pos}, nil
+	case bool:
+		return &configNode{kind: configBool, scalar: strconv.FormatBool(t), pos: pos}, nil
+	default:
+		return &configNode{kind: configNull, pos: pos}, nil
+	}
+}
+
+func offsetToPosition(content []byte, offset int) configPosition {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(before, '\n')
+	return configPosition{line: line, column: column}
+}
+
+func yamlToConfigNode(n *yaml.Node) *configNode {
+	pos := configPosition{line: n.Line, column: n.Column}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) > 0 {
+			return yamlToConfigNode(n.Content[0])
+		}
+		return &configNode{kind: configNull, pos: pos}
+	case yaml.AliasNode:
+		return yamlToConfigNode(n.Alias)
+	case yaml.MappingNode:
+		node := newConfigObjectNode(pos)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			node.setField(key.Value, configPosition{line: key.Line, column: key.Column}, yamlToConfigNode(n.Content[i+1]))
+		}
+		return node
+	case yaml.SequenceNode:
+		node := &configNode{kind: configArray, pos: pos}
+		for _, item := range n.Content {
+			node.items = append(node.items, yamlToConfigNode(item))
+		}
+		return node
+	default:
+		switch n.ShortTag() {
+		case "!!int", "!!float":
+			return &configNode{kind: configNumber, scalar: n.Value, pos: pos}
+		case "!!bool":
+			return &configNode{kind: configBool, scalar: n.Value, pos: pos}
+		case "!!null":
+			return &configNode{kind: configNull, pos: pos}
+		default:
+			return &configNode{kind: configString, scalar: n.Value, pos: pos}
+		}
+	}
+}
+
+func genericToConfigNode(v interface{}) *configNode {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		node := newConfigObjectNode(configPosition{})
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			node.setField(key, configPosition{}, genericToConfigNode(t[key]))
+		}
+		return node
+	case []map[string]interface{}:
+		node := &configNode{kind: configArray}
+		for _, item := range t {
+			node.items = append(node.items, genericToConfigNode(item))
+		}
+		return node
+	case []interface{}:
+		node := &configNode{kind: configArray}
+		for _, item := range t {
+			node.items = append(node.items, genericToConfigNode(item))
+		}
+		return node
+	case string:
+		return &configNode{kind: configString, scalar: t}
+	case bool:
+		return &configNode{kind: configBool, scalar: strconv.FormatBool(t)}
+	case int64:
+		return &configNode{kind: configNumber, scalar: strconv.FormatInt(t, 10)}
+	case float64:
+		return &configNode{kind: configNumber, scalar: strconv.FormatFloat(t, 'g', -1, 64)}
+	case nil:
+		return &configNode{kind: configNull}
+	default:
+		//TOML dates and times; our schema only expects them as keys
+		return &configNode{kind: configString, scalar: fmt.Sprint(t)}
+	}
+}
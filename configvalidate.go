@@ -0,0 +1,123 @@
+package tmpcontrol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigError one problem found in a config. Path is a JSON pointer such as /controllers/0/controlType. Line and
+// Column are 1-based and only known when the config was validated from a file, see ValidateConfigFile
+type ConfigError struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	message := e.Message
+	if e.Path != "" {
+		message = e.Path + ": " + message
+	}
+	if e.Line > 0 {
+		message = fmt.Sprintf("%d:%d: %s", e.Line, e.Column, message)
+	}
+	return message
+}
+
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, 0, len(errs))
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateConfig checks the semantic rules a config must follow before we'll control anything with it. The error,
+// if any, is a ConfigErrors
+func ValidateConfig(config ControllersConfig) error {
+	errs := validateConfigSemantics(config)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func validateConfigSemantics(config ControllersConfig) ConfigErrors {
+	var errs ConfigErrors
+	add := func(path string, format string, v ...interface{}) {
+		errs = append(errs, ConfigError{Path: path, Message: fmt.Sprintf(format, v...)})
+	}
+	if config.ConfigFetchAlertAfter < 0 {
+		add("/configFetchAlertAfter", "configFetchAlertAfter can't be negative")
+	}
+	errs = append(errs, validateControlTiming("/timing", config.Timing)...)
+	names := make(map[string]bool, len(config.Controllers))
+	for i, controller := range config.Controllers {
+		path := fmt.Sprintf("/controllers/%d", i)
+		if !ClientIdentifiersRegex.MatchString(controller.Name) {
+			add(path+"/name", "name %#v must match the regular expression %s", controller.Name, ClientIdentifiersRegex.String())
+		} else if names[controller.Name] {
+			add(path+"/name", "the name %s is used by more than one controller", controller.Name)
+		}
+		names[controller.Name] = true
+
+		if len(controller.Sensors) > 0 {
+			if controller.ThermometerPath != "" {
+				add(path+"/thermometerPath", "controller %s: use thermometerPath or sensors, not both", controller.Name)
+			}
+		} else if controller.ThermometerPath == "" {
+			add(path+"/thermometerPath", "controller %s: thermometerPath is required unless the controller lists sensors", controller.Name)
+		} else if err := validateThermometerPath(controller.ThermometerPath); err != nil {
+			add(path+"/thermometerPath", "controller %s: %s", controller.Name, err)
+		}
+		errs = append(errs, validateControllerSensors(path, controller)...)
+		if controller.ControlType != "heat" && controller.ControlType != "cool" {
+			add(path+"/controlType", "controller %s: controlType must be \"heat\" or \"cool\", not %#v", controller.Name, controller.ControlType)
+		}
+		for j, host := range controller.SwitchHosts {
+			if host == "" {
+				add(fmt.Sprintf("%s/switchHosts/%d", path, j), "controller %s: switchHosts can't contain a blank host", controller.Name)
+			} else if host == kasaAliasPrefix {
+				add(fmt.Sprintf("%s/switchHosts/%d", path, j), "controller %s: %#v needs the plug's alias after it", controller.Name, kasaAliasPrefix)
+			} else if err := validateSwitchHost(host); err != nil {
+				add(fmt.Sprintf("%s/switchHosts/%d", path, j), "controller %s: %s", controller.Name, err)
+			}
+		}
+		errs = append(errs, validateControlTiming(path+"/timing", controller.Timing)...)
+	}
+	return errs
+}
+
+// ValidateConfigFile validates a JSON, YAML or TOML config file against ConfigJsonSchema and the semantic rules of
+// ValidateConfig, returning every problem found. Problems in JSON and YAML files include their line and column
+func ValidateConfigFile(path string, content []byte) ConfigErrors {
+	format := DetectConfigFormat(path, content)
+	root, err := parseConfigTree(format, content)
+	if err != nil {
+		if configErr, ok := err.(ConfigError); ok {
+			return ConfigErrors{configErr}
+		}
+		return ConfigErrors{{Message: err.Error()}}
+	}
+
+	errs := validateAgainstSchema(configJsonSchema(), root, "")
+	if len(errs) > 0 {
+		//the semantic rules assume the structure is right, so there's no point continuing
+		return errs
+	}
+
+	var config ControllersConfig
+	if err := decodeConfigInto(format, content, &config); err != nil {
+		return ConfigErrors{{Message: err.Error()}}
+	}
+	errs = validateConfigSemantics(config)
+	for i := range errs {
+		if node := root.lookup(errs[i].Path); node != nil {
+			errs[i].Line, errs[i].Column = node.pos.line, node.pos.column
+		}
+	}
+	return errs
+}
@@ -0,0 +1,84 @@
+package tmpcontrol
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// defaultLocalConfigWatchDebounce editors often save in several steps (truncate, write, rename), so we wait for things to settle
+const defaultLocalConfigWatchDebounce = 500 * time.Millisecond
+
+// WatchLocalConfig watches LocalConfigPath and sends each new, valid config on the returned channel as soon as the file
+// settles. Edits that can't be decoded or don't validate are reported with NotifyServer and never sent, so the caller
+// keeps its previous config. The watch ends and the channel is closed when ctx is done
+func (cg *ConfigGopher) WatchLocalConfig(ctx context.Context) (<-chan ControllersConfig, error) {
+	if cg.LocalConfigPath == "" {
+		return nil, fmt.Errorf("ConfigGopher: there's no LocalConfigPath to watch")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	//we watch the directory rather than the file, since editors commonly replace the file by renaming a new one over it
+	configPath := filepath.Clean(cg.LocalConfigPath)
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	debounce := cg.LocalConfigWatchDebounce
+	if debounce <= 0 {
+		debounce = defaultLocalConfigWatchDebounce
+	}
+
+	updates := make(chan ControllersConfig)
+	go func() {
+		defer close(updates)
+		defer watcher.Close()
+
+		settled := time.NewTimer(debounce)
+		settled.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != configPath || event.Op == fsnotify.Chmod {
+					continue
+				}
+				settled.Reset(debounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				cg.logf("%s Error watching %s: %s\n", stdTimestamp(), configPath, err)
+			case <-settled.C:
+				config, _, err := cg.FetchConfig()
+				if err != nil {
+					cg.logf("%s We rejected an edit to %s: %s\n", stdTimestamp(), configPath, err)
+					cg.NotifyServer(fmt.Sprintf("%s: we rejected an edit to %s and kept the previous config: %s", cg.ClientId, configPath, err), ProblemNotification)
+					continue
+				}
+				select {
+				case updates <- config:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return updates, nil
+}
+
+func (cg *ConfigGopher) logf(format string, v ...interface{}) {
+	if cg.Logger != nil {
+		cg.Logger.Printf(format, v...)
+	}
+}
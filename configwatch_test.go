@@ -0,0 +1,104 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+const watchTestConfig = `{"controllers": [{"name": "fridge", "thermometerPath": "/tmp/t", "controlType": "%s", "switchHosts": ["192.168.0.11"]}]}`
+
+func TestConfigGopher_WatchLocalConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(strings.Replace(watchTestConfig, "%s", "cool", 1))
+
+	notifications := &syncBuffer{}
+	cg := ConfigGopher{LocalConfigPath: configPath, LocalConfigWatchDebounce: 50 * time.Millisecond, NotifyOutput: notifications}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates, err := cg.WatchLocalConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig(strings.Replace(watchTestConfig, "%s", "heat", 1))
+	select {
+	case config := <-updates:
+		if config.Controllers[0].ControlType != "heat" {
+			t.Errorf("expected the edited config, got %+v", config)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("we never received the edited config")
+	}
+
+	//a half-written file and a semantically invalid file should both be rejected
+	writeConfig(`{"controllers": [{"name": "fri`)
+	time.Sleep(200 * time.Millisecond)
+	writeConfig(strings.Replace(watchTestConfig, "%s", "lukewarm", 1))
+	select {
+	case config := <-updates:
+		t.Fatalf("expected the invalid edits to be rejected, got %+v", config)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if !strings.Contains(notifications.String(), "rejected an edit") {
+		t.Errorf("expected a notification about the rejected edit, got %#v", notifications.String())
+	}
+
+	cancel()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Error("expected the updates channel to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watcher didn't stop after the context was cancelled")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := ControllersConfig{Controllers: []Controller{{Name: "fridge", ThermometerPath: "/tmp/t", ControlType: "cool"}}}
+	if err := ValidateConfig(valid); err != nil {
+		t.Errorf("expected a valid config: %s", err)
+	}
+
+	invalid := ControllersConfig{Controllers: []Controller{
+		{Name: "fridge", ThermometerPath: "/tmp/t", ControlType: "cool"},
+		{Name: "fridge", ControlType: "lukewarm", SwitchHosts: []string{""}},
+	}}
+	err := ValidateConfig(invalid)
+	if err == nil {
+		t.Fatal("expected an invalid config")
+	}
+	for _, expected := range []string{"more than one controller", "thermometerPath is required", "controlType", "blank host"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected the error to mention %#v: %s", expected, err)
+		}
+	}
+}
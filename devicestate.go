@@ -0,0 +1,106 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DeviceStateReader optionally implemented by a HeatOrCoolController that can tell whether a host is actually on or
+// off. The control loop uses it to notice hosts that were switched behind its back and to verify its own commands
+type DeviceStateReader interface {
+	ReadDeviceState(ctx context.Context, host string) (Control, error)
+}
+
+// maxDeviceStateDisagreements after a host disagrees with us this many iterations in a row, we notify the server
+const maxDeviceStateDisagreements = 3
+
+// deviceStateTracker what we last commanded each host and how many iterations in a row it has disagreed with us.
+// Controllers run on their own goroutines, and a host can belong to more than one of them
+type deviceStateTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*trackedDeviceState
+}
+
+type trackedDeviceState struct {
+	commanded     Control
+	disagreements int
+}
+
+func (t *deviceStateTracker) lastCommanded(host string) (Control, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state, ok := t.hosts[host]; ok {
+		return state.commanded, true
+	}
+	return 0, false
+}
+
+// record returns how many iterations in a row the host has disagreed with us
+func (t *deviceStateTracker) record(host string, commanded Control, disagreed bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.hosts == nil {
+		t.hosts = make(map[string]*trackedDeviceState)
+	}
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &trackedDeviceState{}
+		t.hosts[host] = state
+	}
+	state.commanded = commanded
+	if disagreed {
+		state.disagreements++
+	} else {
+		state.disagreements = 0
+	}
+	return state.disagreements
+}
+
+// checkForDrift reads the host's state before we switch it; if it isn't what we last commanded, someone (or something)
+// switched it in the meantime. Returns a description of the discrepancy, or "" if there wasn't one
+func (cl *ControlLooper) checkForDrift(ctx context.Context, reader DeviceStateReader, controllerName string, host string) string {
+	commanded, ok := cl.deviceStates.lastCommanded(host)
+	if !ok {
+		return ""
+	}
+	actual, err := reader.ReadDeviceState(ctx, host)
+	if err != nil {
+		if !errors.Is(err, ErrDeviceStateUnsupported) {
+			cl.Logger.Printf("%s [%s] We couldn't read the state of %s: %s\n", cl.timestamp(), controllerName, host, err)
+		}
+		return ""
+	}
+	if actual == commanded {
+		return ""
+	}
+	cl.Logger.Printf("%s [%s] %s is %s, but we last turned it %s\n", cl.timestamp(), controllerName, host, actual, commanded)
+	return fmt.Sprintf("%s: drifted %s after we turned it %s", host, actual, commanded)
+}
+
+// verifyDeviceState reads the host's state after we switched it. Returns a description of the discrepancy, or "" if
+// there wasn't one
+func (cl *ControlLooper) verifyDeviceState(ctx context.Context, reader DeviceStateReader, controllerName string, host string, commanded Control) string {
+	actual, err := reader.ReadDeviceState(ctx, host)
+	if err != nil {
+		if !errors.Is(err, ErrDeviceStateUnsupported) {
+			cl.Logger.Printf("%s [%s] We couldn't verify that %s is %s: %s\n", cl.timestamp(), controllerName, host, commanded, err)
+		}
+		return ""
+	}
+	if actual == commanded {
+		return ""
+	}
+	cl.Logger.Printf("%s [%s] We turned %s %s, but it's %s\n", cl.timestamp(), controllerName, host, commanded, actual)
+	return fmt.Sprintf("%s: stayed %s after we turned it %s", host, actual, commanded)
+}
+
+// recordDeviceState notifies the server the first time a host has disagreed with us maxDeviceStateDisagreements
+// iterations in a row
+func (cl *ControlLooper) recordDeviceState(controllerName string, host string, commanded Control, discrepancies []string) {
+	disagreements := cl.deviceStates.record(host, commanded, len(discrepancies) > 0)
+	if disagreements == maxDeviceStateDisagreements {
+		cl.notify(fmt.Sprintf("%s: %s of controller %s has disagreed with the state we commanded %d times in a row (%s)", cl.Cg.ClientId, host, controllerName, disagreements, discrepancies[len(discrepancies)-1]), ProblemNotification)
+	}
+}
@@ -0,0 +1,72 @@
+package tmpcontrol
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stickySwitch a recordingSwitch that can read its hosts back; stuck hosts ignore commands
+type stickySwitch struct {
+	recordingSwitch
+	stuck map[string]bool
+}
+
+func (s *stickySwitch) ControlDevice(host string, action Control) error {
+	if s.stuck[host] {
+		return nil
+	}
+	return s.recordingSwitch.ControlDevice(host, action)
+}
+
+func (s *stickySwitch) ReadDeviceState(ctx context.Context, host string) (Control, error) {
+	if state := s.state(host); state != 0 {
+		return state, nil
+	}
+	return ControlOff, nil
+}
+
+func TestControlLooper_DeviceStateDiscrepancies(t *testing.T) {
+	switches := &stickySwitch{stuck: map[string]bool{"stuck": true}}
+	notifications := &syncBuffer{}
+	cl := NewControlLooper(&ConfigGopher{NotifyOutput: notifications}, switches, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = fixedThermometer{"/heater": 40}
+	controller := Controller{
+		Name:                "heater",
+		ThermometerPath:     "/heater",
+		ControlType:         "heat",
+		SwitchHosts:         []string{"stuck", "fine"},
+		TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 60},
+	}
+
+	ret := cl.temperatureControl(context.Background(), &controller)
+	if ret.err != nil {
+		t.Fatal(ret.err)
+	}
+	if ret.tmplog.DeviceStateDiscrepancies != "stuck: stayed off after we turned it on" {
+		t.Errorf("unexpected discrepancies: %#v", ret.tmplog.DeviceStateDiscrepancies)
+	}
+
+	//someone presses the button on the fine plug between iterations
+	_ = switches.recordingSwitch.ControlDevice("fine", ControlOff)
+	ret = cl.temperatureControl(context.Background(), &controller)
+	if !strings.Contains(ret.tmplog.DeviceStateDiscrepancies, "fine: drifted off after we turned it on") {
+		t.Errorf("expected the drift to be logged: %#v", ret.tmplog.DeviceStateDiscrepancies)
+	}
+	if switches.state("fine") != ControlOn {
+		t.Error("expected the drifted plug to be turned back on")
+	}
+	if notifications.String() != "" {
+		t.Errorf("didn't expect a notification yet: %s", notifications.String())
+	}
+
+	//the stuck plug has now disagreed three iterations in a row; we only notify once per streak
+	cl.temperatureControl(context.Background(), &controller)
+	cl.temperatureControl(context.Background(), &controller)
+	if strings.Count(notifications.String(), "stuck of controller heater has disagreed") != 1 || strings.Contains(notifications.String(), "fine") {
+		t.Errorf("expected a single notification about the stuck plug: %s", notifications.String())
+	}
+}
@@ -0,0 +1,296 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// earliestPlausibleClock a Pi without a real-time clock boots thinking it's 1970 (or whenever it last shut down) until
+// it syncs, so a clock before this was never synced
+var earliestPlausibleClock = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// DoctorCheck one line of a DoctorReport
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	//Skipped the check didn't apply here, e.g. there's no server to reach. A skipped check passes
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func (c DoctorCheck) String() string {
+	verdict := "FAIL"
+	if c.Skipped {
+		verdict = "SKIP"
+	} else if c.Passed {
+		verdict = "PASS"
+	}
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s", verdict, c.Name)
+	}
+	return fmt.Sprintf("%s %s: %s", verdict, c.Name, c.Detail)
+}
+
+// DoctorReport Passed if every check passed
+type DoctorReport struct {
+	Passed bool          `json:"passed"`
+	Checks []DoctorCheck `json:"checks"`
+}
+
+func (r DoctorReport) String() string {
+	lines := make([]string, 0, len(r.Checks)+1)
+	failures := 0
+	for _, check := range r.Checks {
+		lines = append(lines, check.String())
+		if !check.Passed {
+			failures++
+		}
+	}
+	if failures == 0 {
+		lines = append(lines, fmt.Sprintf("All %d checks passed", len(r.Checks)))
+	} else {
+		lines = append(lines, fmt.Sprintf("%d of %d checks failed", failures, len(r.Checks)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *DoctorReport) add(check DoctorCheck) {
+	r.Checks = append(r.Checks, check)
+	r.Passed = r.Passed && check.Passed
+}
+
+// Doctor checks the things a misbehaving controller usually comes down to: the config, the thermometers, the switch
+// hosts, the local database, the server and the clock
+type Doctor struct {
+	Cg                *ConfigGopher
+	TemperatureReader TemperatureReader
+	Switches          HeatOrCoolController
+	Logger            Logger
+	//KasaPath the kasa executable to check, if plugs are switched through it. Empty skips the check
+	KasaPath string
+	//DbFileName the control loop's database, which we check is writable
+	DbFileName string
+	//Timeout how long reading one thermometer, querying one switch host or reaching the server may take
+	Timeout time.Duration
+	//MaxClockSkew how far our clock may be from the server's
+	MaxClockSkew time.Duration
+	//SkipSchemes thermometers and switch hosts of these schemes are skipped, e.g. because only the running control loop
+	//can read them. The value says why
+	SkipSchemes map[string]string
+}
+
+func NewDoctor(cg *ConfigGopher, reader TemperatureReader, switches HeatOrCoolController, logger Logger) *Doctor {
+	return &Doctor{
+		Cg:                cg,
+		TemperatureReader: reader,
+		Switches:          switches,
+		Logger:            logger,
+		DbFileName:        defaultDbFileName,
+		Timeout:           10 * time.Second,
+		MaxClockSkew:      time.Minute,
+	}
+}
+
+// Run runs every check, even after one fails. Switch hosts are only queried, never switched
+func (d *Doctor) Run(ctx context.Context) DoctorReport {
+	report := DoctorReport{Passed: true}
+	if d.KasaPath != "" {
+		report.add(d.checkKasa())
+	}
+	config, check := d.checkConfig()
+	report.add(check)
+	for _, check := range d.checkThermometers(ctx, config) {
+		report.add(check)
+	}
+	for _, check := range d.checkSwitchHosts(ctx, config) {
+		report.add(check)
+	}
+	report.add(d.checkDatabase())
+	serverCheck, serverTime := d.checkServer(ctx)
+	report.add(serverCheck)
+	report.add(d.checkClock(time.Now(), serverTime))
+	return report
+}
+
+func (d *Doctor) checkKasa() DoctorCheck {
+	check := DoctorCheck{Name: "kasa executable", Detail: d.KasaPath}
+	if err := CheckKasaExecutable(d.KasaPath); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.Passed = true
+	return check
+}
+
+func (d *Doctor) checkConfig() (ControllersConfig, DoctorCheck) {
+	check := DoctorCheck{Name: "config"}
+	config, source, err := d.Cg.FetchConfig()
+	if err != nil {
+		check.Detail = err.Error()
+		return config, check
+	}
+	check.Passed = true
+	check.Detail = fmt.Sprintf("%d controllers from the %s", len(config.Controllers), source)
+	return config, check
+}
+
+// checkThermometers reads each of the config's thermometers once, however many controllers share it
+func (d *Doctor) checkThermometers(ctx context.Context, config ControllersConfig) []DoctorCheck {
+	var sensors []ControllerSensor
+	controllerNames := make(map[string][]string)
+	var checks []DoctorCheck
+	for _, controller := range config.Controllers {
+		for _, sensor := range controller.sensors() {
+			_, seen := controllerNames[sensor.Path]
+			controllerNames[sensor.Path] = append(controllerNames[sensor.Path], controller.Name)
+			if seen {
+				continue
+			}
+			if reason, ok := d.SkipSchemes[ThermometerScheme(sensor.Path)]; ok {
+				checks = append(checks, DoctorCheck{Name: "thermometer " + sensor.Path, Passed: true, Skipped: true, Detail: reason})
+				continue
+			}
+			sensors = append(sensors, sensor)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+	for _, reading := range readSensors(ctx, d.TemperatureReader, sensors) {
+		check := DoctorCheck{Name: "thermometer " + reading.Path}
+		switch {
+		case reading.err != nil:
+			check.Detail = reading.err.Error()
+		case reading.temperature < minValidFahrenheitTemperature || reading.temperature > maxValidFahrenheitTemperature:
+			check.Detail = fmt.Sprintf("%.2f°F isn't a plausible temperature", reading.temperature)
+		default:
+			check.Passed = true
+			check.Detail = fmt.Sprintf("%.2f°F", reading.temperature)
+		}
+		check.Detail += fmt.Sprintf(" (%s)", strings.Join(controllerNames[reading.Path], ", "))
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// checkSwitchHosts asks each host whether it's on, when its driver can tell
+func (d *Doctor) checkSwitchHosts(ctx context.Context, config ControllersConfig) []DoctorCheck {
+	var checks []DoctorCheck
+	checked := make(map[string]bool)
+	reader, canReadState := d.Switches.(DeviceStateReader)
+	for _, controller := range config.Controllers {
+		for _, host := range controller.SwitchHosts {
+			if checked[host] {
+				continue
+			}
+			checked[host] = true
+			check := DoctorCheck{Name: "switch host " + host}
+			if reason, ok := d.SkipSchemes[SwitchHostScheme(host)]; ok {
+				check.Passed, check.Skipped, check.Detail = true, true, reason
+				checks = append(checks, check)
+				continue
+			}
+			if !canReadState {
+				check.Passed, check.Skipped, check.Detail = true, true, ErrDeviceStateUnsupported.Error()
+				checks = append(checks, check)
+				continue
+			}
+			hostCtx, cancel := context.WithTimeout(ctx, d.Timeout)
+			state, err := reader.ReadDeviceState(hostCtx, host)
+			cancel()
+			switch {
+			case errors.Is(err, ErrDeviceStateUnsupported):
+				check.Passed, check.Skipped, check.Detail = true, true, err.Error()
+			case err != nil:
+				check.Detail = err.Error()
+			default:
+				check.Passed = true
+				check.Detail = "it's " + state.String()
+			}
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+func (d *Doctor) checkDatabase() DoctorCheck {
+	check := DoctorCheck{Name: "database " + d.DbFileName}
+	db, err := NewSqliteDbFromFilename(d.DbFileName, d.Logger)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	defer db.Close()
+	if err := db.CheckWritable(); err != nil {
+		check.Detail = "it isn't writable: " + err.Error()
+		return check
+	}
+	check.Passed = true
+	return check
+}
+
+// checkServer asks the server for our config. serverTime is the response's Date, if there was one
+func (d *Doctor) checkServer(ctx context.Context) (check DoctorCheck, serverTime time.Time) {
+	check = DoctorCheck{Name: "server"}
+	if d.Cg.ServerRoot == "" {
+		check.Passed, check.Skipped, check.Detail = true, true, "there's no server configured"
+		return check, serverTime
+	}
+	check.Name = "server " + d.Cg.ServerRoot
+	if err := d.Cg.HasError(); err != nil {
+		check.Detail = err.Error()
+		return check, serverTime
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, d.Cg.getServerRequestUrl(), nil)
+	if err != nil {
+		check.Detail = err.Error()
+		return check, serverTime
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		check.Detail = err.Error()
+		return check, serverTime
+	}
+	defer response.Body.Close()
+	serverTime, _ = http.ParseTime(response.Header.Get("Date"))
+	switch response.StatusCode {
+	case http.StatusOK:
+		check.Passed = true
+		check.Detail = fmt.Sprintf("it has a config for %s", d.Cg.ClientId)
+	case http.StatusNotFound:
+		check.Detail = fmt.Sprintf("it has no config for %s", d.Cg.ClientId)
+	default:
+		check.Detail = fmt.Sprintf("it responded with %d", response.StatusCode)
+	}
+	return check, serverTime
+}
+
+// checkClock now against earliestPlausibleClock and, if we reached the server, its clock
+func (d *Doctor) checkClock(now time.Time, serverTime time.Time) DoctorCheck {
+	check := DoctorCheck{Name: "clock", Detail: now.UTC().Format(time.RFC3339)}
+	if now.Before(earliestPlausibleClock) {
+		check.Detail += ", it was probably never synced"
+		return check
+	}
+	if serverTime.IsZero() {
+		check.Passed = true
+		return check
+	}
+	//the Date header only has whole seconds
+	skew := now.Sub(serverTime).Truncate(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > d.MaxClockSkew {
+		check.Detail += fmt.Sprintf(", %s off the server's", skew)
+		return check
+	}
+	check.Passed = true
+	check.Detail += fmt.Sprintf(", within %s of the server's", max(skew, time.Second))
+	return check
+}
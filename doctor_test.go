@@ -0,0 +1,119 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDoctor(t *testing.T) {
+	config := ControllersConfig{Controllers: []Controller{
+		{
+			Name:                "fermenter",
+			ControlType:         "cool",
+			ThermometerPath:     "/fermenter",
+			SwitchHosts:         []string{"10.0.0.20", "exec:/usr/local/bin/fan"},
+			TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 64},
+		},
+		{
+			Name:                "kegerator",
+			ControlType:         "cool",
+			SwitchHosts:         []string{"10.0.0.20", "http://10.0.0.30#tasmota", "mqtt:cmnd/keg/POWER"},
+			TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 38},
+			Sensors:             []ControllerSensor{{Path: "/fermenter"}, {Path: "/kegerator", Role: SensorRoleChamber}, {Path: "tilt:red", Role: SensorRoleAmbient}},
+		},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/configuration/brewery" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(config)
+	}))
+	defer server.Close()
+
+	switches := NewSwitchDrivers("kasa")
+	_ = switches.Register("kasa", &stickySwitch{})
+	_ = switches.Register("exec", ExecController{})
+	doctor := NewDoctor(&ConfigGopher{ServerRoot: server.URL, ClientId: "brewery"}, partialThermometer{"/fermenter": 64.5, "/kegerator": 250}, switches, log.New(io.Discard, "", 0))
+	doctor.DbFileName = filepath.Join(t.TempDir(), "tmplog.dbo")
+	doctor.SkipSchemes = map[string]string{"mqtt": "not here", "tilt": "not here"}
+
+	report := doctor.Run(context.Background())
+	if report.Passed {
+		t.Error("expected the report to fail")
+	}
+	expected := []string{
+		"PASS config: 2 controllers from the server",
+		"SKIP thermometer tilt:red: not here",
+		"PASS thermometer /fermenter: 64.50°F (fermenter, kegerator)",
+		"FAIL thermometer /kegerator: 250.00°F isn't a plausible temperature (kegerator)",
+		"PASS switch host 10.0.0.20: it's off",
+		"SKIP switch host exec:/usr/local/bin/fan: " + ErrDeviceStateUnsupported.Error(),
+		"FAIL switch host http://10.0.0.30#tasmota: http://10.0.0.30#tasmota: no driver is registered for http hosts",
+		"SKIP switch host mqtt:cmnd/keg/POWER: not here",
+		"PASS database " + doctor.DbFileName,
+		"PASS server " + server.URL + ": it has a config for brewery",
+	}
+	if len(report.Checks) != len(expected)+1 {
+		t.Fatalf("expected %d checks, got\n%s", len(expected)+1, report)
+	}
+	for i, line := range expected {
+		if report.Checks[i].String() != line {
+			t.Errorf("expected %q, got %q", line, report.Checks[i])
+		}
+	}
+	if clock := report.Checks[len(expected)]; !clock.Passed || !strings.Contains(clock.Detail, "of the server's") {
+		t.Errorf("expected the clock to be compared with the server's: %s", clock)
+	}
+	if !strings.HasSuffix(report.String(), "2 of 11 checks failed") {
+		t.Errorf("unexpected summary:\n%s", report)
+	}
+
+	doctor.Cg.ClientId = "stranger"
+	if check, _ := doctor.checkServer(context.Background()); check.Passed || check.Detail != "it has no config for stranger" {
+		t.Errorf("expected the server not to know us: %s", check)
+	}
+}
+
+func TestDoctor_Clock(t *testing.T) {
+	doctor := NewDoctor(&ConfigGopher{}, fixedThermometer{}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	now := time.Date(2026, time.March, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		now, server time.Time
+		passed      bool
+	}{
+		{now, time.Time{}, true},
+		{now, now.Add(-30 * time.Second), true},
+		{now, now.Add(5 * time.Minute), false},
+		{time.Date(1970, time.January, 1, 0, 3, 0, 0, time.UTC), time.Time{}, false},
+	} {
+		if check := doctor.checkClock(test.now, test.server); check.Passed != test.passed {
+			t.Errorf("%s against %s: expected passed %t, got %s", test.now, test.server, test.passed, check)
+		}
+	}
+}
+
+func TestDoctor_ReadOnlyDatabase(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to a read-only directory")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	doctor := NewDoctor(&ConfigGopher{}, fixedThermometer{}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	doctor.DbFileName = filepath.Join(dir, "tmplog.dbo")
+	if check := doctor.checkDatabase(); check.Passed {
+		t.Errorf("expected a database in a read-only directory to fail: %s", check)
+	}
+}
@@ -1,25 +1,40 @@
 package tmpcontrol
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type DS18B20Reader struct {
 	logger Logger
+	//Root where the sensors' directories are, ThermometerDevicesRootPath unless we're testing
+	Root string
+
+	mu          sync.Mutex
+	resolutions map[string]int //connection string maps to the resolution in bits the sensor last reported
 }
 
 func NewDS18B20Reader(logger Logger) *DS18B20Reader {
 	return &DS18B20Reader{
-		logger: logger,
+		logger:      logger,
+		Root:        ThermometerDevicesRootPath,
+		resolutions: make(map[string]int),
 	}
 }
 
-func (t DS18B20Reader) ReadTemperatureInF(temperaturePath string) (float32, error) {
+// ReadTemperatureInF reads a temperature or w1_slave file, or the w1_slave file of a sensor ID like "28-0000000000"
+// under Root. Reading w1_slave lets us reject readings that failed the bus's CRC check
+func (t *DS18B20Reader) ReadTemperatureInF(temperaturePath string) (float32, error) {
+	temperaturePath = t.sensorPath(temperaturePath)
 	var temperatureBytes []byte
 	for counter := 1; counter <= 3; counter++ {
 		// Read the temperature from the file.
@@ -39,13 +54,128 @@ func (t DS18B20Reader) ReadTemperatureInF(temperaturePath string) (float32, erro
 		}
 	}
 
-	temperatureFahrenheit, err := processTemperatureFileBytes(temperatureBytes)
+	if !strings.HasSuffix(temperaturePath, "/w1_slave") {
+		return processTemperatureFileBytes(temperatureBytes)
+	}
+	reading, err := parseW1Slave(temperatureBytes)
 	if err != nil {
 		return 0, err
 	}
-	return temperatureFahrenheit, nil
+	if reading.resolutionBits > 0 {
+		t.mu.Lock()
+		t.resolutions[temperaturePath] = reading.resolutionBits
+		t.mu.Unlock()
+	}
+	return millidegreesToFahrenheit(float64(reading.millidegrees))
+}
+
+// ReadResolution the resolution the sensor reported the last time we read its w1_slave file, see
+// SensorResolutionReader
+func (t *DS18B20Reader) ReadResolution(temperaturePath string) (int, bool) {
+	temperaturePath = t.sensorPath(temperaturePath)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bits, ok := t.resolutions[temperaturePath]
+	return bits, ok
+}
+
+// SetResolution sets a sensor's resolution, 9 to 12 bits, through the kernel's resolution file. A 12 bit conversion
+// is 0.0625°C and takes 750ms; each bit less halves both. Needs root, and a kernel from 5.10 on
+func (t *DS18B20Reader) SetResolution(sensorId string, bits int) error {
+	if bits < 9 || bits > 12 {
+		return fmt.Errorf("a DS18B20's resolution is 9 to 12 bits, not %d", bits)
+	}
+	return os.WriteFile(filepath.Join(t.Root, sensorId, "resolution"), []byte(strconv.Itoa(bits)), 0644)
+}
+
+// sensorPath a sensor ID's w1_slave file; anything with a slash is already a path
+func (t *DS18B20Reader) sensorPath(temperaturePath string) string {
+	if strings.Contains(temperaturePath, "/") {
+		return temperaturePath
+	}
+	return filepath.Join(t.Root, temperaturePath, "w1_slave")
+}
+
+// ErrW1CrcMismatch the reading was corrupted on the 1-Wire bus, usually by a long cable or a missing pull-up resistor
+var ErrW1CrcMismatch = errors.New("the 1-Wire CRC check failed")
+
+// w1SlaveReading what a w1_slave file told us. resolutionBits is 0 for sensors without a configuration register
+type w1SlaveReading struct {
+	millidegrees   int
+	resolutionBits int
+}
+
+// parseW1Slave parses the kernel's w1_slave file, the scratchpad twice with the CRC verdict and then the temperature:
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func parseW1Slave(content []byte) (w1SlaveReading, error) {
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		return w1SlaveReading{}, fmt.Errorf("expected two lines in w1_slave, got %d", len(lines))
+	}
+	scratchpadHex, verdict, ok := strings.Cut(lines[0], ":")
+	if !ok {
+		return w1SlaveReading{}, fmt.Errorf("w1_slave's first line has no CRC: %#v", lines[0])
+	}
+	scratchpad, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(scratchpadHex), " ", ""))
+	if err != nil || len(scratchpad) != 9 {
+		return w1SlaveReading{}, fmt.Errorf("w1_slave's scratchpad isn't 9 bytes: %#v", lines[0])
+	}
+	if !strings.HasSuffix(strings.TrimSpace(verdict), "YES") || w1Crc(scratchpad) != 0 {
+		return w1SlaveReading{}, ErrW1CrcMismatch
+	}
+	if strings.Trim(scratchpadHex, "0 ") == "" {
+		//all zeros has a valid CRC, but it's what a shorted bus reads
+		return w1SlaveReading{}, ErrDS18B20Disconnected
+	}
+
+	_, temperatureString, ok := strings.Cut(lines[1], "t=")
+	if !ok {
+		return w1SlaveReading{}, fmt.Errorf("w1_slave's second line has no temperature: %#v", lines[1])
+	}
+	millidegrees, err := strconv.Atoi(strings.TrimSpace(temperatureString))
+	if err != nil {
+		return w1SlaveReading{}, fmt.Errorf("w1_slave's temperature isn't a number: %w", err)
+	}
+	reading := w1SlaveReading{millidegrees: millidegrees}
+	//a DS18B20's configuration register is 0RR11111, with the resolution in RR
+	if config := scratchpad[4]; config&0x9F == 0x1F {
+		reading.resolutionBits = int(config>>5) + 9
+	}
+	return reading, nil
 }
 
+// w1Crc the Dallas/Maxim CRC-8 (polynomial x^8 + x^5 + x^4 + 1, reflected). Over a scratchpad including its CRC byte,
+// it's 0
+func w1Crc(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		for i := 0; i < 8; i++ {
+			mix := (crc ^ b) & 0x01
+			crc >>= 1
+			if mix != 0 {
+				crc ^= 0x8C
+			}
+			b >>= 1
+		}
+	}
+	return crc
+}
+
+// The values, in millidegrees Celsius, a DS18B20 reports when it isn't really measuring
+const (
+	ds18b20PowerOnReset = 85000
+	ds18b20Disconnected = -127000
+)
+
+// ErrDS18B20PowerOnReset the sensor read 85°C, which is what it reports after losing power before it has converted a
+// temperature. ErrDS18B20Disconnected the sensor read -127°C, which the kernel reports when it doesn't answer
+var (
+	ErrDS18B20PowerOnReset = errors.New("the DS18B20 reported its power-on reset value of 85°C")
+	ErrDS18B20Disconnected = errors.New("the DS18B20 reported -127°C, it's probably disconnected")
+)
+
 func processTemperatureFileBytes(temperatureBytes []byte) (float32, error) {
 	temperatureString := string(temperatureBytes)
 	if "" == temperatureString {
@@ -59,8 +189,18 @@ func processTemperatureFileBytes(temperatureBytes []byte) (float32, error) {
 	if err != nil {
 		return 0, err
 	}
+	return millidegreesToFahrenheit(temperature32)
+}
+
+func millidegreesToFahrenheit(millidegrees float64) (float32, error) {
+	switch millidegrees {
+	case ds18b20PowerOnReset:
+		return 0, ErrDS18B20PowerOnReset
+	case ds18b20Disconnected:
+		return 0, ErrDS18B20Disconnected
+	}
 
-	temperature := float32(temperature32 / 1000)
+	temperature := float32(millidegrees / 1000)
 
 	// Convert the temperature from Celsius to Fahrenheit.
 	temperatureFahrenheit := temperature*9/5 + 32
@@ -76,36 +216,87 @@ func processTemperatureFileBytes(temperatureBytes []byte) (float32, error) {
 // ThermometerDevicesRootPath where to look for DS18B20 devices
 const ThermometerDevicesRootPath = "/sys/bus/w1/devices/"
 
-// EnumerateThermometerPaths Assuming we're on a Raspberry Pi, check if we can find any DS18B20 devices running
-func (t DS18B20Reader) EnumerateThermometerPaths() []string {
-	var temperaturePaths []string
+// w1Families the 1-Wire thermometers we can read, by family code, the first part of their ROM ID
+var w1Families = map[string]string{
+	"10": "DS18S20",
+	"22": "DS1822",
+	"28": "DS18B20",
+	"3b": "DS1825",
+	"42": "DS28EA00",
+}
+
+// defaultEnumerationTimeout how long EnumerateThermometerPaths waits for the slowest sensor. A 12 bit conversion
+// takes 750ms, and the kernel does them one at a time
+const defaultEnumerationTimeout = 10 * time.Second
 
-	entries, err := os.ReadDir(ThermometerDevicesRootPath)
+// ThermometerInfo a 1-Wire thermometer we found. Err is set if we couldn't read it, in which case TemperatureInF and
+// ResolutionBits are 0
+type ThermometerInfo struct {
+	//Path what to put in thermometerPath
+	Path string `json:"path"`
+	//RomId the sensor's 64-bit ROM ID without its CRC, as the kernel names it, e.g. 28-0000000001
+	RomId          string   `json:"romId"`
+	Family         string   `json:"family"`
+	TemperatureInF float32  `json:"temperatureInF,omitempty"`
+	ResolutionBits int      `json:"resolutionBits,omitempty"`
+	Latency        Duration `json:"latency"`
+	Err            string   `json:"error,omitempty"`
+}
+
+// Enumerate reads every thermometer under Root at once, giving up on those that haven't answered when ctx is done.
+// The result is sorted by ROM ID. An error is only returned if Root can't be listed
+func (t *DS18B20Reader) Enumerate(ctx context.Context) ([]ThermometerInfo, error) {
+	entries, err := os.ReadDir(t.Root)
 	if err != nil {
-		return temperaturePaths
+		return nil, err
 	}
+	var thermometers []ThermometerInfo
 	for _, entry := range entries {
-		//we should probably filter out non-directories, but the IsDir() function wasn't working for some reason
-		//check if there's a readable temperature file inside
-		//TODO optimize with concurrency
-		filePath := ThermometerDevicesRootPath + entry.Name() + "/temperature"
-		_, err := os.Open(filePath)
-		if err != nil {
-			continue //temperature file doesn't exist
-		}
-		//we have a real file, so continue to verify it's a valid temperature
-		temperatureBytes, err := os.ReadFile(filePath)
-		if err != nil {
-			continue //we couldn't parse the content as a temperature
+		familyCode, _, ok := strings.Cut(entry.Name(), "-")
+		family, known := w1Families[strings.ToLower(familyCode)]
+		if !ok || !known {
+			continue //the bus master, or a 1-Wire device that isn't a thermometer
 		}
+		thermometers = append(thermometers, ThermometerInfo{Path: "w1:" + entry.Name(), RomId: entry.Name(), Family: family})
+	}
 
-		_, err = processTemperatureFileBytes(temperatureBytes)
-		if err != nil {
-			continue
-		}
+	var wg sync.WaitGroup
+	for i := range thermometers {
+		wg.Add(1)
+		go func(info *ThermometerInfo) {
+			defer wg.Done()
+			start := time.Now()
+			temperature, err := readTemperature(ctx, t, info.RomId)
+			info.Latency = Duration(time.Since(start))
+			if err != nil {
+				info.Err = err.Error()
+				return
+			}
+			info.TemperatureInF = temperature
+			info.ResolutionBits, _ = t.ReadResolution(info.RomId)
+		}(&thermometers[i])
+	}
+	wg.Wait()
+	sort.Slice(thermometers, func(i, j int) bool {
+		return thermometers[i].RomId < thermometers[j].RomId
+	})
+	return thermometers, nil
+}
 
-		//it seems we found a real temperature device path
-		temperaturePaths = append(temperaturePaths, filePath)
+// EnumerateThermometerPaths Assuming we're on a Raspberry Pi, check if we can find any DS18B20 devices running, and
+// return the paths of those we could read
+func (t *DS18B20Reader) EnumerateThermometerPaths() []string {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultEnumerationTimeout)
+	defer cancel()
+	thermometers, err := t.Enumerate(ctx)
+	if err != nil {
+		return nil
+	}
+	var temperaturePaths []string
+	for _, thermometer := range thermometers {
+		if thermometer.Err == "" {
+			temperaturePaths = append(temperaturePaths, thermometer.Path)
+		}
 	}
 	return temperaturePaths
 }
@@ -0,0 +1,170 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// w1SlaveFile what the kernel writes for a scratchpad (without its CRC, which we append) and temperature
+func w1SlaveFile(scratchpad []byte, verdict string, millidegrees int) string {
+	scratchpad = append(scratchpad, w1Crc(scratchpad))
+	hexBytes := strings.TrimSpace(fmt.Sprintf("% x", scratchpad))
+	return fmt.Sprintf("%s : crc=%02x %s\n%s t=%d\n", hexBytes, scratchpad[8], verdict, hexBytes, millidegrees)
+}
+
+func TestParseW1Slave(t *testing.T) {
+	datasheet := "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	reading, err := parseW1Slave([]byte(datasheet))
+	if err != nil || reading.millidegrees != 23125 || reading.resolutionBits != 12 {
+		t.Errorf("expected 23.125°C at 12 bits, got %+v, %v", reading, err)
+	}
+	reading, err = parseW1Slave([]byte(w1SlaveFile([]byte{0x91, 0x01, 0x4b, 0x46, 0x5f, 0xff, 0x0f, 0x10}, "YES", 25062)))
+	if err != nil || reading.resolutionBits != 11 {
+		t.Errorf("expected 11 bits, got %+v, %v", reading, err)
+	}
+
+	for content, expected := range map[string]error{
+		strings.Replace(datasheet, "YES", "NO", 1):                    ErrW1CrcMismatch,
+		strings.Replace(datasheet, "0e 10 57 :", "0e 10 58 :", 1):     ErrW1CrcMismatch,
+		w1SlaveFile(make([]byte, 8), "YES", 0):                        ErrDS18B20Disconnected,
+		"72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n":                   nil,
+		"72 01 4b 46 7f ff 0e 10 : crc=57 YES\n72 01 4b 46 t=23125\n": nil,
+	} {
+		_, err := parseW1Slave([]byte(content))
+		if err == nil || (expected != nil && !errors.Is(err, expected)) {
+			t.Errorf("%#v: expected %v, got %v", content, expected, err)
+		}
+	}
+}
+
+func TestDS18B20Reader_W1Slave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "28-0000000001", "w1_slave")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := NewDS18B20Reader(log.New(io.Discard, "", 0))
+
+	write(w1SlaveFile([]byte{0x50, 0x01, 0x4b, 0x46, 0x3f, 0xff, 0x10, 0x10}, "YES", 20000))
+	if temperature, err := reader.ReadTemperatureInF(path); err != nil || temperature != 68 {
+		t.Errorf("expected 68°F, got %.2f, %v", temperature, err)
+	}
+	if bits, ok := reader.ReadResolution(path); !ok || bits != 10 {
+		t.Errorf("expected 10 bits, got %d, %t", bits, ok)
+	}
+	write(w1SlaveFile([]byte{0x50, 0x05, 0x4b, 0x46, 0x7f, 0xff, 0x0c, 0x10}, "YES", 85000))
+	if _, err := reader.ReadTemperatureInF(path); err != ErrDS18B20PowerOnReset {
+		t.Errorf("expected ErrDS18B20PowerOnReset, got %v", err)
+	}
+}
+
+func TestControlLooper_SensorHealth(t *testing.T) {
+	dir := t.TempDir()
+	beer := filepath.Join(dir, "28-0000000001", "w1_slave")
+	chamber := filepath.Join(dir, "28-0000000002", "w1_slave")
+	for path, content := range map[string]string{
+		beer:    strings.Replace(w1SlaveFile([]byte{0x50, 0x01, 0x4b, 0x46, 0x7f, 0xff, 0x10, 0x10}, "YES", 20000), "YES", "NO", 1),
+		chamber: w1SlaveFile([]byte{0x50, 0x01, 0x4b, 0x46, 0x7f, 0xff, 0x10, 0x10}, "YES", 10000),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cl := NewControlLooper(&ConfigGopher{}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	controller := Controller{
+		Name:                "fermenter",
+		ControlType:         "cool",
+		SwitchHosts:         []string{"fridge"},
+		TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 40},
+		Sensors:             []ControllerSensor{{Path: beer}, {Path: chamber, Role: SensorRoleChamber}},
+	}
+	for i := 0; i < 2; i++ {
+		if ret := cl.temperatureControl(context.Background(), &controller); ret.err != nil || ret.tmplog.TemperatureInF != 50 {
+			t.Fatalf("expected to fall back to the chamber: %+v, %v", ret.tmplog, ret.err)
+		}
+	}
+
+	healths := cl.SensorHealth()
+	if len(healths) != 2 || healths[0].Path != beer || healths[1].Path != chamber {
+		t.Fatalf("expected the health of both sensors: %+v", healths)
+	}
+	if healths[0].Reads != 2 || healths[0].CrcErrors != 2 || healths[0].ConsecutiveFailures != 2 || !healths[0].LastSuccess.IsZero() {
+		t.Errorf("expected the beer sensor to have failed its CRC twice: %+v", healths[0])
+	}
+	if healths[1].Failures != 0 || healths[1].ResolutionBits != 12 || healths[1].LastSuccess.IsZero() {
+		t.Errorf("expected a healthy 12 bit chamber sensor: %+v", healths[1])
+	}
+
+	if failing, _ := cl.thermometerFailing(controller, time.Minute, time.Now()); failing {
+		t.Error("expected the controller not to be failing while the chamber reads")
+	}
+	failing, description := cl.thermometerFailing(controller, time.Minute, time.Now().Add(2*time.Minute))
+	if !failing || !strings.Contains(description, "2 of 2 reads failed (2 CRC errors)") {
+		t.Errorf("expected the controller to be failing once the chamber's reading is stale: %t, %s", failing, description)
+	}
+}
+
+func TestDS18B20Reader_Enumerate(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"28-0000000002":  w1SlaveFile([]byte{0x50, 0x01, 0x4b, 0x46, 0x5f, 0xff, 0x10, 0x10}, "YES", 20000),
+		"28-0000000001":  strings.Replace(w1SlaveFile([]byte{0x50, 0x01, 0x4b, 0x46, 0x7f, 0xff, 0x10, 0x10}, "YES", 20000), "YES", "NO", 1),
+		"3b-0000000003":  w1SlaveFile([]byte{0xa0, 0x00, 0x4b, 0x46, 0x7f, 0xff, 0x10, 0x10}, "YES", 10000),
+		"01-0000000004":  "",
+		"w1_bus_master1": "",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if content != "" {
+			if err := os.WriteFile(filepath.Join(root, name, "w1_slave"), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reader := NewDS18B20Reader(log.New(io.Discard, "", 0))
+	reader.Root = root
+
+	thermometers, err := reader.Enumerate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thermometers) != 3 {
+		t.Fatalf("expected the three thermometers, got %+v", thermometers)
+	}
+	if thermometers[0].RomId != "28-0000000001" || thermometers[0].Err != ErrW1CrcMismatch.Error() {
+		t.Errorf("expected the first to fail its CRC: %+v", thermometers[0])
+	}
+	if thermometers[1].Path != "w1:28-0000000002" || thermometers[1].Family != "DS18B20" || thermometers[1].TemperatureInF != 68 || thermometers[1].ResolutionBits != 11 {
+		t.Errorf("unexpected DS18B20: %+v", thermometers[1])
+	}
+	if thermometers[2].Family != "DS1825" || thermometers[2].TemperatureInF != 50 {
+		t.Errorf("unexpected DS1825: %+v", thermometers[2])
+	}
+
+	if paths := reader.EnumerateThermometerPaths(); strings.Join(paths, " ") != "w1:28-0000000002 w1:3b-0000000003" {
+		t.Errorf("expected the paths of the readable thermometers, got %#v", paths)
+	}
+	if temperature, err := reader.ReadTemperatureInF("28-0000000002"); err != nil || temperature != 68 {
+		t.Errorf("expected a sensor ID to be read under Root, got %.2f, %v", temperature, err)
+	}
+	reader.Root = filepath.Join(root, "missing")
+	if _, err := reader.Enumerate(context.Background()); err == nil {
+		t.Error("expected an error for a missing root")
+	}
+}
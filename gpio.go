@@ -0,0 +1,183 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gpioHostPrefix switch hosts like "gpio:17" are GPIO pins, see parseGpioHost
+const gpioHostPrefix = "gpio:"
+
+// DefaultGpioChip the Raspberry Pi's header pins are on the first chip
+const DefaultGpioChip = "gpiochip0"
+
+// gpioChip a GPIO chip we can request output lines from. The Linux character device implements it, and tests can
+// substitute a fake
+type gpioChip interface {
+	// requestOutput claims a line as an output, initially inactive. With activeLow, active means driven low
+	requestOutput(offset int, activeLow bool, consumer string) (gpioLine, error)
+	Close() error
+}
+
+type gpioLine interface {
+	// setActive drives the line active (on) or inactive (off)
+	setActive(active bool) error
+	active() (bool, error)
+	Close() error
+}
+
+// gpioPin where a switch host lives: a line on a chip, and whether it's active low
+type gpioPin struct {
+	chip      string
+	offset    int
+	activeLow bool
+}
+
+// parseGpioHost parses "gpio:17", "gpio:17:low" (active low, as many relay HATs are) and "gpio:gpiochip1:17:high".
+// Without a chip the pin is on DefaultGpioChip, without an active level it's active high
+func parseGpioHost(host string) (gpioPin, error) {
+	if !strings.HasPrefix(host, gpioHostPrefix) {
+		return gpioPin{}, fmt.Errorf("%#v isn't a GPIO pin, it should look like %s17", host, gpioHostPrefix)
+	}
+	parts := strings.Split(strings.TrimPrefix(host, gpioHostPrefix), ":")
+	pin := gpioPin{chip: DefaultGpioChip}
+	switch last := parts[len(parts)-1]; last {
+	case "low", "high":
+		pin.activeLow = last == "low"
+		parts = parts[:len(parts)-1]
+	}
+	switch len(parts) {
+	case 1:
+	case 2:
+		if parts[0] == "" {
+			return gpioPin{}, fmt.Errorf("%#v has a blank chip", host)
+		}
+		pin.chip = parts[0]
+		parts = parts[1:]
+	default:
+		return gpioPin{}, fmt.Errorf("%#v should look like %s[chip:]offset[:low|:high]", host, gpioHostPrefix)
+	}
+	offset, err := strconv.Atoi(parts[0])
+	if err != nil || offset < 0 {
+		return gpioPin{}, fmt.Errorf("%#v doesn't have a valid line offset", host)
+	}
+	pin.offset = offset
+	return pin, nil
+}
+
+// GpioController switches relays and SSRs wired to GPIO pins through the Linux GPIO character device
+// (/dev/gpiochip*). Switch hosts are pins like "gpio:17", see parseGpioHost. Each line is claimed the first time it's
+// switched and held until Close, so it keeps its state between iterations
+type GpioController struct {
+	// openChip opens a chip by name, e.g. gpiochip0. Replaced by tests
+	openChip func(name string) (gpioChip, error)
+
+	mu    sync.Mutex
+	chips map[string]gpioChip
+	lines map[gpioPin]gpioLine
+}
+
+func NewGpioController() *GpioController {
+	return &GpioController{openChip: openGpioCharacterDevice}
+}
+
+func (g *GpioController) ControlDevice(host string, action Control) error {
+	line, err := g.line(host)
+	if err != nil {
+		return err
+	}
+	if err := line.setActive(action == ControlOn); err != nil {
+		return fmt.Errorf("%s: %w", host, err)
+	}
+	return nil
+}
+
+func (g *GpioController) ReadDeviceState(ctx context.Context, host string) (Control, error) {
+	line, err := g.line(host)
+	if err != nil {
+		return 0, err
+	}
+	active, err := line.active()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", host, err)
+	}
+	if active {
+		return ControlOn, nil
+	}
+	return ControlOff, nil
+}
+
+// line returns the host's line, claiming it if we haven't yet
+func (g *GpioController) line(host string) (gpioLine, error) {
+	pin, err := parseGpioHost(host)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if line, ok := g.lines[pin]; ok {
+		return line, nil
+	}
+	for other := range g.lines {
+		if other.chip == pin.chip && other.offset == pin.offset {
+			return nil, fmt.Errorf("%s: line %d of %s is already in use as active %s", host, pin.offset, pin.chip, activeLevel(other.activeLow))
+		}
+	}
+	chip, ok := g.chips[pin.chip]
+	if !ok {
+		open := g.openChip
+		if open == nil {
+			open = openGpioCharacterDevice
+		}
+		chip, err = open(pin.chip)
+		if err != nil {
+			return nil, fmt.Errorf("%s: opening %s: %w", host, pin.chip, err)
+		}
+		if g.chips == nil {
+			g.chips = make(map[string]gpioChip)
+			g.lines = make(map[gpioPin]gpioLine)
+		}
+		g.chips[pin.chip] = chip
+	}
+	line, err := chip.requestOutput(pin.offset, pin.activeLow, "tmpcontrol")
+	if err != nil {
+		return nil, fmt.Errorf("%s: requesting line %d of %s: %w", host, pin.offset, pin.chip, err)
+	}
+	g.lines[pin] = line
+	return line, nil
+}
+
+func activeLevel(activeLow bool) string {
+	if activeLow {
+		return "low"
+	}
+	return "high"
+}
+
+// Close turns every line off and releases it, then releases the chips. Released lines are no longer driven, so
+// turning them off first keeps a relay from being left on
+func (g *GpioController) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var errs []error
+	for pin, line := range g.lines {
+		if err := line.setActive(false); err != nil {
+			errs = append(errs, fmt.Errorf("turning off line %d of %s: %w", pin.offset, pin.chip, err))
+		}
+		if err := line.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(g.lines, pin)
+	}
+	for name, chip := range g.chips {
+		if err := chip.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(g.chips, name)
+	}
+	return errors.Join(errs...)
+}
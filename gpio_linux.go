@@ -0,0 +1,131 @@
+package tmpcontrol
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// The GPIO character device's v2 uAPI, from linux/gpio.h
+const (
+	gpioV2LinesMax          = 64
+	gpioV2LineNumAttrsMax   = 10
+	gpioMaxNameSize         = 32
+	gpioV2LineFlagActiveLow = 1 << 1
+	gpioV2LineFlagOutput    = 1 << 3
+	gpioV2LineAttrIdValues  = 2
+)
+
+type gpioV2LineAttribute struct {
+	id      uint32
+	padding uint32
+	value   uint64 //a union of flags, output values and the debounce period
+}
+
+type gpioV2LineConfigAttribute struct {
+	attr gpioV2LineAttribute
+	mask uint64
+}
+
+type gpioV2LineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	padding  [5]uint32
+	attrs    [gpioV2LineNumAttrsMax]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	offsets         [gpioV2LinesMax]uint32
+	consumer        [gpioMaxNameSize]byte
+	config          gpioV2LineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	padding         [5]uint32
+	fd              int32
+}
+
+type gpioV2LineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// gpioIoctlReadWrite the kernel's _IOWR(0xB4, nr, size)
+func gpioIoctlReadWrite(nr uintptr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | 0xB4<<8 | nr
+}
+
+var (
+	gpioV2GetLineIoctl       = gpioIoctlReadWrite(0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioV2LineGetValuesIoctl = gpioIoctlReadWrite(0x0E, unsafe.Sizeof(gpioV2LineValues{}))
+	gpioV2LineSetValuesIoctl = gpioIoctlReadWrite(0x0F, unsafe.Sizeof(gpioV2LineValues{}))
+)
+
+func gpioIoctl(fd uintptr, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+type gpioCharacterDevice struct {
+	file *os.File
+}
+
+// openGpioCharacterDevice opens /dev/<name>, or name itself if it's a path
+func openGpioCharacterDevice(name string) (gpioChip, error) {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("/dev", name)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &gpioCharacterDevice{file: file}, nil
+}
+
+func (c *gpioCharacterDevice) requestOutput(offset int, activeLow bool, consumer string) (gpioLine, error) {
+	request := gpioV2LineRequest{numLines: 1}
+	request.offsets[0] = uint32(offset)
+	copy(request.consumer[:gpioMaxNameSize-1], consumer)
+	request.config.flags = gpioV2LineFlagOutput
+	if activeLow {
+		request.config.flags |= gpioV2LineFlagActiveLow
+	}
+	//start inactive, so claiming the line never switches the relay on
+	request.config.numAttrs = 1
+	request.config.attrs[0] = gpioV2LineConfigAttribute{attr: gpioV2LineAttribute{id: gpioV2LineAttrIdValues, value: 0}, mask: 1}
+	if err := gpioIoctl(c.file.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&request)); err != nil {
+		return nil, err
+	}
+	return &gpioCharacterDeviceLine{file: os.NewFile(uintptr(request.fd), "gpio-line")}, nil
+}
+
+func (c *gpioCharacterDevice) Close() error {
+	return c.file.Close()
+}
+
+type gpioCharacterDeviceLine struct {
+	file *os.File
+}
+
+func (l *gpioCharacterDeviceLine) setActive(active bool) error {
+	values := gpioV2LineValues{mask: 1}
+	if active {
+		values.bits = 1
+	}
+	return gpioIoctl(l.file.Fd(), gpioV2LineSetValuesIoctl, unsafe.Pointer(&values))
+}
+
+func (l *gpioCharacterDeviceLine) active() (bool, error) {
+	values := gpioV2LineValues{mask: 1}
+	if err := gpioIoctl(l.file.Fd(), gpioV2LineGetValuesIoctl, unsafe.Pointer(&values)); err != nil {
+		return false, err
+	}
+	return values.bits&1 == 1, nil
+}
+
+func (l *gpioCharacterDeviceLine) Close() error {
+	return l.file.Close()
+}
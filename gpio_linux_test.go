@@ -0,0 +1,19 @@
+package tmpcontrol
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// the structs must match the kernel's layout exactly, or the ioctls read and write the wrong fields
+func TestGpioV2StructLayout(t *testing.T) {
+	if size := unsafe.Sizeof(gpioV2LineRequest{}); size != 592 {
+		t.Errorf("expected struct gpio_v2_line_request to be 592 bytes, it's %d", size)
+	}
+	if size := unsafe.Sizeof(gpioV2LineValues{}); size != 16 {
+		t.Errorf("expected struct gpio_v2_line_values to be 16 bytes, it's %d", size)
+	}
+	if gpioV2GetLineIoctl != 0xC250B407 {
+		t.Errorf("expected GPIO_V2_GET_LINE_IOCTL to be 0xC250B407, it's %#x", gpioV2GetLineIoctl)
+	}
+}
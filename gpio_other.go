@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tmpcontrol
+
+import "errors"
+
+func openGpioCharacterDevice(name string) (gpioChip, error) {
+	return nil, errors.New("GPIO pins are only supported on Linux")
+}
@@ -0,0 +1,108 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeGpioChip records the level of each line the way the kernel would drive it
+type fakeGpioChip struct {
+	lines map[int]*fakeGpioLine
+}
+
+type fakeGpioLine struct {
+	activeLow bool
+	//high the physical level of the pin
+	high     bool
+	released bool
+}
+
+func (c *fakeGpioChip) requestOutput(offset int, activeLow bool, consumer string) (gpioLine, error) {
+	if line, ok := c.lines[offset]; ok && !line.released {
+		return nil, errors.New("device or resource busy")
+	}
+	line := &fakeGpioLine{activeLow: activeLow, high: activeLow} //inactive
+	c.lines[offset] = line
+	return line, nil
+}
+
+func (c *fakeGpioChip) Close() error {
+	return nil
+}
+
+func (l *fakeGpioLine) setActive(active bool) error {
+	l.high = active != l.activeLow
+	return nil
+}
+
+func (l *fakeGpioLine) active() (bool, error) {
+	return l.high != l.activeLow, nil
+}
+
+func (l *fakeGpioLine) Close() error {
+	l.released = true
+	return nil
+}
+
+func TestParseGpioHost(t *testing.T) {
+	for host, expected := range map[string]gpioPin{
+		"gpio:17":                {chip: DefaultGpioChip, offset: 17},
+		"gpio:17:low":            {chip: DefaultGpioChip, offset: 17, activeLow: true},
+		"gpio:gpiochip1:4:high":  {chip: "gpiochip1", offset: 4},
+		"gpio:/dev/gpiochip2:22": {chip: "/dev/gpiochip2", offset: 22},
+	} {
+		pin, err := parseGpioHost(host)
+		if err != nil || pin != expected {
+			t.Errorf("%s: expected %+v, got %+v, %v", host, expected, pin, err)
+		}
+	}
+	for _, host := range []string{"gpio:", "gpio:seventeen", "gpio:-1", "gpio:a:b:17", "gpio::17", "192.168.1.20"} {
+		if _, err := parseGpioHost(host); err == nil {
+			t.Errorf("%s: expected an error", host)
+		}
+	}
+}
+
+func TestGpioController(t *testing.T) {
+	chips := map[string]*fakeGpioChip{"gpiochip0": {lines: make(map[int]*fakeGpioLine)}}
+	g := &GpioController{openChip: func(name string) (gpioChip, error) {
+		if chip, ok := chips[name]; ok {
+			return chip, nil
+		}
+		return nil, errors.New("no such file or directory")
+	}}
+
+	if err := g.ControlDevice("gpio:17", ControlOn); err != nil {
+		t.Fatal(err)
+	}
+	if !chips["gpiochip0"].lines[17].high {
+		t.Error("expected an active high pin to be driven high")
+	}
+	if err := g.ControlDevice("gpio:27:low", ControlOn); err != nil {
+		t.Fatal(err)
+	}
+	if chips["gpiochip0"].lines[27].high {
+		t.Error("expected an active low pin to be driven low")
+	}
+	if state, err := g.ReadDeviceState(context.Background(), "gpio:27:low"); err != nil || state != ControlOn {
+		t.Errorf("expected the active low pin to read on, got %s, %v", state, err)
+	}
+
+	if err := g.ControlDevice("gpio:17:low", ControlOn); err == nil {
+		t.Error("expected an error for a line that's already in use with another active level")
+	}
+	if err := g.ControlDevice("gpio:gpiochip9:1", ControlOn); err == nil {
+		t.Error("expected an error for a chip that doesn't exist")
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !chips["gpiochip0"].lines[17].released {
+		t.Error("expected Close to release the lines")
+	}
+	if chips["gpiochip0"].lines[17].high || !chips["gpiochip0"].lines[27].high {
+		t.Error("expected Close to turn the lines off before releasing them")
+	}
+}
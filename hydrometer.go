@@ -0,0 +1,308 @@
+package tmpcontrol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpecificGravityReader optionally implemented by a TemperatureReader whose thermometers also measure gravity, e.g.
+// Hydrometers. The gravity is stored alongside the temperature in the client db
+type SpecificGravityReader interface {
+	//ReadSpecificGravity returns false if the thermometer doesn't measure gravity, or hasn't recently
+	ReadSpecificGravity(connectionString string) (float64, bool)
+}
+
+// HydrometerReading what a Tilt or iSpindel floating in the beer last told us
+type HydrometerReading struct {
+	//Kind "tilt" or "ispindel"
+	Kind string
+	//Name the Tilt's color, e.g. "red", or the iSpindel's name
+	Name            string
+	TemperatureInF  float32
+	SpecificGravity float64
+	//Battery the iSpindel's battery voltage; Tilts don't report it
+	Battery  float64
+	Received time.Time
+}
+
+// defaultHydrometerMaxReadingAge an iSpindel only wakes every 15 minutes by default
+const defaultHydrometerMaxReadingAge = 30 * time.Minute
+
+// Hydrometers keeps the latest reading of every Tilt and iSpindel we hear from. Tilts are heard through their
+// iBeacon advertisements (see IngestTiltStream) or a bridge posting to /tilt, iSpindels post to /ispindel (see
+// ServeHTTP). As a TemperatureReader it reads thermometer paths like "tilt:red" and "ispindel:iSpindel000", so a
+// controller can control on the temperature in the beer
+type Hydrometers struct {
+	//MaxReadingAge how old a reading may be before it's a failed read. Defaults to 30 minutes
+	MaxReadingAge time.Duration
+	//Clock stamps readings and tells how old they are. Defaults to the system clock; give it the looper's Clock
+	Clock  Clock
+	logger Logger
+
+	mu       sync.Mutex
+	readings map[string]HydrometerReading
+}
+
+func NewHydrometers(logger Logger) *Hydrometers {
+	return &Hydrometers{MaxReadingAge: defaultHydrometerMaxReadingAge, Clock: systemClock{}, logger: logger, readings: make(map[string]HydrometerReading)}
+}
+
+func hydrometerKey(kind string, name string) string {
+	return kind + ":" + strings.ToLower(name)
+}
+
+// Record keeps the reading as the latest of its hydrometer
+func (h *Hydrometers) Record(reading HydrometerReading) {
+	if reading.Received.IsZero() {
+		reading.Received = h.Clock.Now()
+	}
+	h.mu.Lock()
+	h.readings[hydrometerKey(reading.Kind, reading.Name)] = reading
+	h.mu.Unlock()
+	h.logger.Printf("%s The %s %s reads %.2f°F and a gravity of %.4f\n", h.Clock.Now().Format(stdTimestampLayout), reading.Kind, reading.Name, reading.TemperatureInF, reading.SpecificGravity)
+}
+
+// Readings the latest reading of every hydrometer we've heard from
+func (h *Hydrometers) Readings() []HydrometerReading {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	readings := make([]HydrometerReading, 0, len(h.readings))
+	for _, reading := range h.readings {
+		readings = append(readings, reading)
+	}
+	return readings
+}
+
+// latest the latest reading of the hydrometer at a thermometer path like "tilt:red", if it isn't too old
+func (h *Hydrometers) latest(connectionString string) (HydrometerReading, error) {
+	kind, name, _ := strings.Cut(connectionString, ":")
+	kind = strings.ToLower(kind)
+	if (kind != "tilt" && kind != "ispindel") || name == "" {
+		return HydrometerReading{}, fmt.Errorf("%#v should look like tilt:red or ispindel:iSpindel000", connectionString)
+	}
+	h.mu.Lock()
+	reading, ok := h.readings[hydrometerKey(kind, name)]
+	h.mu.Unlock()
+	if !ok {
+		return HydrometerReading{}, fmt.Errorf("we haven't heard from the %s %s yet", kind, name)
+	}
+	maxAge := h.MaxReadingAge
+	if maxAge <= 0 {
+		maxAge = defaultHydrometerMaxReadingAge
+	}
+	if age := h.Clock.Now().Sub(reading.Received); age > maxAge {
+		return HydrometerReading{}, fmt.Errorf("we last heard from the %s %s %s ago", kind, name, age.Round(time.Second))
+	}
+	return reading, nil
+}
+
+func (h *Hydrometers) ReadTemperatureInF(connectionString string) (float32, error) {
+	reading, err := h.latest(connectionString)
+	if err != nil {
+		return 0, err
+	}
+	return reading.TemperatureInF, nil
+}
+
+func (h *Hydrometers) ReadSpecificGravity(connectionString string) (float64, bool) {
+	reading, err := h.latest(connectionString)
+	if err != nil || reading.SpecificGravity == 0 {
+		return 0, false
+	}
+	return reading.SpecificGravity, true
+}
+
+// tiltColors the fourth byte of a Tilt's iBeacon UUID, A495BB<color>-C5B1-4B44-B512-1370F02D74DE, tells its color
+var tiltColors = map[byte]string{
+	0x10: "red",
+	0x20: "green",
+	0x30: "black",
+	0x40: "purple",
+	0x50: "orange",
+	0x60: "blue",
+	0x70: "yellow",
+	0x80: "pink",
+}
+
+// iBeaconPrefix Apple's company ID (little endian), the iBeacon type and its length
+var iBeaconPrefix = []byte{0x4C, 0x00, 0x02, 0x15}
+
+var tiltUuidPrefix = []byte{0xA4, 0x95, 0xBB}
+var tiltUuidSuffix = []byte{0xC5, 0xB1, 0x4B, 0x44, 0xB5, 0x12, 0x13, 0x70, 0xF0, 0x2D, 0x74, 0xDE}
+
+// ErrNotATilt returned by DecodeTiltAdvertisement for other BLE advertisements
+var ErrNotATilt = errors.New("the advertisement isn't a Tilt's")
+
+// DecodeTiltAdvertisement decodes the iBeacon in a BLE advertisement, which can be just the manufacturer specific
+// data or a whole HCI event: the major is the temperature in °F and the minor the gravity times 1000. The Tilt Pro
+// sends both with an extra digit of precision
+func DecodeTiltAdvertisement(advertisement []byte) (HydrometerReading, error) {
+	start := bytes.Index(advertisement, iBeaconPrefix)
+	if start < 0 {
+		return HydrometerReading{}, ErrNotATilt
+	}
+	beacon := advertisement[start+len(iBeaconPrefix):]
+	if len(beacon) < 21 { //UUID, major, minor and TX power
+		return HydrometerReading{}, ErrNotATilt
+	}
+	uuid := beacon[:16]
+	color, ok := tiltColors[uuid[3]]
+	if !bytes.Equal(uuid[:3], tiltUuidPrefix) || !bytes.Equal(uuid[4:], tiltUuidSuffix) || !ok {
+		return HydrometerReading{}, ErrNotATilt
+	}
+	major := binary.BigEndian.Uint16(beacon[16:18])
+	minor := binary.BigEndian.Uint16(beacon[18:20])
+	reading := HydrometerReading{Kind: "tilt", Name: color, TemperatureInF: float32(major), SpecificGravity: float64(minor) / 1000}
+	if minor > 5000 { //a Tilt Pro
+		reading.TemperatureInF, reading.SpecificGravity = float32(major)/10, float64(minor)/10000
+	}
+	return reading, nil
+}
+
+// IngestTiltStream records the Tilt advertisements in r until r ends or ctx is done. r is hex (spaces and colons are
+// ignored) with one advertisement per line, like a recording, except that indented lines continue the line before
+// them. That's how `hcidump --raw` prints each packet: a line starting with ">" and then the rest of the packet,
+// indented, about 20 bytes a line. Lines and packets that aren't a Tilt's are skipped
+func (h *Hydrometers) IngestTiltStream(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	var packet []byte
+	//decoded whether we've recorded the packet, which we do as soon as it's long enough rather than waiting for the
+	//next one to start
+	decoded := false
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		line := scanner.Text()
+		if continuation := packet != nil && strings.TrimLeft(line, " \t") != line; !continuation {
+			packet, decoded = nil, false
+		}
+		data, err := hex.DecodeString(strings.NewReplacer(" ", "", ":", "", ">", "", "<", "", "\t", "").Replace(line))
+		if err != nil {
+			packet = nil
+			continue
+		}
+		packet = append(packet, data...)
+		if decoded {
+			continue
+		}
+		if reading, err := DecodeTiltAdvertisement(packet); err == nil {
+			h.Record(reading)
+			decoded = true
+		}
+	}
+	return scanner.Err()
+}
+
+// ServeHTTP takes readings posted by iSpindels to /ispindel (their "HTTP" service, with JSON) and by Tilt bridges
+// to /tilt (the Tilt app's cloud logging, form encoded or JSON)
+func (h *Hydrometers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "readings must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var reading HydrometerReading
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/ispindel":
+		reading, err = parseISpindelReading(body)
+	case "/tilt":
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reading, err = parseTiltBridgeReading(body, mediaType == "application/json")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.Record(reading)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseISpindelReading the JSON an iSpindel posts, e.g. {"name":"iSpindel000","temperature":20.5,"temp_units":"C",
+// "gravity":1.050,"battery":4.1}. A gravity over 1.5 is taken to be in °Plato
+func parseISpindelReading(body []byte) (HydrometerReading, error) {
+	var posted struct {
+		Name        string   `json:"name"`
+		Temperature *float64 `json:"temperature"`
+		TempUnits   string   `json:"temp_units"`
+		Gravity     float64  `json:"gravity"`
+		Battery     float64  `json:"battery"`
+	}
+	if err := json.Unmarshal(body, &posted); err != nil {
+		return HydrometerReading{}, fmt.Errorf("decoding the iSpindel's JSON: %w", err)
+	}
+	if posted.Name == "" || posted.Temperature == nil {
+		return HydrometerReading{}, errors.New("the iSpindel's JSON needs a name and a temperature")
+	}
+	var fahrenheit float64
+	switch strings.ToUpper(posted.TempUnits) {
+	case "", "C":
+		fahrenheit = *posted.Temperature*9/5 + 32
+	case "F":
+		fahrenheit = *posted.Temperature
+	case "K":
+		fahrenheit = (*posted.Temperature-273.15)*9/5 + 32
+	default:
+		return HydrometerReading{}, fmt.Errorf("unknown temp_units %#v", posted.TempUnits)
+	}
+	gravity := posted.Gravity
+	if gravity > 1.5 {
+		gravity = platoToSpecificGravity(gravity)
+	}
+	return HydrometerReading{Kind: "ispindel", Name: posted.Name, TemperatureInF: float32(fahrenheit), SpecificGravity: gravity, Battery: posted.Battery}, nil
+}
+
+func platoToSpecificGravity(plato float64) float64 {
+	return 1 + plato/(258.6-plato/258.2*227.1)
+}
+
+// parseTiltBridgeReading the Tilt app's cloud logging fields: Color, Temp (°F) and SG
+func parseTiltBridgeReading(body []byte, isJson bool) (HydrometerReading, error) {
+	fields := make(map[string]string)
+	if isJson {
+		var posted map[string]interface{}
+		if err := json.Unmarshal(body, &posted); err != nil {
+			return HydrometerReading{}, fmt.Errorf("decoding the Tilt's JSON: %w", err)
+		}
+		for key, value := range posted {
+			fields[strings.ToLower(key)] = strings.TrimSpace(fmt.Sprint(value))
+		}
+	} else {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return HydrometerReading{}, fmt.Errorf("decoding the Tilt's form: %w", err)
+		}
+		for key := range values {
+			fields[strings.ToLower(key)] = strings.TrimSpace(values.Get(key))
+		}
+	}
+	color := strings.ToLower(fields["color"])
+	temperature, temperatureErr := strconv.ParseFloat(fields["temp"], 32)
+	gravity, gravityErr := strconv.ParseFloat(fields["sg"], 64)
+	if color == "" || temperatureErr != nil || gravityErr != nil {
+		return HydrometerReading{}, errors.New("the Tilt's reading needs a Color, a Temp and an SG")
+	}
+	return HydrometerReading{Kind: "tilt", Name: color, TemperatureInF: float32(temperature), SpecificGravity: gravity}, nil
+}
@@ -0,0 +1,178 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tiltAdvertisement the manufacturer specific data of a Tilt of color broadcasting major and minor
+func tiltAdvertisement(color byte, major uint16, minor uint16) string {
+	data := append([]byte{}, iBeaconPrefix...)
+	data = append(data, tiltUuidPrefix...)
+	data = append(data, color)
+	data = append(data, tiltUuidSuffix...)
+	data = append(data, byte(major>>8), byte(major), byte(minor>>8), byte(minor), 0xC5)
+	return hex.EncodeToString(data)
+}
+
+func TestDecodeTiltAdvertisement(t *testing.T) {
+	for advertisement, expected := range map[string]HydrometerReading{
+		tiltAdvertisement(0x10, 68, 1050):                      {Kind: "tilt", Name: "red", TemperatureInF: 68, SpecificGravity: 1.050},
+		"043e2a02010300" + tiltAdvertisement(0x80, 655, 10123): {Kind: "tilt", Name: "pink", TemperatureInF: 65.5, SpecificGravity: 1.0123},
+	} {
+		data, _ := hex.DecodeString(advertisement)
+		reading, err := DecodeTiltAdvertisement(data)
+		if err != nil {
+			t.Errorf("%s: %s", advertisement, err)
+		} else if reading.Name != expected.Name || reading.TemperatureInF != expected.TemperatureInF || math.Abs(reading.SpecificGravity-expected.SpecificGravity) > 1e-9 {
+			t.Errorf("%s: expected %+v, got %+v", advertisement, expected, reading)
+		}
+	}
+	notATilt, _ := hex.DecodeString(strings.Replace(tiltAdvertisement(0x10, 68, 1050), "a495bb", "a495bc", 1))
+	if _, err := DecodeTiltAdvertisement(notATilt); err != ErrNotATilt {
+		t.Errorf("expected ErrNotATilt for another iBeacon, got %v", err)
+	}
+}
+
+func TestHydrometers_TiltStream(t *testing.T) {
+	hydrometers := NewHydrometers(log.New(io.Discard, "", 0))
+	stream := strings.Join([]string{
+		"> 04 3E 2A 02 01",
+		tiltAdvertisement(0x60, 66, 1048),
+		"not hex at all",
+		tiltAdvertisement(0x60, 67, 1046),
+	}, "\n")
+	if err := hydrometers.IngestTiltStream(context.Background(), strings.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+	temperature, err := hydrometers.ReadTemperatureInF("tilt:Blue")
+	if err != nil || temperature != 67 {
+		t.Errorf("expected the blue Tilt's latest 67°F, got %.2f, %v", temperature, err)
+	}
+	if gravity, ok := hydrometers.ReadSpecificGravity("tilt:blue"); !ok || math.Abs(gravity-1.046) > 1e-9 {
+		t.Errorf("expected a gravity of 1.046, got %.4f, %t", gravity, ok)
+	}
+	if _, err := hydrometers.ReadTemperatureInF("tilt:red"); err == nil {
+		t.Error("expected an error for a Tilt we haven't heard from")
+	}
+
+}
+
+func TestHydrometers_HcidumpStream(t *testing.T) {
+	hydrometers := NewHydrometers(log.New(io.Discard, "", 0))
+	clock := NewSimulatedClock(time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC))
+	hydrometers.Clock = clock
+	//`hcidump --raw` splits each packet over several lines: a blue Tilt at 66°F and 1.048, another device's
+	//advertisement, a command we sent, then the Tilt again at 67°F and 1.046
+	stream := `HCI sniffer - Bluetooth packet analyzer ver 5.55
+device: hci0 snap_len: 1500 filter: 0xffffffffffffffff
+> 04 3E 27 02 01 00 00 5A 0B 4E 60 E2 DC 1B 1A FF 4C 00 02 15 
+  A4 95 BB 60 C5 B1 4B 44 B5 12 13 70 F0 2D 74 DE 00 42 04 18 
+  C5 B3 
+> 04 3E 1A 02 01 00 01 11 22 33 44 55 66 0E 02 01 06 0A 09 46 
+  69 74 62 69 74 20 34 32 C0 
+< 01 0C 20 02 01 00 
+> 04 3E 27 02 01 00 00 5A 0B 4E 60 E2 DC 1B 1A FF 4C 00 02 15 
+  A4 95 BB 60 C5 B1 4B 44 B5 12 13 70 F0 2D 74 DE 00 43 04 16 
+  C5 B1 
+`
+	if err := hydrometers.IngestTiltStream(context.Background(), strings.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+	readings := hydrometers.Readings()
+	if len(readings) != 1 || readings[0].Name != "blue" || readings[0].TemperatureInF != 67 || math.Abs(readings[0].SpecificGravity-1.046) > 1e-9 {
+		t.Fatalf("expected the blue Tilt's latest 67°F and 1.046, got %+v", readings)
+	}
+	if !readings[0].Received.Equal(clock.Now()) {
+		t.Errorf("expected the reading to be stamped by the clock, got %s", readings[0].Received)
+	}
+
+	//readings go stale by the clock
+	clock.Advance(hydrometers.MaxReadingAge - time.Second)
+	if _, err := hydrometers.ReadTemperatureInF("tilt:blue"); err != nil {
+		t.Errorf("expected the reading to still be fresh: %s", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := hydrometers.ReadTemperatureInF("tilt:blue"); err == nil {
+		t.Error("expected an error for a stale reading")
+	}
+}
+
+func TestHydrometers_ServeHTTP(t *testing.T) {
+	hydrometers := NewHydrometers(log.New(io.Discard, "", 0))
+	server := httptest.NewServer(hydrometers)
+	defer server.Close()
+	for _, post := range []struct {
+		path, contentType, body string
+		status                  int
+	}{
+		{"/ispindel", "application/json", `{"name":"iSpindel000","ID":1234,"angle":52.1,"temperature":20,"temp_units":"C","battery":4.05,"gravity":12.5,"interval":900,"RSSI":-70}`, http.StatusNoContent},
+		{"/tilt", "application/x-www-form-urlencoded", "Timepoint=45000.5&Temp=64.0&SG=1.044&Beer=Stout&Color=BLACK&Comment=", http.StatusNoContent},
+		{"/ispindel", "application/json", `{"name":"iSpindel000"}`, http.StatusBadRequest},
+		{"/gravitymon", "application/json", `{}`, http.StatusNotFound},
+	} {
+		response, err := http.Post(server.URL+post.path, post.contentType, strings.NewReader(post.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != post.status {
+			t.Errorf("%s %s: expected %d, got %s", post.path, post.body, post.status, response.Status)
+		}
+	}
+
+	if temperature, err := hydrometers.ReadTemperatureInF("ispindel:iSpindel000"); err != nil || temperature != 68 {
+		t.Errorf("expected the iSpindel's 20°C, got %.2f, %v", temperature, err)
+	}
+	if gravity, ok := hydrometers.ReadSpecificGravity("ispindel:iSpindel000"); !ok || math.Abs(gravity-1.0504) > 0.0005 {
+		t.Errorf("expected 12.5°P to be about 1.050, got %.4f", gravity)
+	}
+	if temperature, err := hydrometers.ReadTemperatureInF("tilt:black"); err != nil || temperature != 64 {
+		t.Errorf("expected the Tilt's 64°F, got %.2f, %v", temperature, err)
+	}
+}
+
+func TestControlLooper_StoresGravity(t *testing.T) {
+	hydrometers := NewHydrometers(log.New(io.Discard, "", 0))
+	hydrometers.Record(HydrometerReading{Kind: "tilt", Name: "red", TemperatureInF: 70, SpecificGravity: 1.032})
+	readers := NewTemperatureReaders("w1")
+	_ = readers.Register("tilt", hydrometers)
+	cl := NewControlLooper(&ConfigGopher{}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = readers
+	controller := Controller{
+		Name:                "fermenter",
+		ThermometerPath:     "tilt:red",
+		ControlType:         "cool",
+		SwitchHosts:         []string{"plug"},
+		TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 66},
+	}
+	ret := cl.temperatureControl(context.Background(), &controller)
+	if ret.err != nil || ret.tmplog.TemperatureInF != 70 || ret.tmplog.SpecificGravity != 1.032 {
+		t.Fatalf("expected to control on the Tilt and log its gravity: %+v, %v", ret.tmplog, ret.err)
+	}
+
+	db, err := NewSqliteDbFromFilename(filepath.Join(t.TempDir(), "tmplog.dbo"), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PersistTmpLog(ret.tmplog); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PersistTmpLog(TmpLog{ControllerName: "fridge", Timestamp: time.Now(), TemperatureInF: 40}); err != nil {
+		t.Fatal(err)
+	}
+	tmplogs, err := db.FetchTmpLogsNotYetSentToServer()
+	if err != nil || len(tmplogs) != 2 || tmplogs[0].SpecificGravity != 1.032 || tmplogs[1].SpecificGravity != 0 {
+		t.Errorf("expected the gravity to be stored, and no gravity to be 0: %+v, %v", tmplogs, err)
+	}
+}
@@ -0,0 +1,42 @@
+package tmpcontrol
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// i2cSlaveIoctl I2C_SLAVE from linux/i2c-dev.h, which sets the address later reads and writes go to
+const i2cSlaveIoctl = 0x0703
+
+type i2cCharacterDevice struct {
+	file *os.File
+}
+
+// openI2cCharacterDevice opens /dev/i2c-<bus> and addresses the device at address
+func openI2cCharacterDevice(bus int, address uint16) (i2cDevice, error) {
+	file, err := os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), i2cSlaveIoctl, uintptr(address)); errno != 0 {
+		file.Close()
+		return nil, fmt.Errorf("addressing %#x: %w", address, errno)
+	}
+	return &i2cCharacterDevice{file: file}, nil
+}
+
+func (d *i2cCharacterDevice) write(p []byte) error {
+	_, err := d.file.Write(p)
+	return err
+}
+
+func (d *i2cCharacterDevice) read(p []byte) error {
+	_, err := io.ReadFull(d.file, p)
+	return err
+}
+
+func (d *i2cCharacterDevice) Close() error {
+	return d.file.Close()
+}
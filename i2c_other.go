@@ -0,0 +1,9 @@
+//go:build !linux
+
+package tmpcontrol
+
+import "errors"
+
+func openI2cCharacterDevice(bus int, address uint16) (i2cDevice, error) {
+	return nil, errors.New("I2C sensors are only supported on Linux")
+}
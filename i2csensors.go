@@ -0,0 +1,221 @@
+package tmpcontrol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// i2cDevice one device on an I2C bus. The Linux /dev/i2c-* character device implements it, and tests can substitute a
+// fake
+type i2cDevice interface {
+	write(p []byte) error
+	read(p []byte) error
+	Close() error
+}
+
+// i2cSensor where a sensor lives: its kind ("bme280" or "sht3x"), bus and address
+type i2cSensor struct {
+	kind    string
+	bus     int
+	address uint16
+}
+
+// defaultI2cAddresses the address of each kind of sensor when the path doesn't give one. Both can be strapped to a
+// second address: 0x77 for the BME280 and 0x45 for the SHT3x
+var defaultI2cAddresses = map[string]uint16{
+	"bme280": 0x76,
+	"sht3x":  0x44,
+}
+
+// defaultI2cBus the Raspberry Pi's header pins are on bus 1
+const defaultI2cBus = 1
+
+// parseI2cThermometerPath parses "i2c-bme280:1:0x77", "i2c-sht3x:1" and "i2c-bme280:". Without a bus the sensor is on
+// defaultI2cBus, and without an address it's at the kind's default address
+func parseI2cThermometerPath(path string) (i2cSensor, error) {
+	scheme, rest, _ := strings.Cut(path, ":")
+	kind := strings.TrimPrefix(strings.ToLower(scheme), "i2c-")
+	address, ok := defaultI2cAddresses[kind]
+	if !ok || !strings.HasPrefix(strings.ToLower(scheme), "i2c-") {
+		return i2cSensor{}, fmt.Errorf("%#v isn't an I2C sensor, it should look like i2c-bme280:1:0x76", path)
+	}
+	sensor := i2cSensor{kind: kind, bus: defaultI2cBus, address: address}
+	if rest == "" {
+		return sensor, nil
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) > 2 {
+		return i2cSensor{}, fmt.Errorf("%#v should look like %s:bus[:address]", path, scheme)
+	}
+	bus, err := strconv.Atoi(parts[0])
+	if err != nil || bus < 0 {
+		return i2cSensor{}, fmt.Errorf("%#v doesn't have a valid bus number", path)
+	}
+	sensor.bus = bus
+	if len(parts) == 2 {
+		parsed, err := strconv.ParseUint(parts[1], 0, 7)
+		if err != nil {
+			return i2cSensor{}, fmt.Errorf("%#v doesn't have a valid 7-bit address like 0x76", path)
+		}
+		sensor.address = uint16(parsed)
+	}
+	return sensor, nil
+}
+
+// I2cThermometerReader reads BME280 (and BMP280) and SHT3x sensors on an I2C bus through /dev/i2c-*. Thermometer
+// paths look like "i2c-bme280:1:0x76", see parseI2cThermometerPath. The user running tmpcontrol needs access to
+// /dev/i2c-* (the i2c group on Raspberry Pi OS)
+type I2cThermometerReader struct {
+	// openDevice opens the device at address on bus. Replaced by tests
+	openDevice func(bus int, address uint16) (i2cDevice, error)
+	//mu each reading is a sequence of transfers that another reading on the same bus mustn't interleave with
+	mu sync.Mutex
+}
+
+func NewI2cThermometerReader() *I2cThermometerReader {
+	return &I2cThermometerReader{openDevice: openI2cCharacterDevice}
+}
+
+func (r *I2cThermometerReader) ReadTemperatureInF(path string) (float32, error) {
+	sensor, err := parseI2cThermometerPath(path)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	open := r.openDevice
+	if open == nil {
+		open = openI2cCharacterDevice
+	}
+	device, err := open(sensor.bus, sensor.address)
+	if err != nil {
+		return 0, fmt.Errorf("%s: opening bus %d: %w", path, sensor.bus, err)
+	}
+	defer device.Close()
+	var celsius float64
+	switch sensor.kind {
+	case "bme280":
+		celsius, err = readBme280Temperature(device)
+	case "sht3x":
+		celsius, err = readSht3xTemperature(device)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	fahrenheit := celsius*9/5 + 32
+	if fahrenheit < minValidFahrenheitTemperature || fahrenheit > maxValidFahrenheitTemperature {
+		return 0, fmt.Errorf("%s: invalid temperature: %.2f", path, fahrenheit)
+	}
+	return float32(fahrenheit), nil
+}
+
+// The BME280's registers, from its datasheet
+const (
+	bme280RegisterChipId      = 0xD0
+	bme280RegisterCalibration = 0x88
+	bme280RegisterStatus      = 0xF3
+	bme280RegisterCtrlMeas    = 0xF4
+	bme280RegisterTemperature = 0xFA
+	bme280ChipId              = 0x60
+	bmp280ChipId              = 0x58
+	//bme280ForcedTemperatureOnly one measurement, temperature oversampled x1, pressure (and humidity) skipped
+	bme280ForcedTemperatureOnly = 0x01<<5 | 0x01
+	bme280StatusMeasuring       = 0x08
+	//bme280SkippedMeasurement what the temperature registers hold when it wasn't measured
+	bme280SkippedMeasurement = 0x80000
+)
+
+func readI2cRegisters(device i2cDevice, register byte, p []byte) error {
+	if err := device.write([]byte{register}); err != nil {
+		return err
+	}
+	return device.read(p)
+}
+
+// readBme280Temperature triggers a forced measurement and compensates it with the sensor's calibration, in Celsius
+func readBme280Temperature(device i2cDevice) (float64, error) {
+	id := make([]byte, 1)
+	if err := readI2cRegisters(device, bme280RegisterChipId, id); err != nil {
+		return 0, err
+	}
+	if id[0] != bme280ChipId && id[0] != bmp280ChipId {
+		return 0, fmt.Errorf("the chip ID is %#x, that's not a BME280 or BMP280", id[0])
+	}
+	calibration := make([]byte, 6)
+	if err := readI2cRegisters(device, bme280RegisterCalibration, calibration); err != nil {
+		return 0, err
+	}
+	t1 := float64(uint16(calibration[1])<<8 | uint16(calibration[0]))
+	t2 := float64(int16(uint16(calibration[3])<<8 | uint16(calibration[2])))
+	t3 := float64(int16(uint16(calibration[5])<<8 | uint16(calibration[4])))
+	if err := device.write([]byte{bme280RegisterCtrlMeas, bme280ForcedTemperatureOnly}); err != nil {
+		return 0, err
+	}
+	//a temperature-only measurement takes under 10ms
+	status := make([]byte, 1)
+	for attempt := 0; ; attempt++ {
+		time.Sleep(2 * time.Millisecond)
+		if err := readI2cRegisters(device, bme280RegisterStatus, status); err != nil {
+			return 0, err
+		}
+		if status[0]&bme280StatusMeasuring == 0 {
+			break
+		}
+		if attempt == 20 {
+			return 0, errors.New("the measurement didn't finish")
+		}
+	}
+	raw := make([]byte, 3)
+	if err := readI2cRegisters(device, bme280RegisterTemperature, raw); err != nil {
+		return 0, err
+	}
+	adc := int32(raw[0])<<12 | int32(raw[1])<<4 | int32(raw[2])>>4
+	if adc == bme280SkippedMeasurement {
+		return 0, errors.New("the sensor skipped the measurement")
+	}
+	//the datasheet's floating point compensation
+	var1 := (float64(adc)/16384 - t1/1024) * t2
+	var2 := (float64(adc)/131072 - t1/8192) * (float64(adc)/131072 - t1/8192) * t3
+	return (var1 + var2) / 5120, nil
+}
+
+// sht3xMeasureHighRepeatability a single shot measurement without clock stretching
+var sht3xMeasureHighRepeatability = []byte{0x24, 0x00}
+
+// readSht3xTemperature takes a single shot measurement, in Celsius
+func readSht3xTemperature(device i2cDevice) (float64, error) {
+	if err := device.write(sht3xMeasureHighRepeatability); err != nil {
+		return 0, err
+	}
+	//a high repeatability measurement takes up to 15ms
+	time.Sleep(16 * time.Millisecond)
+	measurement := make([]byte, 6) //temperature, its CRC, humidity, its CRC
+	if err := device.read(measurement); err != nil {
+		return 0, err
+	}
+	if crc := sht3xCrc(measurement[:2]); crc != measurement[2] {
+		return 0, fmt.Errorf("the temperature's CRC is %#x, expected %#x", measurement[2], crc)
+	}
+	raw := float64(uint16(measurement[0])<<8 | uint16(measurement[1]))
+	return -45 + 175*raw/65535, nil
+}
+
+// sht3xCrc CRC-8 with polynomial 0x31 and initialization 0xFF
+func sht3xCrc(data []byte) byte {
+	crc := byte(0xFF)
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x31
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,135 @@
+package tmpcontrol
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// fakeBme280 a register file holding the datasheet's example calibration and measurement, which compensate to 25.08°C
+type fakeBme280 struct {
+	registers [256]byte
+	pointer   byte
+	closed    bool
+}
+
+func newFakeBme280() *fakeBme280 {
+	f := &fakeBme280{}
+	f.registers[bme280RegisterChipId] = bme280ChipId
+	//dig_T1 27504, dig_T2 26435, dig_T3 -1000, little endian
+	copy(f.registers[bme280RegisterCalibration:], []byte{0x70, 0x6B, 0x43, 0x67, 0x18, 0xFC})
+	//adc_T 519888
+	copy(f.registers[bme280RegisterTemperature:], []byte{0x7E, 0xED, 0x00})
+	return f
+}
+
+func (f *fakeBme280) write(p []byte) error {
+	f.pointer = p[0]
+	for i, b := range p[1:] {
+		f.registers[int(f.pointer)+i] = b
+	}
+	return nil
+}
+
+func (f *fakeBme280) read(p []byte) error {
+	copy(p, f.registers[f.pointer:])
+	return nil
+}
+
+func (f *fakeBme280) Close() error {
+	f.closed = true
+	return nil
+}
+
+// fakeSht3x answers a measurement command with raw, followed by its CRC
+type fakeSht3x struct {
+	raw      uint16
+	measured bool
+}
+
+func (f *fakeSht3x) write(p []byte) error {
+	f.measured = p[0] == 0x24
+	return nil
+}
+
+func (f *fakeSht3x) read(p []byte) error {
+	if !f.measured {
+		return errors.New("no measurement")
+	}
+	temperature := []byte{byte(f.raw >> 8), byte(f.raw)}
+	copy(p, append(temperature, sht3xCrc(temperature), 0x66, 0x66, 0x93))
+	return nil
+}
+
+func (f *fakeSht3x) Close() error {
+	return nil
+}
+
+func TestParseI2cThermometerPath(t *testing.T) {
+	for path, expected := range map[string]i2cSensor{
+		"i2c-bme280:":       {kind: "bme280", bus: 1, address: 0x76},
+		"i2c-bme280:1:0x77": {kind: "bme280", bus: 1, address: 0x77},
+		"i2c-sht3x:3":       {kind: "sht3x", bus: 3, address: 0x44},
+		"I2C-SHT3X:0:69":    {kind: "sht3x", bus: 0, address: 69},
+	} {
+		sensor, err := parseI2cThermometerPath(path)
+		if err != nil {
+			t.Errorf("%s: %s", path, err)
+		} else if sensor != expected {
+			t.Errorf("%s: expected %+v, got %+v", path, expected, sensor)
+		}
+	}
+	for _, path := range []string{"i2c-dht22:1", "i2c-bme280:bus", "i2c-bme280:1:0x80", "i2c-bme280:1:0x76:2", "/sys/bus/w1"} {
+		if _, err := parseI2cThermometerPath(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestI2cThermometerReader(t *testing.T) {
+	bme280 := newFakeBme280()
+	sht3x := &fakeSht3x{raw: 0x6666} //25°C
+	reader := &I2cThermometerReader{openDevice: func(bus int, address uint16) (i2cDevice, error) {
+		switch {
+		case bus == 1 && address == 0x77:
+			return bme280, nil
+		case bus == 1 && address == 0x44:
+			return sht3x, nil
+		}
+		return nil, errors.New("no such device")
+	}}
+
+	temperature, err := reader.ReadTemperatureInF("i2c-bme280:1:0x77")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(float64(temperature)-77.15) > 0.01 {
+		t.Errorf("expected 25.08°C, got %.2f°F", temperature)
+	}
+	if bme280.registers[bme280RegisterCtrlMeas] != bme280ForcedTemperatureOnly || !bme280.closed {
+		t.Error("expected a forced measurement and the device to be closed")
+	}
+
+	temperature, err = reader.ReadTemperatureInF("i2c-sht3x:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(float64(temperature)-77) > 0.01 {
+		t.Errorf("expected 25°C, got %.2f°F", temperature)
+	}
+
+	if _, err := reader.ReadTemperatureInF("i2c-bme280:1"); err == nil {
+		t.Error("expected an error for a missing device")
+	}
+	bme280.registers[bme280RegisterChipId] = 0x55
+	if _, err := reader.ReadTemperatureInF("i2c-bme280:1:0x77"); err == nil {
+		t.Error("expected an error for the wrong chip")
+	}
+}
+
+func TestSht3xCrc(t *testing.T) {
+	//the datasheet's example
+	if crc := sht3xCrc([]byte{0xBE, 0xEF}); crc != 0x92 {
+		t.Errorf("expected 0x92, got %#x", crc)
+	}
+}
@@ -0,0 +1,455 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	kasaXorPort  = 9999
+	kasaKlapPort = 80
+	//kasaXorInitialKey the autokey cipher's first key, every following key is the previous ciphertext byte
+	kasaXorInitialKey = 171
+)
+
+// kasaDefaultCredentials devices that were never bound to a TP-Link account accept one of these
+var kasaDefaultCredentials = []KasaCredentials{{}, {Username: "kasa@tp-link.net", Password: "kasaSetup"}}
+
+var ErrKasaAuthentication = errors.New("the plug rejected our credentials")
+
+type KasaCredentials struct {
+	Username string
+	Password string
+}
+
+// NativeKasaController talks to Kasa smart plugs directly over the local network, instead of through the python kasa
+// CLI. Older firmware speaks the XOR autokey protocol on TCP 9999, newer firmware only speaks KLAP over HTTP; we try
+// the first and fall back to the second, remembering what worked for each host. It's a DeviceStateReader, so the
+// control loop reads the relay back to verify every switch
+type NativeKasaController struct {
+	//Credentials the TP-Link account a KLAP plug is bound to. The well-known defaults are tried after these
+	Credentials KasaCredentials
+	//Timeout for each call if ctx doesn't have an earlier deadline. Defaults to controlDeviceTimeout
+	Timeout time.Duration
+	//XorPort and KlapPort are only meant to be changed for testing. They default to 9999 and 80
+	XorPort  int
+	KlapPort int
+	//DiscoveryAddress where to broadcast when resolving a plug by alias or MAC. Defaults to KasaDiscoveryAddress
+	DiscoveryAddress string
+	//DiscoveryTimeout how long we wait for plugs to answer when resolving one. Defaults to 2 seconds
+	DiscoveryTimeout time.Duration
+
+	mu sync.Mutex
+	//klapSessions by address; an address in here doesn't speak the XOR protocol
+	klapSessions map[string]*klapSession
+	//resolvedHosts the last address of each plug we've referred to by alias or MAC
+	resolvedHosts map[string]string
+}
+
+func NewNativeKasaController(credentials KasaCredentials) *NativeKasaController {
+	return &NativeKasaController{
+		Credentials:  credentials,
+		Timeout:      controlDeviceTimeout,
+		XorPort:      kasaXorPort,
+		KlapPort:     kasaKlapPort,
+		klapSessions: make(map[string]*klapSession),
+	}
+}
+
+func (k *NativeKasaController) ControlDevice(host string, action Control) error {
+	return k.ControlDeviceContext(context.Background(), host, action)
+}
+
+func (k *NativeKasaController) ControlDeviceContext(ctx context.Context, host string, action Control) error {
+	ctx, cancel := context.WithTimeout(ctx, k.timeout())
+	defer cancel()
+	state := 0
+	if action == ControlOn {
+		state = 1
+	}
+	request := fmt.Sprintf(`{"system":{"set_relay_state":{"state":%d}},"context":{"source":"tmpcontrol"}}`, state)
+	_, err := k.query(ctx, host, []byte(request))
+	return err
+}
+
+// ReadDeviceState returns whether the plug's relay is on or off
+func (k *NativeKasaController) ReadDeviceState(ctx context.Context, host string) (Control, error) {
+	ctx, cancel := context.WithTimeout(ctx, k.timeout())
+	defer cancel()
+	response, err := k.query(ctx, host, []byte(`{"system":{"get_sysinfo":{}}}`))
+	if err != nil {
+		return 0, err
+	}
+	var sysinfo struct {
+		System struct {
+			GetSysinfo struct {
+				RelayState *int `json:"relay_state"`
+			} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := json.Unmarshal(response, &sysinfo); err != nil {
+		return 0, fmt.Errorf("decoding the plug's sysinfo: %w", err)
+	}
+	switch relayState := sysinfo.System.GetSysinfo.RelayState; {
+	case relayState == nil:
+		return 0, fmt.Errorf("the plug's sysinfo doesn't have a relay_state, is it a plug? %s", response)
+	case *relayState == 1:
+		return ControlOn, nil
+	default:
+		return ControlOff, nil
+	}
+}
+
+// query sends a request to the plug and returns its response, after checking every err_code in it. host is an address,
+// or a reference to a plug by alias or MAC
+func (k *NativeKasaController) query(ctx context.Context, host string, request []byte) ([]byte, error) {
+	address, err := k.resolveHost(ctx, host, false)
+	if err != nil {
+		return nil, fmt.Errorf("kasa %s: %w", host, err)
+	}
+	response, err := k.queryAddress(ctx, address, request)
+	if err != nil && isKasaDeviceReference(host) && ctx.Err() == nil {
+		//the plug may have a new DHCP lease
+		if refreshed, resolveErr := k.resolveHost(ctx, host, true); resolveErr == nil && refreshed != address {
+			response, err = k.queryAddress(ctx, refreshed, request)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kasa %s: %w", host, err)
+	}
+	if err := checkKasaErrCodes(response); err != nil {
+		return nil, fmt.Errorf("kasa %s: %w", host, err)
+	}
+	return response, nil
+}
+
+func (k *NativeKasaController) queryAddress(ctx context.Context, host string, request []byte) ([]byte, error) {
+	var response []byte
+	var err error
+	if session := k.klapSession(host); session != nil {
+		response, err = session.query(ctx, request)
+		if errors.Is(err, errKlapSessionExpired) {
+			k.forgetKlapSession(host)
+			response, err = k.queryKlap(ctx, host, request)
+		}
+	} else {
+		response, err = queryKasaXor(ctx, k.xorAddress(host), request)
+		if err != nil && doesNotSpeakKasaXor(err) {
+			response, err = k.queryKlap(ctx, host, request)
+		}
+	}
+	return response, err
+}
+
+// timeout, xorPort and klapPort apply the defaults, so a NativeKasaController doesn't need NewNativeKasaController
+func (k *NativeKasaController) timeout() time.Duration {
+	if k.Timeout <= 0 {
+		return controlDeviceTimeout
+	}
+	return k.Timeout
+}
+
+func (k *NativeKasaController) xorPort() int {
+	if k.XorPort == 0 {
+		return kasaXorPort
+	}
+	return k.XorPort
+}
+
+func (k *NativeKasaController) klapPort() int {
+	if k.KlapPort == 0 {
+		return kasaKlapPort
+	}
+	return k.KlapPort
+}
+
+// xorAddress the host's address on the XOR port, unless it already has a port, like "fridge-plug.local:9999"
+func (k *NativeKasaController) xorAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(k.xorPort()))
+}
+
+func (k *NativeKasaController) klapSession(host string) *klapSession {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.klapSessions[host]
+}
+
+func (k *NativeKasaController) forgetKlapSession(host string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.klapSessions, host)
+}
+
+// queryKlap starts a new KLAP session with the host and sends the request with it
+func (k *NativeKasaController) queryKlap(ctx context.Context, host string, request []byte) ([]byte, error) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h //the port is the XOR port, see xorAddress
+	}
+	baseUrl := "http://" + net.JoinHostPort(hostname, strconv.Itoa(k.klapPort())) + "/app"
+	var session *klapSession
+	var err error
+	for _, credentials := range append([]KasaCredentials{k.Credentials}, kasaDefaultCredentials...) {
+		session, err = newKlapSession(ctx, baseUrl, credentials)
+		if !errors.Is(err, ErrKasaAuthentication) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	if k.klapSessions == nil {
+		k.klapSessions = make(map[string]*klapSession)
+	}
+	k.klapSessions[host] = session
+	k.mu.Unlock()
+	return session.query(ctx, request)
+}
+
+// doesNotSpeakKasaXor plugs with KLAP-only firmware either refuse connections on the XOR port or hang up on us
+func doesNotSpeakKasaXor(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// checkKasaErrCodes every module in a response reports an err_code, which is 0 on success
+func checkKasaErrCodes(response []byte) error {
+	var modules map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(response, &modules); err != nil {
+		return fmt.Errorf("decoding the plug's response: %w", err)
+	}
+	for module, methods := range modules {
+		for method, raw := range methods {
+			var result struct {
+				ErrCode int    `json:"err_code"`
+				ErrMsg  string `json:"err_msg"`
+			}
+			if json.Unmarshal(raw, &result) == nil && result.ErrCode != 0 {
+				return fmt.Errorf("%s.%s failed with err_code %d: %s", module, method, result.ErrCode, result.ErrMsg)
+			}
+		}
+	}
+	return nil
+}
+
+func kasaXorEncrypt(plaintext []byte) []byte {
+	key := byte(kasaXorInitialKey)
+	ciphertext := make([]byte, len(plaintext))
+	for i, b := range plaintext {
+		ciphertext[i] = b ^ key
+		key = ciphertext[i]
+	}
+	return ciphertext
+}
+
+func kasaXorDecrypt(ciphertext []byte) []byte {
+	key := byte(kasaXorInitialKey)
+	plaintext := make([]byte, len(ciphertext))
+	for i, b := range ciphertext {
+		plaintext[i] = b ^ key
+		key = b
+	}
+	return plaintext
+}
+
+// writeKasaXorFrame writes the big-endian length of the payload, then the encrypted payload
+func writeKasaXorFrame(w io.Writer, plaintext []byte) error {
+	frame := make([]byte, 4, 4+len(plaintext))
+	binary.BigEndian.PutUint32(frame, uint32(len(plaintext)))
+	_, err := w.Write(append(frame, kasaXorEncrypt(plaintext)...))
+	return err
+}
+
+func readKasaXorFrame(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > 1<<20 {
+		return nil, fmt.Errorf("a %d byte frame is too big to be from a plug", length)
+	}
+	ciphertext := make([]byte, length)
+	if _, err := io.ReadFull(r, ciphertext); err != nil {
+		return nil, err
+	}
+	return kasaXorDecrypt(ciphertext), nil
+}
+
+func queryKasaXor(ctx context.Context, address string, request []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := writeKasaXorFrame(conn, request); err != nil {
+		return nil, err
+	}
+	return readKasaXorFrame(conn)
+}
+
+var errKlapSessionExpired = errors.New("the KLAP session expired")
+
+// klapSession a KLAP handshake's result: an AES session key, and a sequence number that's bumped for every request
+type klapSession struct {
+	baseUrl string
+	client  *http.Client
+	cipher  *klapCipher
+
+	mu  sync.Mutex
+	seq int32
+}
+
+// klapAuthHash the hash a plug derives from the credentials it's bound to (KLAP v2)
+func klapAuthHash(credentials KasaCredentials) []byte {
+	username := sha1.Sum([]byte(credentials.Username))
+	password := sha1.Sum([]byte(credentials.Password))
+	hash := sha256.Sum256(append(username[:], password[:]...))
+	return hash[:]
+}
+
+func sha256Of(parts ...[]byte) []byte {
+	hash := sha256.Sum256(bytes.Join(parts, nil))
+	return hash[:]
+}
+
+func newKlapSession(ctx context.Context, baseUrl string, credentials KasaCredentials) (*klapSession, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Jar: jar}
+	localSeed := make([]byte, 16)
+	if _, err := rand.Read(localSeed); err != nil {
+		return nil, err
+	}
+
+	response, err := klapPost(ctx, client, baseUrl+"/handshake1", localSeed)
+	if err != nil {
+		return nil, fmt.Errorf("KLAP handshake1: %w", err)
+	}
+	if len(response) != 48 {
+		return nil, fmt.Errorf("KLAP handshake1: expected 48 bytes, got %d", len(response))
+	}
+	remoteSeed, serverHash := response[:16], response[16:]
+	authHash := klapAuthHash(credentials)
+	if !bytes.Equal(serverHash, sha256Of(localSeed, remoteSeed, authHash)) {
+		return nil, ErrKasaAuthentication
+	}
+
+	if _, err := klapPost(ctx, client, baseUrl+"/handshake2", sha256Of(remoteSeed, localSeed, authHash)); err != nil {
+		return nil, fmt.Errorf("KLAP handshake2: %w", err)
+	}
+	c, seq := newKlapCipher(localSeed, remoteSeed, authHash)
+	return &klapSession{baseUrl: baseUrl, client: client, cipher: c, seq: seq}, nil
+}
+
+func (s *klapSession) query(ctx context.Context, request []byte) ([]byte, error) {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	response, err := klapPost(ctx, s.client, fmt.Sprintf("%s/request?seq=%d", s.baseUrl, seq), s.cipher.encrypt(request, seq))
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.decrypt(response, seq)
+}
+
+func klapPost(ctx context.Context, client *http.Client, url string, body []byte) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusForbidden {
+		return nil, errKlapSessionExpired
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return data, nil
+}
+
+// klapCipher AES-128-CBC with an IV made of a fixed prefix and the request's sequence number, and a SHA-256
+// signature in front of the ciphertext. The plug and we derive the same one from the handshake's seeds
+type klapCipher struct {
+	key       []byte
+	ivPrefix  []byte
+	signature []byte
+}
+
+func newKlapCipher(localSeed, remoteSeed, authHash []byte) (*klapCipher, int32) {
+	iv := sha256Of([]byte("iv"), localSeed, remoteSeed, authHash)
+	return &klapCipher{
+		key:       sha256Of([]byte("lsk"), localSeed, remoteSeed, authHash)[:16],
+		ivPrefix:  iv[:12],
+		signature: sha256Of([]byte("ldk"), localSeed, remoteSeed, authHash)[:28],
+	}, int32(binary.BigEndian.Uint32(iv[28:]))
+}
+
+func (c *klapCipher) iv(seq int32) []byte {
+	return binary.BigEndian.AppendUint32(bytes.Clone(c.ivPrefix), uint32(seq))
+}
+
+func (c *klapCipher) encrypt(plaintext []byte, seq int32) []byte {
+	block, _ := aes.NewCipher(c.key) //the key is always 16 bytes
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append(bytes.Clone(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, c.iv(seq)).CryptBlocks(ciphertext, padded)
+	seqBytes := binary.BigEndian.AppendUint32(nil, uint32(seq))
+	return append(sha256Of(c.signature, seqBytes, ciphertext), ciphertext...)
+}
+
+func (c *klapCipher) decrypt(payload []byte, seq int32) ([]byte, error) {
+	if len(payload) < sha256.Size+aes.BlockSize || (len(payload)-sha256.Size)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("a %d byte KLAP payload can't be right", len(payload))
+	}
+	ciphertext := payload[sha256.Size:]
+	seqBytes := binary.BigEndian.AppendUint32(nil, uint32(seq))
+	if !bytes.Equal(payload[:sha256.Size], sha256Of(c.signature, seqBytes, ciphertext)) {
+		return nil, errors.New("the KLAP payload's signature doesn't match")
+	}
+	block, _ := aes.NewCipher(c.key)
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, c.iv(seq)).CryptBlocks(plaintext, ciphertext)
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("the KLAP payload's padding is invalid")
+	}
+	return plaintext[:len(plaintext)-padding], nil
+}
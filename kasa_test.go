@@ -0,0 +1,300 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKasaPlug a Kasa plug that speaks either the XOR protocol or KLAP on localhost
+type fakeKasaPlug struct {
+	credentials KasaCredentials
+	alias, mac  string
+	//stuck the relay ignores set_relay_state
+	stuck bool
+
+	mu         sync.Mutex
+	relayState int
+	//KLAP state; a zero cipher means there's no session
+	localSeed, remoteSeed []byte
+	cipher                *klapCipher
+}
+
+func (p *fakeKasaPlug) handle(request []byte) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var r struct {
+		System struct {
+			SetRelayState *struct {
+				State int `json:"state"`
+			} `json:"set_relay_state"`
+			GetSysinfo *struct{} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := json.Unmarshal(request, &r); err != nil {
+		return []byte(`{"system":{"err_code":-1,"err_msg":"bad json"}}`)
+	}
+	if r.System.SetRelayState != nil {
+		if r.System.SetRelayState.State != 0 && r.System.SetRelayState.State != 1 {
+			return []byte(`{"system":{"set_relay_state":{"err_code":-3,"err_msg":"invalid argument"}}}`)
+		}
+		if !p.stuck {
+			p.relayState = r.System.SetRelayState.State
+		}
+		return []byte(`{"system":{"set_relay_state":{"err_code":0}}}`)
+	}
+	return []byte(fmt.Sprintf(`{"system":{"get_sysinfo":{"alias":%q,"mac":%q,"model":"HS103(US)","relay_state":%d,"err_code":0}}}`, p.alias, p.mac, p.relayState))
+}
+
+func (p *fakeKasaPlug) serveXor(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			request, err := readKasaXorFrame(conn)
+			if err == nil {
+				_ = writeKasaXorFrame(conn, p.handle(request))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// serveDiscovery answers discovery requests like a plug does on UDP 9999; returns the address to send them to
+func (p *fakeKasaPlug) serveDiscovery(t *testing.T) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(kasaXorEncrypt(p.handle(kasaXorDecrypt(buffer[:n]))), from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func (p *fakeKasaPlug) serveKlap(t *testing.T) int {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /app/handshake1", func(w http.ResponseWriter, r *http.Request) {
+		localSeed, _ := io.ReadAll(r.Body)
+		remoteSeed := make([]byte, 16)
+		_, _ = rand.Read(remoteSeed)
+		p.mu.Lock()
+		p.localSeed, p.remoteSeed, p.cipher = localSeed, remoteSeed, nil
+		p.mu.Unlock()
+		http.SetCookie(w, &http.Cookie{Name: "TP_SESSIONID", Value: "fake"})
+		_, _ = w.Write(append(remoteSeed, sha256Of(localSeed, remoteSeed, klapAuthHash(p.credentials))...))
+	})
+	mux.HandleFunc("POST /app/handshake2", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		authHash := klapAuthHash(p.credentials)
+		if !bytes.Equal(body, sha256Of(p.remoteSeed, p.localSeed, authHash)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		p.cipher, _ = newKlapCipher(p.localSeed, p.remoteSeed, authHash)
+	})
+	mux.HandleFunc("POST /app/request", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seq, err := strconv.Atoi(r.URL.Query().Get("seq"))
+		p.mu.Lock()
+		c := p.cipher
+		p.mu.Unlock()
+		if c == nil || err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		request, err := c.decrypt(body, int32(seq))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(c.encrypt(p.handle(request), int32(seq)))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func (p *fakeKasaPlug) state() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.relayState
+}
+
+// expireKlapSession makes the plug forget our session, like it does after its TIMEOUT
+func (p *fakeKasaPlug) expireKlapSession() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cipher = nil
+}
+
+// closedPort a port nothing listens on
+func closedPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestKasaXorCipher(t *testing.T) {
+	//a well-known sample from the protocol's reverse engineering
+	ciphertext := kasaXorEncrypt([]byte(`{"system":{"get_sysinfo":{}}}`))
+	if ciphertext[0] != 0xd0 || ciphertext[1] != 0xf2 {
+		t.Errorf("unexpected ciphertext: %x", ciphertext)
+	}
+	if string(kasaXorDecrypt(ciphertext)) != `{"system":{"get_sysinfo":{}}}` {
+		t.Error("decrypting didn't round trip")
+	}
+}
+
+func TestNativeKasaController_Xor(t *testing.T) {
+	plug := &fakeKasaPlug{}
+	//without NewNativeKasaController, so the Timeout default is applied when it's used
+	k := &NativeKasaController{XorPort: plug.serveXor(t), KlapPort: closedPort(t)}
+
+	for _, action := range []Control{ControlOn, ControlOff, ControlOn} {
+		if err := k.ControlDevice("127.0.0.1", action); err != nil {
+			t.Fatal(err)
+		}
+		state, err := k.ReadDeviceState(context.Background(), "127.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != action {
+			t.Errorf("expected the plug to be %s, it's %s", action, state)
+		}
+	}
+
+	plug.mu.Lock()
+	plug.stuck = true
+	plug.mu.Unlock()
+	if err := k.ControlDevice("127.0.0.1", ControlOff); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := k.ReadDeviceState(context.Background(), "127.0.0.1"); err != nil || state != ControlOn {
+		t.Errorf("expected the stuck plug to still be on, got %s, %v", state, err)
+	}
+
+	//a host with a port is reached on that port rather than XorPort
+	withPort := &NativeKasaController{XorPort: closedPort(t), KlapPort: closedPort(t)}
+	if state, err := withPort.ReadDeviceState(context.Background(), net.JoinHostPort("127.0.0.1", strconv.Itoa(k.XorPort))); err != nil || state != ControlOn {
+		t.Errorf("expected to reach the plug on its port, got %s, %v", state, err)
+	}
+}
+
+func TestNativeKasaController_Klap(t *testing.T) {
+	plug := &fakeKasaPlug{credentials: KasaCredentials{Username: "brewer@example.com", Password: "hunter2"}}
+	k := NewNativeKasaController(plug.credentials)
+	k.XorPort = closedPort(t)
+	k.KlapPort = plug.serveKlap(t)
+
+	if err := k.ControlDevice("127.0.0.1", ControlOn); err != nil {
+		t.Fatal(err)
+	}
+	if plug.state() != 1 {
+		t.Error("expected the plug to be on")
+	}
+
+	//a new session is negotiated once the plug forgets ours
+	plug.expireKlapSession()
+	if err := k.ControlDevice("127.0.0.1", ControlOff); err != nil {
+		t.Fatal(err)
+	}
+	if plug.state() != 0 {
+		t.Error("expected the plug to be off")
+	}
+
+	wrong := NewNativeKasaController(KasaCredentials{Username: "brewer@example.com", Password: "wrong"})
+	wrong.XorPort = k.XorPort
+	wrong.KlapPort = k.KlapPort
+	if err := wrong.ControlDevice("127.0.0.1", ControlOn); !errors.Is(err, ErrKasaAuthentication) {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+}
+
+func TestNativeKasaController_KlapDefaultCredentials(t *testing.T) {
+	plug := &fakeKasaPlug{} //never bound to an account
+	k := NewNativeKasaController(KasaCredentials{Username: "brewer@example.com", Password: "hunter2"})
+	k.XorPort = closedPort(t)
+	k.KlapPort = plug.serveKlap(t)
+	if err := k.ControlDevice("127.0.0.1", ControlOn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckKasaErrCodes(t *testing.T) {
+	if err := checkKasaErrCodes([]byte(`{"system":{"set_relay_state":{"err_code":-3,"err_msg":"invalid argument"}}}`)); err == nil {
+		t.Error("expected an error for a non-zero err_code")
+	}
+	if err := checkKasaErrCodes([]byte(`{"system":{"set_relay_state":{"err_code":0}}}`)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiscoverKasaDevices(t *testing.T) {
+	plug := &fakeKasaPlug{alias: "Fermentation fridge", mac: "50:c7:bf:00:00:01", relayState: 1}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	devices, err := DiscoverKasaDevices(ctx, plug.serveDiscovery(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := KasaDevice{Host: "127.0.0.1", Alias: "Fermentation fridge", Mac: "50:C7:BF:00:00:01", Model: "HS103(US)", State: ControlOn}
+	if len(devices) != 1 || devices[0] != expected {
+		t.Errorf("unexpected devices: %+v", devices)
+	}
+}
+
+func TestNativeKasaController_ResolvesAliasAndMac(t *testing.T) {
+	plug := &fakeKasaPlug{alias: "Fermentation fridge", mac: "50:C7:BF:00:00:01"}
+	k := NewNativeKasaController(KasaCredentials{})
+	k.XorPort = plug.serveXor(t)
+	k.DiscoveryAddress = plug.serveDiscovery(t)
+	k.DiscoveryTimeout = 100 * time.Millisecond
+
+	if err := k.ControlDevice("alias:Fermentation fridge", ControlOn); err != nil {
+		t.Fatal(err)
+	}
+	if plug.state() != 1 {
+		t.Error("expected the plug to be on")
+	}
+	state, err := k.ReadDeviceState(context.Background(), "50-c7-bf-00-00-01")
+	if err != nil || state != ControlOn {
+		t.Errorf("expected to read the plug by MAC, got %s, %v", state, err)
+	}
+	if err := k.ControlDevice("alias:Kegerator", ControlOn); err == nil {
+		t.Error("expected an error for a plug that doesn't answer discovery")
+	}
+}
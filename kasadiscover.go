@@ -0,0 +1,178 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KasaDiscoveryAddress where plugs listen for discovery broadcasts. Plugs with KLAP-only firmware answer a different,
+// encrypted discovery protocol on port 20002 and won't show up
+const KasaDiscoveryAddress = "255.255.255.255:9999"
+
+// defaultKasaDiscoveryTimeout how long we wait for plugs to answer a discovery broadcast
+const defaultKasaDiscoveryTimeout = 2 * time.Second
+
+// kasaAliasPrefix a switch host like "alias:Fermentation fridge" refers to the plug by its name in the Kasa app
+const kasaAliasPrefix = "alias:"
+
+var macAddressRegex = regexp.MustCompile(`^(?i)[0-9a-f]{2}([:-][0-9a-f]{2}){5}$`)
+
+type KasaDevice struct {
+	Host  string  `json:"host"`
+	Alias string  `json:"alias"`
+	Mac   string  `json:"mac"`
+	Model string  `json:"model"`
+	State Control `json:"-"`
+}
+
+// DiscoverKasaDevices broadcasts a sysinfo request to broadcastAddress (usually KasaDiscoveryAddress) and collects
+// the answers until ctx is done, sorted by alias
+func DiscoverKasaDevices(ctx context.Context, broadcastAddress string) ([]KasaDevice, error) {
+	address, err := net.ResolveUDPAddr("udp4", broadcastAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	//closing the connection unblocks ReadFromUDP once ctx is done
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	if _, err := conn.WriteToUDP(kasaXorEncrypt([]byte(`{"system":{"get_sysinfo":{}}}`)), address); err != nil {
+		return nil, fmt.Errorf("broadcasting discovery: %w", err)
+	}
+	found := make(map[string]KasaDevice)
+	buffer := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		device, err := parseKasaDiscoveryResponse(kasaXorDecrypt(buffer[:n]))
+		if err != nil {
+			continue //something else answered on the port
+		}
+		device.Host = from.IP.String()
+		found[device.Host] = device
+	}
+
+	devices := make([]KasaDevice, 0, len(found))
+	for _, device := range found {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Alias != devices[j].Alias {
+			return devices[i].Alias < devices[j].Alias
+		}
+		return devices[i].Host < devices[j].Host
+	})
+	return devices, nil
+}
+
+func parseKasaDiscoveryResponse(response []byte) (KasaDevice, error) {
+	var sysinfo struct {
+		System struct {
+			GetSysinfo struct {
+				Alias      string `json:"alias"`
+				Mac        string `json:"mac"`
+				MicMac     string `json:"mic_mac"` //some models report their MAC here instead, without separators
+				Model      string `json:"model"`
+				RelayState int    `json:"relay_state"`
+			} `json:"get_sysinfo"`
+		} `json:"system"`
+	}
+	if err := json.Unmarshal(response, &sysinfo); err != nil {
+		return KasaDevice{}, err
+	}
+	info := sysinfo.System.GetSysinfo
+	if info.Model == "" {
+		return KasaDevice{}, errors.New("the response doesn't look like a Kasa sysinfo")
+	}
+	device := KasaDevice{Alias: info.Alias, Mac: normalizeMac(info.Mac), Model: info.Model, State: ControlOff}
+	if device.Mac == "" {
+		device.Mac = normalizeMac(info.MicMac)
+	}
+	if info.RelayState == 1 {
+		device.State = ControlOn
+	}
+	return device, nil
+}
+
+// normalizeMac upper case and colon separated, e.g. "50:C7:BF:00:00:01"
+func normalizeMac(mac string) string {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(hex) != 12 {
+		return strings.ToUpper(mac)
+	}
+	pairs := make([]string, 0, 6)
+	for i := 0; i < 12; i += 2 {
+		pairs = append(pairs, hex[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// isKasaDeviceReference whether a switch host names a plug by alias or MAC, instead of by address
+func isKasaDeviceReference(host string) bool {
+	return strings.HasPrefix(host, kasaAliasPrefix) || macAddressRegex.MatchString(host)
+}
+
+// resolveHost turns a switch host that names a plug by alias or MAC into its current address. Addresses are cached,
+// and rediscovered when the host isn't in the cache or refresh is set (the plug may have a new DHCP lease)
+func (k *NativeKasaController) resolveHost(ctx context.Context, host string, refresh bool) (string, error) {
+	if !isKasaDeviceReference(host) {
+		return host, nil
+	}
+	k.mu.Lock()
+	address, ok := k.resolvedHosts[host]
+	k.mu.Unlock()
+	if ok && !refresh {
+		return address, nil
+	}
+
+	discoveryAddress := k.DiscoveryAddress
+	if discoveryAddress == "" {
+		discoveryAddress = KasaDiscoveryAddress
+	}
+	discoveryTimeout := k.DiscoveryTimeout
+	if discoveryTimeout <= 0 {
+		discoveryTimeout = defaultKasaDiscoveryTimeout
+	}
+	discoveryCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+	devices, err := DiscoverKasaDevices(discoveryCtx, discoveryAddress)
+	if err != nil {
+		return "", fmt.Errorf("discovering %s: %w", host, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.resolvedHosts == nil {
+		k.resolvedHosts = make(map[string]string)
+	}
+	for _, device := range devices {
+		k.resolvedHosts[kasaAliasPrefix+device.Alias] = device.Host
+		k.resolvedHosts[device.Mac] = device.Host
+	}
+	key := host
+	if !strings.HasPrefix(host, kasaAliasPrefix) {
+		key = normalizeMac(host)
+	}
+	address, ok = k.resolvedHosts[key]
+	if !ok {
+		return "", fmt.Errorf("no plug answered discovery as %s", host)
+	}
+	k.resolvedHosts[host] = address
+	return address, nil
+}
@@ -0,0 +1,159 @@
+package tmpcontrol
+
+import (
+	"fmt"
+	"time"
+)
+
+// loopHealth what the control loop remembers so it only notifies the server when something starts failing, and when
+// it recovers
+type loopHealth struct {
+	//start when the loop started
+	start                time.Time
+	lastConfigFetched    time.Time
+	isConfigFetchFailing bool
+	//successfulHostControlTimestamp by host; zero for the hosts we haven't reached yet
+	successfulHostControlTimestamp map[string]time.Time
+	//hostAppeared by host: after the startup grace period from then, we start to worry about hosts we've never heard from
+	hostAppeared      map[string]time.Time
+	failingHostStates map[string]bool
+	//failingTempReadStates and sleepingControllers by controller name. Temp read errors aren't reported for sleeping
+	//controllers
+	failingTempReadStates map[string]bool
+	sleepingControllers   map[string]bool
+}
+
+func newLoopHealth(config ControllersConfig, now time.Time) *loopHealth {
+	//TODO what happens when a host is removed from the config entirely?
+	h := &loopHealth{
+		start:                          now,
+		lastConfigFetched:              now,
+		successfulHostControlTimestamp: make(map[string]time.Time),
+		hostAppeared:                   make(map[string]time.Time),
+		failingHostStates:              make(map[string]bool),
+		failingTempReadStates:          make(map[string]bool),
+		sleepingControllers:            make(map[string]bool),
+	}
+	h.trackHosts(config, now)
+	return h
+}
+
+// trackHosts starts keeping an eye on the switch hosts in config we weren't tracking yet, as of now
+func (h *loopHealth) trackHosts(config ControllersConfig, now time.Time) {
+	for _, host := range uniqueSwitchHosts(config) {
+		if _, ok := h.hostAppeared[host]; ok {
+			continue
+		}
+		h.hostAppeared[host] = now
+		if _, ok := h.successfulHostControlTimestamp[host]; !ok {
+			h.successfulHostControlTimestamp[host] = time.Time{}
+		}
+	}
+}
+
+// iterationFinished takes in what a controller's iteration learned about its hosts and whether it's sleeping
+func (h *loopHealth) iterationFinished(ret temperatureControlReturn) {
+	h.sleepingControllers[ret.controllerConfig.Name] = ret.noSchedulesAreActive
+	h.successfulHostControlTimestamp = updateSuccessfulHostTimestamps(h.successfulHostControlTimestamp, ret.successfulHostControlTimestamp)
+}
+
+// configFetched notifies the server if we've just recovered from failing to fetch the config
+func (cl *ControlLooper) configFetched(h *loopHealth, now time.Time) {
+	timeElapsedSinceLastConfigFetched := now.Sub(h.lastConfigFetched)
+	h.lastConfigFetched = now
+	if h.isConfigFetchFailing { //we just recovered from the config fetch failing
+		h.isConfigFetchFailing = false
+		cl.notify(fmt.Sprintf("%s: we have recovered from config retrieval issues after %s", cl.Cg.ClientId, timeElapsedSinceLastConfigFetched.String()), ProblemNotification)
+	}
+}
+
+// configFetchFailed notifies the server once we've gone without config for too long
+func (cl *ControlLooper) configFetchFailed(h *loopHealth, config ControllersConfig, now time.Time) {
+	configFetchAlertAfter := cl.configFetchAlertAfter(config)
+	if !h.isConfigFetchFailing && h.lastConfigFetched.Add(configFetchAlertAfter).Before(now) {
+		h.isConfigFetchFailing = true
+		cl.notify(fmt.Sprintf("%s: we haven't received config in %s", cl.Cg.ClientId, configFetchAlertAfter.String()), ProblemNotification)
+	}
+}
+
+// checkThermometerHealth checks up on temperature read health for each controller. We only notify the server if we
+// are just entering into (or recovering from) the failing state
+func (cl *ControlLooper) checkThermometerHealth(h *loopHealth, config ControllersConfig, now time.Time) {
+	for i := range config.Controllers {
+		name := config.Controllers[i].Name
+		//no need to worry if the controller is asleep
+		isControllerAsleep, ok := h.sleepingControllers[name]
+		if ok && isControllerAsleep {
+			previouslyFailing, ok := h.failingTempReadStates[name]
+			if ok && previouslyFailing {
+				h.failingTempReadStates[name] = false
+				cl.notify(fmt.Sprintf("We previously informed that the thermometer for controller %s couldn't be read. Now that controller is sleeping, so we'll ignore the problem for now", name), SeriousNotification)
+			}
+			continue
+		}
+
+		tempReadAlertAfter := cl.timingFor(config, config.Controllers[i]).tempReadAlertAfter
+		if now.Sub(h.start) < tempReadAlertAfter {
+			//we can't have gone that long without contact yet, and the controller may not have read its thermometer
+			continue
+		}
+		if failing, health := cl.thermometerFailing(config.Controllers[i], tempReadAlertAfter, now); failing {
+			//we're failing to read this controller's thermometer. Do we need to notify the server?
+			if !h.failingTempReadStates[name] {
+				h.failingTempReadStates[name] = true
+				cl.notify(fmt.Sprintf("We haven't had contact with the thermometer for controller %s for %s (%s)", name, tempReadAlertAfter.String(), health), SeriousNotification)
+			}
+		} else if h.failingTempReadStates[name] {
+			//we are successfully reading this controller's thermometer again
+			h.failingTempReadStates[name] = false
+			cl.notify(fmt.Sprintf("We recovered contact with the thermometer for controller %s", name), SeriousNotification)
+		}
+	}
+}
+
+// checkSwitchHostHealth checks up on host communication health to see if we should notify
+func (cl *ControlLooper) checkSwitchHostHealth(h *loopHealth, config ControllersConfig, now time.Time) {
+	sleepingHosts := findSleepingHosts(config, h.sleepingControllers) //host maps to bool if they belong to no awake controller
+	hostTimings := cl.hostTimings(config)
+	for host, lastSuccess := range h.successfulHostControlTimestamp {
+		timing, ok := hostTimings[host]
+		if !ok {
+			continue //the host is no longer in the config
+		}
+		//no need to worry if host is asleep
+		isHostAsleep, ok := sleepingHosts[host]
+		if ok && isHostAsleep {
+			previouslyFailing, ok := h.failingHostStates[host]
+			if ok && previouslyFailing {
+				h.failingHostStates[host] = false
+				cl.notify(fmt.Sprintf("We previously informed that the host %s couldn't be contacted. That switch-host is no longer associated with an active controller. We'll ignore the problem for now", host), ProblemNotification)
+			}
+			continue
+		}
+
+		//the startup grace period is a special case since we won't have any successful timestamps before the first time
+		appeared := h.hostAppeared[host]
+		if lastSuccess.IsZero() && now.After(appeared.Add(timing.startupGracePeriod)) {
+			if !h.failingHostStates[host] {
+				cl.Logger.Printf("%#v\n", h.successfulHostControlTimestamp)
+				h.failingHostStates[host] = true
+				if appeared.Equal(h.start) {
+					cl.notify(fmt.Sprintf("We started the control loop over %s ago and we still haven't heard from host %s", timing.startupGracePeriod, host), ProblemNotification)
+				} else {
+					cl.notify(fmt.Sprintf("Host %s was added to the config over %s ago and we still haven't heard from it", host, timing.startupGracePeriod), ProblemNotification)
+				}
+			}
+		} else if !lastSuccess.IsZero() && lastSuccess.Add(timing.switchHostAlertAfter).Before(now) {
+			if !h.failingHostStates[host] {
+				cl.Logger.Printf("%#v", h.successfulHostControlTimestamp)
+				h.failingHostStates[host] = true
+				cl.notify(fmt.Sprintf("We haven't had contact with switch-host %s since %s", host, lastSuccess.Format(stdTimestampLayout)), ProblemNotification)
+			}
+		} else if h.failingHostStates[host] { //it seems this host has recovered
+			cl.Logger.Printf("%#v", h.successfulHostControlTimestamp)
+			h.failingHostStates[host] = false
+			//we maintain the problem notification urgency to make sure the admin was notified and through the same means
+			cl.notify(fmt.Sprintf("We recovered contact with switch-host %s at %s", host, lastSuccess.Format(stdTimestampLayout)), ProblemNotification)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notificationsSince returns what was notified since it was last called
+func notificationsSince(notifications *syncBuffer) func() string {
+	var seen int
+	return func() string {
+		all := notifications.String()
+		since := all[seen:]
+		seen = len(all)
+		return since
+	}
+}
+
+func TestLoopHealth_Thermometer(t *testing.T) {
+	notifications := &syncBuffer{}
+	cl := NewControlLooper(&ConfigGopher{NotifyOutput: notifications}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	controller := Controller{Name: "fermenter", ThermometerPath: "/fermenter", ControlType: "cool", SwitchHosts: []string{"fridge"}}
+	config := ControllersConfig{Controllers: []Controller{controller}}
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	health := newLoopHealth(config, start)
+	newNotifications := notificationsSince(notifications)
+
+	for _, step := range []struct {
+		at       time.Duration
+		read     error
+		sleeping bool
+		expected string
+	}{
+		{at: 0},
+		{at: 45 * time.Second, read: ErrW1CrcMismatch},
+		{at: 75 * time.Second, read: ErrW1CrcMismatch, expected: "We haven't had contact with the thermometer for controller fermenter for 1m0s (/fermenter: 2 of 3 reads failed (2 CRC errors)"},
+		{at: 90 * time.Second, read: ErrW1CrcMismatch},
+		{at: 105 * time.Second, expected: "We recovered contact with the thermometer for controller fermenter"},
+		{at: 180 * time.Second, read: ErrDS18B20Disconnected, expected: "We haven't had contact with the thermometer for controller fermenter"},
+		{at: 195 * time.Second, sleeping: true, expected: "Now that controller is sleeping"},
+		{at: 10 * time.Minute, sleeping: true},
+		{at: 11 * time.Minute, read: ErrDS18B20Disconnected, expected: "We haven't had contact with the thermometer for controller fermenter"},
+	} {
+		now := start.Add(step.at)
+		if !step.sleeping {
+			cl.sensorHealth.record("/fermenter", step.read, 0, now)
+		}
+		health.iterationFinished(temperatureControlReturn{controllerConfig: &controller, noSchedulesAreActive: step.sleeping})
+		cl.checkThermometerHealth(health, config, now)
+		if notified := newNotifications(); (step.expected == "") != (notified == "") || !strings.Contains(notified, step.expected) {
+			t.Errorf("%s: expected %#v, got %#v", step.at, step.expected, notified)
+		}
+	}
+}
+
+func TestLoopHealth_SwitchHost(t *testing.T) {
+	notifications := &syncBuffer{}
+	cl := NewControlLooper(&ConfigGopher{NotifyOutput: notifications}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	controller := Controller{Name: "fermenter", ThermometerPath: "/fermenter", ControlType: "cool", SwitchHosts: []string{"fridge"}}
+	config := ControllersConfig{Controllers: []Controller{controller}}
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	health := newLoopHealth(config, start)
+	newNotifications := notificationsSince(notifications)
+
+	for _, step := range []struct {
+		at       time.Duration
+		reached  bool
+		sleeping bool
+		expected string
+	}{
+		{at: 30 * time.Second},
+		{at: 61 * time.Second, expected: "We started the control loop over 1m0s ago and we still haven't heard from host fridge"},
+		{at: 70 * time.Second},
+		{at: 75 * time.Second, reached: true, expected: "We recovered contact with switch-host fridge at 2026-03-01 00:01:15"},
+		{at: 5 * time.Minute},
+		{at: 6*time.Minute + 30*time.Second, expected: "We haven't had contact with switch-host fridge since 2026-03-01 00:01:15"},
+		{at: 7 * time.Minute, sleeping: true, expected: "That switch-host is no longer associated with an active controller"},
+		{at: 20 * time.Minute, sleeping: true},
+		{at: 21 * time.Minute, reached: true},
+	} {
+		now := start.Add(step.at)
+		ret := temperatureControlReturn{controllerConfig: &controller, noSchedulesAreActive: step.sleeping, successfulHostControlTimestamp: map[string]time.Time{}}
+		if step.reached {
+			ret.successfulHostControlTimestamp["fridge"] = now
+		}
+		health.iterationFinished(ret)
+		cl.checkSwitchHostHealth(health, config, now)
+		if notified := newNotifications(); (step.expected == "") != (notified == "") || !strings.Contains(notified, step.expected) {
+			t.Errorf("%s: expected %#v, got %#v", step.at, step.expected, notified)
+		}
+	}
+}
+
+func TestLoopHealth_AddedSwitchHost(t *testing.T) {
+	notifications := &syncBuffer{}
+	cl := NewControlLooper(&ConfigGopher{NotifyOutput: notifications}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	fermenter := Controller{Name: "fermenter", ThermometerPath: "/fermenter", ControlType: "cool", SwitchHosts: []string{"fridge"}}
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	health := newLoopHealth(ControllersConfig{Controllers: []Controller{fermenter}}, start)
+	newNotifications := notificationsSince(notifications)
+
+	//a config change half a minute in adds a controller with a new host
+	mash := Controller{Name: "mash", ThermometerPath: "/mash", ControlType: "heat", SwitchHosts: []string{"fridge", "heater"}}
+	config := ControllersConfig{Controllers: []Controller{fermenter, mash}}
+	health.trackHosts(config, start.Add(30*time.Second))
+
+	for _, step := range []struct {
+		at       time.Duration
+		expected string
+	}{
+		{at: 61 * time.Second, expected: "We started the control loop over 1m0s ago and we still haven't heard from host fridge"},
+		{at: 85 * time.Second},
+		{at: 91 * time.Second, expected: "Host heater was added to the config over 1m0s ago and we still haven't heard from it"},
+	} {
+		cl.checkSwitchHostHealth(health, config, start.Add(step.at))
+		if notified := newNotifications(); (step.expected == "") != (notified == "") || !strings.Contains(notified, step.expected) {
+			t.Errorf("%s: expected %#v, got %#v", step.at, step.expected, notified)
+		}
+	}
+}
+
+func TestLoopHealth_ConfigFetch(t *testing.T) {
+	notifications := &syncBuffer{}
+	cl := NewControlLooper(&ConfigGopher{ClientId: "brewery", NotifyOutput: notifications}, &recordingSwitch{}, log.New(io.Discard, "", 0))
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	health := newLoopHealth(ControllersConfig{}, start)
+	newNotifications := notificationsSince(notifications)
+
+	for _, step := range []struct {
+		at       time.Duration
+		fetched  bool
+		expected string
+	}{
+		{at: 10 * time.Minute},
+		{at: 16 * time.Minute, expected: "brewery: we haven't received config in 15m0s"},
+		{at: 17 * time.Minute},
+		{at: 20 * time.Minute, fetched: true, expected: "brewery: we have recovered from config retrieval issues after 20m0s"},
+		{at: 30 * time.Minute},
+		{at: 31 * time.Minute, fetched: true},
+	} {
+		now := start.Add(step.at)
+		if step.fetched {
+			cl.configFetched(health, now)
+		} else {
+			cl.configFetchFailed(health, ControllersConfig{}, now)
+		}
+		if notified := newNotifications(); (step.expected == "") != (notified == "") || !strings.Contains(notified, step.expected) {
+			t.Errorf("%s: expected %#v, got %#v", step.at, step.expected, notified)
+		}
+	}
+}
+
+// flakyThermometer reads 70°F unless it's failing
+type flakyThermometer struct {
+	mu      sync.Mutex
+	failing bool
+}
+
+func (f *flakyThermometer) ReadTemperatureInF(path string) (float32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return 0, errors.New("the thermometer fell off the bus")
+	}
+	return 70, nil
+}
+
+func (f *flakyThermometer) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func TestControlLooper_SimulatedClock(t *testing.T) {
+	configPath := writeTestConfig(t, `{"controllers": [
+		{"name": "fermenter", "thermometerPath": "/fermenter", "controlType": "cool", "switchHosts": ["fridge"], "temperatureSchedule": {"2024-01-01T00:00:00Z": 40}}
+	]}`)
+	notifications := &syncBuffer{}
+	cg := &ConfigGopher{LocalConfigPath: configPath, ConfigFetchInterval: time.Hour, NotifyOutput: notifications}
+	switches := &recordingSwitch{}
+	cl := NewControlLooper(cg, switches, log.New(io.Discard, "", 0))
+	thermometer := &flakyThermometer{}
+	cl.TemperatureReader = thermometer
+	cl.dbFileName = filepath.Join(t.TempDir(), "tmplog.dbo")
+	clock := NewSimulatedClock(time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC))
+	cl.Clock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cl.StartControlLoop(ctx)
+	}()
+	//the control loop's ticker and the controller's
+	clock.BlockUntilWaiters(2)
+
+	//virtual seconds go by as fast as the loop can take them
+	advanceUntil := func(condition func() bool, description string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %s by %s; notifications %#v", description, clock.Now(), notifications.String())
+			}
+			clock.Advance(time.Second)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	advanceUntil(func() bool { return switches.state("fridge") == ControlOn }, "the fridge to be turned on")
+
+	thermometer.setFailing(true)
+	failedAt := clock.Now()
+	advanceUntil(func() bool {
+		return strings.Contains(notifications.String(), "We haven't had contact with the thermometer")
+	}, "a thermometer alert")
+	if waited := clock.Now().Sub(failedAt); waited < cl.TempReadAlertAfter-cl.ControlInterval {
+		t.Errorf("expected the alert to wait for TempReadAlertAfter, it came after %s", waited)
+	}
+	advanceUntil(func() bool { return switches.state("fridge") == ControlOff }, "the fridge to be turned off while we can't read the thermometer")
+
+	thermometer.setFailing(false)
+	advanceUntil(func() bool {
+		return strings.Contains(notifications.String(), "We recovered contact with the thermometer")
+	}, "a recovery")
+	//and after it recovered, no more alerts
+	for i := 0; i < 300; i++ {
+		clock.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if alerts := strings.Count(notifications.String(), "We haven't had contact with the thermometer"); alerts != 1 {
+		t.Errorf("expected one alert, got %d", alerts)
+	}
+}
@@ -0,0 +1,398 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TelemetryPublisher optionally set on the ControlLooper to receive each controller's reading and decision as soon as
+// it's made, e.g. an MqttBridge
+type TelemetryPublisher interface {
+	PublishTelemetry(log TmpLog)
+}
+
+// SetpointOverrider optionally set on the ControlLooper to replace a controller's scheduled temperature, e.g. from an
+// MqttBridge
+type SetpointOverrider interface {
+	//SetpointOverride returns false if the controller should follow its schedule
+	SetpointOverride(controllerName string) (float32, bool)
+}
+
+// mqttHostPrefix switch hosts like "mqtt:zigbee2mqtt/fridge-plug/set/state" and thermometer paths like
+// "mqtt:sensors/fridge/temperature" are handled by the MqttBridge
+const mqttHostPrefix = "mqtt:"
+
+const defaultMqttDiscoveryPrefix = "homeassistant"
+
+// defaultMqttMaxReadingAge readings older than this are too old to control with
+const defaultMqttMaxReadingAge = 5 * time.Minute
+
+// mqttFirstReadingWait how long the first read of a topic waits for its retained message
+const mqttFirstReadingWait = 2 * time.Second
+
+// MqttOptions how to reach the broker and which topics to use
+type MqttOptions struct {
+	//Broker like tcp://192.168.1.10:1883 or ssl://broker.local:8883
+	Broker   string
+	Username string
+	Password string
+	//ClientId defaults to "tmpcontrol-" and the host name
+	ClientId string
+	//TopicPrefix of our topics, e.g. "tmpcontrol/fermentation-pi"
+	TopicPrefix string
+	//DiscoveryPrefix of Home Assistant's MQTT discovery; "" doesn't publish discovery payloads
+	DiscoveryPrefix string
+	//MaxReadingAge how old a reading from a thermometer topic may be. Defaults to 5 minutes
+	MaxReadingAge time.Duration
+}
+
+// DefaultMqttOptions the options for a client identified as clientId
+func DefaultMqttOptions(broker string, clientId string) MqttOptions {
+	if clientId == "" {
+		clientId, _ = os.Hostname()
+	}
+	return MqttOptions{
+		Broker:          broker,
+		ClientId:        "tmpcontrol-" + clientId,
+		TopicPrefix:     "tmpcontrol/" + clientId,
+		DiscoveryPrefix: defaultMqttDiscoveryPrefix,
+		MaxReadingAge:   defaultMqttMaxReadingAge,
+	}
+}
+
+// MqttBridge connects tmpcontrol to an MQTT broker, for Home Assistant and other home automation. It publishes each
+// controller's temperature, setpoint and output state, takes setpoint overrides from <prefix>/<controller>/setpoint/set,
+// switches "mqtt:" hosts by publishing ON or OFF to their topic and reads "mqtt:" thermometer paths
+type MqttBridge struct {
+	options MqttOptions
+	client  paho.Client
+	logger  Logger
+
+	mu sync.Mutex
+	//overrides by controller name
+	overrides map[string]float32
+	//readings by topic, of the thermometer topics we've subscribed to
+	readings map[string]*mqttReading
+	//discoveryPublished controllers we've published the Home Assistant discovery payloads of
+	discoveryPublished map[string]bool
+	//subscribed is closed once we've first subscribed to the setpoint commands
+	subscribed     chan struct{}
+	subscribedOnce sync.Once
+}
+
+type mqttReading struct {
+	temperature float32
+	err         error
+	received    time.Time
+	//arrived is closed when the first message arrives
+	arrived chan struct{}
+}
+
+func NewMqttBridge(options MqttOptions, logger Logger) *MqttBridge {
+	if options.MaxReadingAge <= 0 {
+		options.MaxReadingAge = defaultMqttMaxReadingAge
+	}
+	m := &MqttBridge{
+		options:            options,
+		logger:             logger,
+		overrides:          make(map[string]float32),
+		readings:           make(map[string]*mqttReading),
+		discoveryPublished: make(map[string]bool),
+		subscribed:         make(chan struct{}),
+	}
+	clientOptions := paho.NewClientOptions().
+		AddBroker(options.Broker).
+		SetClientID(options.ClientId).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(m.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			m.logger.Printf("%s We lost our connection to the MQTT broker, we'll keep trying to reconnect: %s\n", stdTimestamp(), err)
+		})
+	m.client = paho.NewClient(clientOptions)
+	return m
+}
+
+// Connect returns once we're connected to the broker and subscribed to the setpoint commands. If ctx is done first we
+// keep trying in the background
+func (m *MqttBridge) Connect(ctx context.Context) error {
+	token := m.client.Connect()
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("connecting to %s: %w", m.options.Broker, ctx.Err())
+	}
+	select {
+	case <-m.subscribed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("subscribing to %s: %w", m.controllerTopic("+", "setpoint/set"), ctx.Err())
+	}
+}
+
+// Close tells the broker we're offline and disconnects
+func (m *MqttBridge) Close() {
+	if m.client.IsConnected() {
+		m.client.Publish(m.availabilityTopic(), 1, true, "offline").WaitTimeout(time.Second)
+	}
+	m.client.Disconnect(250)
+}
+
+// onConnect (re)subscribes, since the broker forgets our subscriptions with a clean session
+func (m *MqttBridge) onConnect(client paho.Client) {
+	m.logger.Printf("%s We're connected to the MQTT broker %s\n", stdTimestamp(), m.options.Broker)
+	client.Publish(m.availabilityTopic(), 1, true, "online")
+	token := client.Subscribe(m.controllerTopic("+", "setpoint/set"), 1, m.handleSetpointCommand)
+	if token.WaitTimeout(controlDeviceTimeout) && token.Error() == nil {
+		m.subscribedOnce.Do(func() { close(m.subscribed) })
+	} else {
+		m.logger.Printf("%s We couldn't subscribe to the setpoint commands: %v\n", stdTimestamp(), token.Error())
+	}
+	m.mu.Lock()
+	topics := make([]string, 0, len(m.readings))
+	for topic := range m.readings {
+		topics = append(topics, topic)
+	}
+	m.mu.Unlock()
+	for _, topic := range topics {
+		client.Subscribe(topic, 1, m.handleReading)
+	}
+	//Home Assistant forgets entities when it restarts, and so might the broker
+	m.mu.Lock()
+	m.discoveryPublished = make(map[string]bool)
+	m.mu.Unlock()
+}
+
+func (m *MqttBridge) availabilityTopic() string {
+	return m.options.TopicPrefix + "/status"
+}
+
+func (m *MqttBridge) controllerTopic(controllerName string, suffix string) string {
+	return m.options.TopicPrefix + "/" + controllerName + "/" + suffix
+}
+
+// handleSetpointCommand a number overrides the controller's schedule until an empty payload or "schedule" clears it
+func (m *MqttBridge) handleSetpointCommand(_ paho.Client, message paho.Message) {
+	controllerName := strings.TrimSuffix(strings.TrimPrefix(message.Topic(), m.options.TopicPrefix+"/"), "/setpoint/set")
+	payload := strings.TrimSpace(string(message.Payload()))
+	if payload == "" || strings.EqualFold(payload, "schedule") {
+		m.mu.Lock()
+		delete(m.overrides, controllerName)
+		m.mu.Unlock()
+		m.logger.Printf("%s [%s] The setpoint override was cleared over MQTT, we're following the schedule again\n", stdTimestamp(), controllerName)
+		return
+	}
+	setpoint, err := strconv.ParseFloat(payload, 32)
+	if err != nil || setpoint < minValidFahrenheitTemperature || setpoint > maxValidFahrenheitTemperature {
+		m.logger.Printf("%s [%s] We ignored the setpoint %#v we got over MQTT, it should be a temperature in Fahrenheit\n", stdTimestamp(), controllerName, payload)
+		return
+	}
+	m.mu.Lock()
+	m.overrides[controllerName] = float32(setpoint)
+	m.mu.Unlock()
+	m.logger.Printf("%s [%s] The setpoint was overridden to %.2f over MQTT\n", stdTimestamp(), controllerName, setpoint)
+}
+
+func (m *MqttBridge) SetpointOverride(controllerName string) (float32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	setpoint, ok := m.overrides[controllerName]
+	return setpoint, ok
+}
+
+// PublishTelemetry publishes the temperature, setpoint and output state of the controller, retained so a new
+// subscriber sees them right away. It doesn't wait for the broker
+func (m *MqttBridge) PublishTelemetry(log TmpLog) {
+	if !m.client.IsConnectionOpen() {
+		return
+	}
+	m.publishDiscovery(log.ControllerName)
+	state := "OFF"
+	if log.TurningOnNotOff {
+		state = "ON"
+	}
+	m.client.Publish(m.controllerTopic(log.ControllerName, "temperature"), 0, true, fmt.Sprintf("%.2f", log.TemperatureInF))
+	m.client.Publish(m.controllerTopic(log.ControllerName, "setpoint"), 0, true, fmt.Sprintf("%.2f", log.DesiredTemperatureInF))
+	m.client.Publish(m.controllerTopic(log.ControllerName, "state"), 0, true, state)
+}
+
+// publishDiscovery publishes the Home Assistant discovery payloads of the controller the first time we publish its
+// telemetry: a temperature sensor, a setpoint number and a binary sensor for its output
+func (m *MqttBridge) publishDiscovery(controllerName string) {
+	if m.options.DiscoveryPrefix == "" {
+		return
+	}
+	m.mu.Lock()
+	published := m.discoveryPublished[controllerName]
+	m.discoveryPublished[controllerName] = true
+	m.mu.Unlock()
+	if published {
+		return
+	}
+	node := mqttDiscoveryId(strings.TrimPrefix(m.options.TopicPrefix, "tmpcontrol/"))
+	device := map[string]interface{}{
+		"identifiers":  []string{"tmpcontrol_" + node},
+		"name":         "tmpcontrol " + node,
+		"manufacturer": "tmpcontrol",
+	}
+	objectId := mqttDiscoveryId(controllerName)
+	entities := map[string]map[string]interface{}{
+		"sensor/" + objectId + "_temperature": {
+			"name":                controllerName + " temperature",
+			"state_topic":         m.controllerTopic(controllerName, "temperature"),
+			"device_class":        "temperature",
+			"state_class":         "measurement",
+			"unit_of_measurement": "°F",
+		},
+		"number/" + objectId + "_setpoint": {
+			"name":                controllerName + " setpoint",
+			"state_topic":         m.controllerTopic(controllerName, "setpoint"),
+			"command_topic":       m.controllerTopic(controllerName, "setpoint/set"),
+			"device_class":        "temperature",
+			"unit_of_measurement": "°F",
+			"min":                 minValidFahrenheitTemperature,
+			"max":                 maxValidFahrenheitTemperature,
+			"step":                0.5,
+			"mode":                "box",
+		},
+		"binary_sensor/" + objectId + "_output": {
+			"name":         controllerName + " output",
+			"state_topic":  m.controllerTopic(controllerName, "state"),
+			"device_class": "power",
+		},
+	}
+	for component, config := range entities {
+		kind, entityId, _ := strings.Cut(component, "/")
+		config["unique_id"] = "tmpcontrol_" + node + "_" + entityId
+		config["availability_topic"] = m.availabilityTopic()
+		config["device"] = device
+		payload, err := json.Marshal(config)
+		if err != nil {
+			panic(err) //it's all strings and numbers
+		}
+		m.client.Publish(fmt.Sprintf("%s/%s/tmpcontrol_%s/%s/config", m.options.DiscoveryPrefix, kind, node, entityId), 1, true, payload)
+	}
+}
+
+var mqttDiscoveryIdRegex = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mqttDiscoveryId Home Assistant only allows letters, digits, _ and - in node and object ids
+func mqttDiscoveryId(s string) string {
+	return mqttDiscoveryIdRegex.ReplaceAllString(s, "_")
+}
+
+func (m *MqttBridge) ControlDevice(host string, action Control) error {
+	return m.ControlDeviceContext(context.Background(), host, action)
+}
+
+// ControlDeviceContext publishes ON or OFF to the host's topic, which is what Tasmota's cmnd/<device>/POWER and
+// zigbee2mqtt's <device>/set/state expect
+func (m *MqttBridge) ControlDeviceContext(ctx context.Context, host string, action Control) error {
+	topic, err := parseMqttTopic(host)
+	if err != nil {
+		return err
+	}
+	payload := "OFF"
+	if action == ControlOn {
+		payload = "ON"
+	}
+	ctx, cancel := context.WithTimeout(ctx, controlDeviceTimeout)
+	defer cancel()
+	token := m.client.Publish(topic, 1, false, payload)
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("publishing %s to %s: %w", payload, topic, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("publishing %s to %s: %w", payload, topic, ctx.Err())
+	}
+}
+
+func (m *MqttBridge) ReadTemperatureInF(connectionString string) (float32, error) {
+	return m.ReadTemperatureInFContext(context.Background(), connectionString)
+}
+
+// ReadTemperatureInFContext returns the latest reading published to the topic. The first read of a topic subscribes to
+// it and waits briefly for its retained message
+func (m *MqttBridge) ReadTemperatureInFContext(ctx context.Context, connectionString string) (float32, error) {
+	topic, err := parseMqttTopic(connectionString)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	reading, subscribed := m.readings[topic]
+	if !subscribed {
+		reading = &mqttReading{arrived: make(chan struct{})}
+		m.readings[topic] = reading
+	}
+	m.mu.Unlock()
+	if !subscribed {
+		m.client.Subscribe(topic, 1, m.handleReading)
+	}
+	wait, cancel := context.WithTimeout(ctx, mqttFirstReadingWait)
+	defer cancel()
+	select {
+	case <-reading.arrived:
+	case <-wait.Done():
+		return 0, fmt.Errorf("nothing has been published to %s yet", topic)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if reading.err != nil {
+		return 0, fmt.Errorf("%s: %w", topic, reading.err)
+	}
+	if age := time.Since(reading.received); age > m.options.MaxReadingAge {
+		return 0, fmt.Errorf("the last reading published to %s is %s old", topic, age.Round(time.Second))
+	}
+	return reading.temperature, nil
+}
+
+func (m *MqttBridge) handleReading(_ paho.Client, message paho.Message) {
+	temperature, err := parseTemperaturePayload(message.Payload(), temperatureField{})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reading, ok := m.readings[message.Topic()]
+	if !ok {
+		return
+	}
+	reading.temperature, reading.err, reading.received = temperature, err, time.Now()
+	select {
+	case <-reading.arrived:
+	default:
+		close(reading.arrived)
+	}
+}
+
+// parseMqttTopic the topic of "mqtt:zigbee2mqtt/fridge-plug/set/state" or "mqtt://zigbee2mqtt/fridge-plug/set/state"
+func parseMqttTopic(host string) (string, error) {
+	if !strings.HasPrefix(host, mqttHostPrefix) {
+		return "", fmt.Errorf("%#v should look like mqtt:zigbee2mqtt/fridge-plug/set/state", host)
+	}
+	topic := strings.TrimPrefix(strings.TrimPrefix(host, mqttHostPrefix), "//")
+	if topic == "" {
+		return "", fmt.Errorf("%#v should look like mqtt:zigbee2mqtt/fridge-plug/set/state", host)
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return "", fmt.Errorf("%#v: the topic can't have wildcards", host)
+	}
+	return topic, nil
+}
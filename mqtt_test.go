@@ -0,0 +1,185 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// startMqttBroker an embedded broker that records the last payload published to each topic
+func startMqttBroker(t *testing.T) (*mochi.Server, string, *mqttMessages) {
+	server := mochi.New(&mochi.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	listener := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	messages := &mqttMessages{payloads: make(map[string]string)}
+	err := server.Subscribe("#", 1, func(_ *mochi.Client, _ packets.Subscription, pk packets.Packet) {
+		messages.mu.Lock()
+		defer messages.mu.Unlock()
+		messages.payloads[pk.TopicName] = string(pk.Payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, "tcp://" + listener.Address(), messages
+}
+
+type mqttMessages struct {
+	mu       sync.Mutex
+	payloads map[string]string
+}
+
+// waitFor the topic's payload, or "" if nothing is published to it in time
+func (m *mqttMessages) waitFor(topic string) string {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		m.mu.Lock()
+		payload, ok := m.payloads[topic]
+		m.mu.Unlock()
+		if ok {
+			return payload
+		}
+	}
+	return ""
+}
+
+func connectMqttBridge(t *testing.T, broker string) *MqttBridge {
+	bridge := NewMqttBridge(DefaultMqttOptions(broker, "test-pi"), log.New(io.Discard, "", 0))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bridge.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bridge.Close)
+	return bridge
+}
+
+func TestMqttBridge_Telemetry(t *testing.T) {
+	_, broker, messages := startMqttBroker(t)
+	bridge := connectMqttBridge(t, broker)
+
+	bridge.PublishTelemetry(TmpLog{ControllerName: "fridge", TemperatureInF: 66.5, DesiredTemperatureInF: 64, TurningOnNotOff: true})
+	for topic, expected := range map[string]string{
+		"tmpcontrol/test-pi/status":             "online",
+		"tmpcontrol/test-pi/fridge/temperature": "66.50",
+		"tmpcontrol/test-pi/fridge/setpoint":    "64.00",
+		"tmpcontrol/test-pi/fridge/state":       "ON",
+	} {
+		if payload := messages.waitFor(topic); payload != expected {
+			t.Errorf("%s: expected %#v, got %#v", topic, expected, payload)
+		}
+	}
+
+	var number map[string]interface{}
+	if err := json.Unmarshal([]byte(messages.waitFor("homeassistant/number/tmpcontrol_test-pi/fridge_setpoint/config")), &number); err != nil {
+		t.Fatal(err)
+	}
+	if number["command_topic"] != "tmpcontrol/test-pi/fridge/setpoint/set" || number["unique_id"] != "tmpcontrol_test-pi_fridge_setpoint" {
+		t.Errorf("unexpected discovery payload: %v", number)
+	}
+	for _, topic := range []string{"homeassistant/sensor/tmpcontrol_test-pi/fridge_temperature/config", "homeassistant/binary_sensor/tmpcontrol_test-pi/fridge_output/config"} {
+		if messages.waitFor(topic) == "" {
+			t.Errorf("expected a discovery payload on %s", topic)
+		}
+	}
+}
+
+func TestMqttBridge_SetpointOverride(t *testing.T) {
+	server, broker, _ := startMqttBroker(t)
+	bridge := connectMqttBridge(t, broker)
+	waitForOverride := func(expected float32, expectedOk bool) {
+		t.Helper()
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if setpoint, ok := bridge.SetpointOverride("fridge"); setpoint == expected && ok == expectedOk {
+				return
+			}
+		}
+		t.Errorf("expected the override to be %.2f, %t", expected, expectedOk)
+	}
+
+	_ = server.Publish("tmpcontrol/test-pi/fridge/setpoint/set", []byte("62.5"), false, 1)
+	waitForOverride(62.5, true)
+	_ = server.Publish("tmpcontrol/test-pi/fridge/setpoint/set", []byte("hot"), false, 1)
+	_ = server.Publish("tmpcontrol/test-pi/fridge/setpoint/set", []byte("schedule"), false, 1)
+	waitForOverride(0, false)
+
+	//the control loop follows the override instead of the schedule
+	switches := &recordingSwitch{}
+	cl := NewControlLooper(&ConfigGopher{}, switches, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = fixedThermometer{"/fridge": 63}
+	cl.SetpointOverrides = bridge
+	controller := Controller{
+		Name:                "fridge",
+		ThermometerPath:     "/fridge",
+		ControlType:         "cool",
+		SwitchHosts:         []string{"plug"},
+		TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 65},
+	}
+	_ = server.Publish("tmpcontrol/test-pi/fridge/setpoint/set", []byte("60"), false, 1)
+	waitForOverride(60, true)
+	ret := cl.temperatureControl(context.Background(), &controller)
+	if ret.tmplog.DesiredTemperatureInF != 60 || switches.state("plug") != ControlOn {
+		t.Errorf("expected to cool to the overridden setpoint: %+v", ret.tmplog)
+	}
+}
+
+func TestMqttBridge_SwitchAndThermometer(t *testing.T) {
+	server, broker, messages := startMqttBroker(t)
+	bridge := connectMqttBridge(t, broker)
+
+	if err := bridge.ControlDevice("mqtt:cmnd/fridge-plug/POWER", ControlOn); err != nil {
+		t.Fatal(err)
+	}
+	if payload := messages.waitFor("cmnd/fridge-plug/POWER"); payload != "ON" {
+		t.Errorf("expected ON to be published, got %#v", payload)
+	}
+	if err := bridge.ControlDevice("mqtt://zigbee2mqtt/heater-plug/set/state", ControlOff); err != nil {
+		t.Fatal(err)
+	}
+	if payload := messages.waitFor("zigbee2mqtt/heater-plug/set/state"); payload != "OFF" {
+		t.Errorf("expected OFF to be published to the topic after mqtt://, got %#v", payload)
+	}
+
+	_ = server.Publish("zigbee2mqtt/fridge-sensor", []byte(`{"temperature":20,"humidity":55}`), true, 1)
+	temperature, err := bridge.ReadTemperatureInF("mqtt:zigbee2mqtt/fridge-sensor")
+	if err != nil || temperature != 68 {
+		t.Errorf("expected the retained 20°C, got %.2f, %v", temperature, err)
+	}
+	if _, err := bridge.ReadTemperatureInF("mqtt:nothing/here"); err == nil {
+		t.Error("expected an error for a topic nothing was published to")
+	}
+}
+
+func TestParseMqttTopic(t *testing.T) {
+	for host, expected := range map[string]string{
+		"mqtt:cmnd/fridge-plug/POWER":        "cmnd/fridge-plug/POWER",
+		"mqtt://zigbee2mqtt/fridge-plug/set": "zigbee2mqtt/fridge-plug/set",
+		"mqtt:zigbee2mqtt/fridge-sensor":     "zigbee2mqtt/fridge-sensor",
+	} {
+		if topic, err := parseMqttTopic(host); err != nil || topic != expected {
+			t.Errorf("%s: expected %#v, got %#v, %v", host, expected, topic, err)
+		}
+	}
+	for _, host := range []string{"mqtt:", "mqtt://", "mqtt:zigbee2mqtt/+/set", "zigbee2mqtt/fridge-plug/set"} {
+		if _, err := parseMqttTopic(host); err == nil {
+			t.Errorf("%s: expected an error", host)
+		}
+	}
+}
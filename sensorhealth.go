@@ -0,0 +1,132 @@
+package tmpcontrol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SensorResolutionReader optionally implemented by a TemperatureReader that knows how finely a thermometer measures,
+// e.g. DS18B20Reader
+type SensorResolutionReader interface {
+	ReadResolution(connectionString string) (bits int, ok bool)
+}
+
+// SensorHealth how a thermometer has done since we started
+type SensorHealth struct {
+	Path     string
+	Reads    int
+	Failures int
+	//CrcErrors the failures where the reading was corrupted on the bus, see ErrW1CrcMismatch
+	CrcErrors           int
+	ConsecutiveFailures int
+	LastSuccess         time.Time
+	LastError           string
+	//ResolutionBits 0 unless the reader knows, see SensorResolutionReader
+	ResolutionBits int
+}
+
+func (h SensorHealth) String() string {
+	description := fmt.Sprintf("%s: %d of %d reads failed", h.Path, h.Failures, h.Reads)
+	if h.CrcErrors > 0 {
+		description += fmt.Sprintf(" (%d CRC errors)", h.CrcErrors)
+	}
+	if h.ConsecutiveFailures > 0 {
+		description += fmt.Sprintf(", the last %d in a row: %s", h.ConsecutiveFailures, h.LastError)
+	}
+	return description
+}
+
+// sensorHealthTracker the health of every thermometer by path. Controllers run on their own goroutines
+type sensorHealthTracker struct {
+	mu      sync.Mutex
+	sensors map[string]*SensorHealth
+}
+
+func (t *sensorHealthTracker) record(path string, err error, resolutionBits int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sensors == nil {
+		t.sensors = make(map[string]*SensorHealth)
+	}
+	health, ok := t.sensors[path]
+	if !ok {
+		health = &SensorHealth{Path: path}
+		t.sensors[path] = health
+	}
+	health.Reads++
+	if resolutionBits > 0 {
+		health.ResolutionBits = resolutionBits
+	}
+	if err == nil {
+		health.ConsecutiveFailures = 0
+		health.LastSuccess = now
+		return
+	}
+	health.Failures++
+	health.ConsecutiveFailures++
+	health.LastError = err.Error()
+	if errors.Is(err, ErrW1CrcMismatch) {
+		health.CrcErrors++
+	}
+}
+
+func (t *sensorHealthTracker) get(path string) (SensorHealth, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if health, ok := t.sensors[path]; ok {
+		return *health, true
+	}
+	return SensorHealth{}, false
+}
+
+// SensorHealth the health of every thermometer we've read, by path
+func (cl *ControlLooper) SensorHealth() []SensorHealth {
+	cl.sensorHealth.mu.Lock()
+	defer cl.sensorHealth.mu.Unlock()
+	healths := make([]SensorHealth, 0, len(cl.sensorHealth.sensors))
+	for _, health := range cl.sensorHealth.sensors {
+		healths = append(healths, *health)
+	}
+	sort.Slice(healths, func(i, j int) bool {
+		return healths[i].Path < healths[j].Path
+	})
+	return healths
+}
+
+// recordSensorHealth is called with the readings as the sensors gave them
+func (cl *ControlLooper) recordSensorHealth(readings []sensorReading, now time.Time) {
+	resolutionReader, canReadResolution := cl.TemperatureReader.(SensorResolutionReader)
+	for _, reading := range readings {
+		var bits int
+		if canReadResolution && reading.err == nil {
+			bits, _ = resolutionReader.ReadResolution(reading.Path)
+		}
+		cl.sensorHealth.record(reading.Path, reading.err, bits, now)
+	}
+}
+
+// thermometerFailing whether none of the controller's beer or chamber sensors has been read within alertAfter. The
+// description summarizes their health for a notification
+func (cl *ControlLooper) thermometerFailing(controller Controller, alertAfter time.Duration, now time.Time) (bool, string) {
+	failing := true
+	var descriptions []string
+	for _, sensor := range controller.sensors() {
+		if sensor.Role == SensorRoleAmbient {
+			continue
+		}
+		health, ok := cl.sensorHealth.get(sensor.Path)
+		if !ok {
+			descriptions = append(descriptions, sensor.Path+": never read")
+			continue
+		}
+		if !health.LastSuccess.IsZero() && !health.LastSuccess.Add(alertAfter).Before(now) {
+			failing = false
+		}
+		descriptions = append(descriptions, health.String())
+	}
+	return failing, strings.Join(descriptions, "; ")
+}
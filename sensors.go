@@ -0,0 +1,320 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Sensor roles. Ambient sensors are logged but never controlled on
+const (
+	SensorRoleBeer    = "beer"
+	SensorRoleChamber = "chamber"
+	SensorRoleAmbient = "ambient"
+)
+
+var sensorRoles = []string{SensorRoleBeer, SensorRoleChamber, SensorRoleAmbient}
+
+// Sensor policies, see SensorPolicy
+const (
+	SensorPolicyPrimary = "primary"
+	SensorPolicyAverage = "average"
+	SensorPolicyMin     = "min"
+	SensorPolicyMax     = "max"
+	SensorPolicyCascade = "cascade"
+)
+
+var sensorPolicyModes = []string{SensorPolicyPrimary, SensorPolicyAverage, SensorPolicyMin, SensorPolicyMax, SensorPolicyCascade}
+
+// defaultChamberLimit how many °F past the beer a cascade lets the chamber go
+const defaultChamberLimit = 10
+
+// ControllerSensor one of a controller's thermometers. Path is anything thermometerPath accepts; Role defaults to beer
+type ControllerSensor struct {
+	Path        string             `json:"path"`
+	Role        string             `json:"role,omitempty"`
+	Calibration *SensorCalibration `json:"calibration,omitempty"`
+	Filter      *SensorFilter      `json:"filter,omitempty"`
+}
+
+// SensorPolicy how a controller with several sensors arrives at the temperature it controls on. The modes are:
+//   - primary: the first beer or chamber sensor, in the order listed, that we can read. The rest are fallbacks
+//   - average, min, max: of every beer and chamber sensor we can read
+//   - cascade: control on the beer, but don't let the chamber get more than ChamberLimit colder (or warmer, when
+//     heating) than the beer while we drive the beer to the desired temperature. Without a beer reading we control on
+//     the chamber
+type SensorPolicy struct {
+	Mode string `json:"mode,omitempty"`
+	//MaxDisagreement how many °F sensors of the same role may differ by before we notify the server. 0 doesn't check
+	MaxDisagreement float32 `json:"maxDisagreement,omitempty"`
+	//ChamberLimit see cascade, defaults to 10°F
+	ChamberLimit float32 `json:"chamberLimit,omitempty"`
+}
+
+// sensors the controller's Sensors, or its ThermometerPath as a lone beer sensor with the controller's Calibration and
+// Filter
+func (controller *Controller) sensors() []ControllerSensor {
+	if len(controller.Sensors) == 0 {
+		return []ControllerSensor{{
+			Path:        controller.ThermometerPath,
+			Role:        SensorRoleBeer,
+			Calibration: controller.Calibration,
+			Filter:      controller.Filter,
+		}}
+	}
+	sensors := make([]ControllerSensor, len(controller.Sensors))
+	for i, sensor := range controller.Sensors {
+		if sensor.Role == "" {
+			sensor.Role = SensorRoleBeer
+		}
+		sensors[i] = sensor
+	}
+	return sensors
+}
+
+func (controller *Controller) sensorPolicy() SensorPolicy {
+	policy := SensorPolicy{Mode: SensorPolicyPrimary, ChamberLimit: defaultChamberLimit}
+	if controller.SensorPolicy != nil {
+		if controller.SensorPolicy.Mode != "" {
+			policy.Mode = controller.SensorPolicy.Mode
+		}
+		policy.MaxDisagreement = controller.SensorPolicy.MaxDisagreement
+		if controller.SensorPolicy.ChamberLimit > 0 {
+			policy.ChamberLimit = controller.SensorPolicy.ChamberLimit
+		}
+	}
+	return policy
+}
+
+// validateControllerSensors the controller's sensors and sensorPolicy; the thermometerPath is validated on its own
+func validateControllerSensors(path string, controller Controller) ConfigErrors {
+	var errs ConfigErrors
+	add := func(path string, format string, v ...interface{}) {
+		errs = append(errs, ConfigError{Path: path, Message: fmt.Sprintf(format, v...)})
+	}
+	roles := make(map[string]int)
+	for i, sensor := range controller.sensors() {
+		roles[sensor.Role]++
+		if len(controller.Sensors) == 0 {
+			//it's the thermometerPath, which our caller validates; its corrections are the controller's
+			errs = append(errs, validateSensorCorrection(path, controller.Name, sensor)...)
+			continue
+		}
+		sensorPath := fmt.Sprintf("%s/sensors/%d", path, i)
+		if sensor.Path == "" {
+			add(sensorPath+"/path", "controller %s: every sensor needs a path", controller.Name)
+		} else if err := validateThermometerPath(sensor.Path); err != nil {
+			add(sensorPath+"/path", "controller %s: %s", controller.Name, err)
+		}
+		if !slices.Contains(sensorRoles, sensor.Role) {
+			add(sensorPath+"/role", "controller %s: role must be one of %s, not %#v", controller.Name, strings.Join(sensorRoles, ", "), sensor.Role)
+		}
+		errs = append(errs, validateSensorCorrection(sensorPath, controller.Name, sensor)...)
+	}
+	if len(controller.Sensors) != 0 && controller.Calibration != nil {
+		add(path+"/calibration", "controller %s: with sensors, put the calibration on the sensor it's for", controller.Name)
+	}
+	if len(controller.Sensors) != 0 && controller.Filter != nil {
+		add(path+"/filter", "controller %s: with sensors, put the filter on the sensor it's for", controller.Name)
+	}
+	if roles[SensorRoleBeer]+roles[SensorRoleChamber] == 0 {
+		add(path+"/sensors", "controller %s: at least one sensor must be a beer or chamber sensor", controller.Name)
+	}
+
+	policy := controller.sensorPolicy()
+	if !slices.Contains(sensorPolicyModes, policy.Mode) {
+		add(path+"/sensorPolicy/mode", "controller %s: mode must be one of %s, not %#v", controller.Name, strings.Join(sensorPolicyModes, ", "), policy.Mode)
+	} else if policy.Mode == SensorPolicyCascade && (roles[SensorRoleBeer] == 0 || roles[SensorRoleChamber] == 0) {
+		add(path+"/sensorPolicy/mode", "controller %s: a cascade needs a beer sensor and a chamber sensor", controller.Name)
+	}
+	if controller.SensorPolicy != nil {
+		if controller.SensorPolicy.MaxDisagreement < 0 {
+			add(path+"/sensorPolicy/maxDisagreement", "controller %s: maxDisagreement can't be negative", controller.Name)
+		}
+		if controller.SensorPolicy.ChamberLimit < 0 {
+			add(path+"/sensorPolicy/chamberLimit", "controller %s: chamberLimit can't be negative", controller.Name)
+		}
+	}
+	return errs
+}
+
+// sensorReading err is set if we couldn't read the sensor. raw is what the sensor said before correctReadings
+type sensorReading struct {
+	ControllerSensor
+	temperature float32
+	raw         float32
+	err         error
+}
+
+func (r sensorReading) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("%s %s error", r.Role, r.Path)
+	}
+	if r.raw != r.temperature {
+		return fmt.Sprintf("%s %s %.2f (raw %.2f)", r.Role, r.Path, r.temperature, r.raw)
+	}
+	return fmt.Sprintf("%s %s %.2f", r.Role, r.Path, r.temperature)
+}
+
+// readSensors reads every sensor at once, so one slow thermometer doesn't hold up the rest. A panicking reader panics
+// on the caller's goroutine, like readTemperature, so the controller's supervisor can recover it
+func readSensors(ctx context.Context, reader TemperatureReader, sensors []ControllerSensor) []sensorReading {
+	readings := make([]sensorReading, len(sensors))
+	panics := make([]interface{}, len(sensors))
+	var wg sync.WaitGroup
+	for i, sensor := range sensors {
+		wg.Add(1)
+		go func(i int, sensor ControllerSensor) {
+			defer wg.Done()
+			defer func() {
+				panics[i] = recover()
+			}()
+			temperature, err := readTemperature(ctx, reader, sensor.Path)
+			readings[i] = sensorReading{ControllerSensor: sensor, temperature: temperature, raw: temperature, err: err}
+		}(i, sensor)
+	}
+	wg.Wait()
+	for _, panicValue := range panics {
+		if panicValue != nil {
+			panic(panicValue)
+		}
+	}
+	return readings
+}
+
+// sensorTemperatures what a policy made of the readings. chamber is only set for a cascade that read its chamber
+type sensorTemperatures struct {
+	control float32
+	chamber *float32
+}
+
+// ErrNoSensorReadings none of the sensors a controller controls on could be read
+var ErrNoSensorReadings = errors.New("we couldn't read any of the controller's sensors")
+
+func (policy SensorPolicy) apply(readings []sensorReading) (sensorTemperatures, error) {
+	var controlled, beer, chamber []float32
+	var errs []error
+	for _, reading := range readings {
+		if reading.Role == SensorRoleAmbient {
+			continue
+		}
+		if reading.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", reading.Path, reading.err))
+			continue
+		}
+		controlled = append(controlled, reading.temperature)
+		if reading.Role == SensorRoleBeer {
+			beer = append(beer, reading.temperature)
+		} else {
+			chamber = append(chamber, reading.temperature)
+		}
+	}
+	if len(controlled) == 0 {
+		if len(readings) == 1 {
+			return sensorTemperatures{}, readings[0].err
+		}
+		return sensorTemperatures{}, errors.Join(append([]error{ErrNoSensorReadings}, errs...)...)
+	}
+
+	switch policy.Mode {
+	case SensorPolicyAverage:
+		var sum float32
+		for _, temperature := range controlled {
+			sum += temperature
+		}
+		return sensorTemperatures{control: sum / float32(len(controlled))}, nil
+	case SensorPolicyMin:
+		return sensorTemperatures{control: slices.Min(controlled)}, nil
+	case SensorPolicyMax:
+		return sensorTemperatures{control: slices.Max(controlled)}, nil
+	case SensorPolicyCascade:
+		if len(beer) == 0 {
+			return sensorTemperatures{control: chamber[0]}, nil
+		}
+		temperatures := sensorTemperatures{control: beer[0]}
+		if len(chamber) > 0 {
+			temperatures.chamber = &chamber[0]
+		}
+		return temperatures, nil
+	default:
+		return sensorTemperatures{control: controlled[0]}, nil
+	}
+}
+
+// limitByChamber turns the hosts off if the chamber is already ChamberLimit past the beer, which a cascade controls on.
+// Returns whether it did
+func (policy SensorPolicy) limitByChamber(temperatures sensorTemperatures, controlType string, newState Control) (Control, bool) {
+	if temperatures.chamber == nil || newState != ControlOn {
+		return newState, false
+	}
+	beer := temperatures.control
+	if controlType == "cool" && *temperatures.chamber < beer-policy.ChamberLimit {
+		return ControlOff, true
+	}
+	if controlType != "cool" && *temperatures.chamber > beer+policy.ChamberLimit {
+		return ControlOff, true
+	}
+	return newState, false
+}
+
+// sensorDisagreement describes the sensors of a role that differ by more than maxDisagreement, or returns ""
+func sensorDisagreement(readings []sensorReading, maxDisagreement float32) string {
+	if maxDisagreement <= 0 {
+		return ""
+	}
+	var disagreements []string
+	for _, role := range sensorRoles {
+		var lowest, highest *sensorReading
+		for i := range readings {
+			reading := &readings[i]
+			if reading.Role != role || reading.err != nil {
+				continue
+			}
+			if lowest == nil || reading.temperature < lowest.temperature {
+				lowest = reading
+			}
+			if highest == nil || reading.temperature > highest.temperature {
+				highest = reading
+			}
+		}
+		if lowest != nil && highest.temperature-lowest.temperature > maxDisagreement {
+			disagreements = append(disagreements, fmt.Sprintf("%s sensors %s reads %.2f but %s reads %.2f", role, lowest.Path, lowest.temperature, highest.Path, highest.temperature))
+		}
+	}
+	return strings.Join(disagreements, "; ")
+}
+
+// sensorDisagreementTracker which controllers' sensors currently disagree. Controllers run on their own goroutines
+type sensorDisagreementTracker struct {
+	mu          sync.Mutex
+	controllers map[string]bool
+}
+
+// update returns true if the controller just started or stopped disagreeing
+func (t *sensorDisagreementTracker) update(controllerName string, disagreeing bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.controllers == nil {
+		t.controllers = make(map[string]bool)
+	}
+	changed := t.controllers[controllerName] != disagreeing
+	t.controllers[controllerName] = disagreeing
+	return changed
+}
+
+// checkSensorAgreement notifies the server when a controller's sensors start disagreeing, and when they stop
+func (cl *ControlLooper) checkSensorAgreement(controllerName string, readings []sensorReading, maxDisagreement float32) {
+	disagreement := sensorDisagreement(readings, maxDisagreement)
+	if !cl.sensorDisagreements.update(controllerName, disagreement != "") {
+		return
+	}
+	if disagreement != "" {
+		cl.Logger.Printf("%s [%s]: The sensors disagree: %s\n", cl.timestamp(), controllerName, disagreement)
+		cl.notify(fmt.Sprintf("%s: the sensors of controller %s disagree by more than %.2f°F: %s", cl.Cg.ClientId, controllerName, maxDisagreement, disagreement), ProblemNotification)
+	} else {
+		cl.notify(fmt.Sprintf("%s: the sensors of controller %s agree again", cl.Cg.ClientId, controllerName), ProblemNotification)
+	}
+}
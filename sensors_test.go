@@ -0,0 +1,149 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// partialThermometer can't read the paths it doesn't know
+type partialThermometer map[string]float32
+
+func (p partialThermometer) ReadTemperatureInF(path string) (float32, error) {
+	if temperature, ok := p[path]; ok {
+		return temperature, nil
+	}
+	return 0, errors.New("no such thermometer")
+}
+
+func TestSensorPolicy_Apply(t *testing.T) {
+	readings := []sensorReading{
+		{ControllerSensor: ControllerSensor{Path: "/beer-1", Role: SensorRoleBeer}, err: errors.New("unplugged")},
+		{ControllerSensor: ControllerSensor{Path: "/beer-2", Role: SensorRoleBeer}, temperature: 66},
+		{ControllerSensor: ControllerSensor{Path: "/chamber", Role: SensorRoleChamber}, temperature: 60},
+		{ControllerSensor: ControllerSensor{Path: "/garage", Role: SensorRoleAmbient}, temperature: 90},
+	}
+	for mode, expected := range map[string]float32{
+		SensorPolicyPrimary: 66,
+		SensorPolicyAverage: 63,
+		SensorPolicyMin:     60,
+		SensorPolicyMax:     66,
+		SensorPolicyCascade: 66,
+	} {
+		temperatures, err := SensorPolicy{Mode: mode}.apply(readings)
+		if err != nil || temperatures.control != expected {
+			t.Errorf("%s: expected %.2f, got %.2f, %v", mode, expected, temperatures.control, err)
+		}
+	}
+
+	//without a beer reading, a cascade controls on the chamber
+	temperatures, err := SensorPolicy{Mode: SensorPolicyCascade}.apply(readings[2:])
+	if err != nil || temperatures.control != 60 || temperatures.chamber != nil {
+		t.Errorf("expected to fall back to the chamber: %+v, %v", temperatures, err)
+	}
+	if _, err := (SensorPolicy{Mode: SensorPolicyAverage}).apply(append(readings[:1:1], readings[3])); !errors.Is(err, ErrNoSensorReadings) {
+		t.Errorf("expected ErrNoSensorReadings when only the ambient sensor reads, got %v", err)
+	}
+}
+
+func TestSensorPolicy_LimitByChamber(t *testing.T) {
+	policy := SensorPolicy{Mode: SensorPolicyCascade, ChamberLimit: 10}
+	//the limit is relative to the beer, not the setpoint: cooling 70°F beer toward 50°F, the chamber may go down to 60°F
+	//even though that's still 10°F above the setpoint, and no further even though 55°F still is
+	chamber := func(temperature float32) sensorTemperatures {
+		return sensorTemperatures{control: 70, chamber: &temperature}
+	}
+	for _, test := range []struct {
+		temperatures sensorTemperatures
+		controlType  string
+		expected     Control
+	}{
+		{chamber(60), "cool", ControlOn},
+		{chamber(59), "cool", ControlOff},
+		{chamber(55), "cool", ControlOff},
+		{chamber(80), "heat", ControlOn},
+		{chamber(81), "heat", ControlOff},
+		{sensorTemperatures{control: 70}, "cool", ControlOn},
+	} {
+		if state, _ := policy.limitByChamber(test.temperatures, test.controlType, ControlOn); state != test.expected {
+			t.Errorf("%s with the chamber at %v: expected %s, got %s", test.controlType, test.temperatures.chamber, test.expected, state)
+		}
+	}
+}
+
+func TestControlLooper_MultipleSensors(t *testing.T) {
+	notifications := &syncBuffer{}
+	switches := &recordingSwitch{}
+	thermometers := partialThermometer{"/beer-1": 66, "/beer-2": 66.5, "/chamber": 50}
+	cl := NewControlLooper(&ConfigGopher{NotifyOutput: notifications}, switches, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = thermometers
+	controller := Controller{
+		Name:                "fermenter",
+		ControlType:         "cool",
+		SwitchHosts:         []string{"fridge"},
+		TemperatureSchedule: map[time.Time]float32{time.Now().Add(-time.Hour): 64},
+		Sensors: []ControllerSensor{
+			{Path: "/beer-1"},
+			{Path: "/beer-2"},
+			{Path: "/chamber", Role: SensorRoleChamber},
+			{Path: "/garage", Role: SensorRoleAmbient},
+		},
+		SensorPolicy: &SensorPolicy{Mode: SensorPolicyCascade, MaxDisagreement: 2},
+	}
+
+	//the beer is warm, but the chamber is already 14°F under the setpoint
+	ret := cl.temperatureControl(context.Background(), &controller)
+	if ret.err != nil || ret.tmplog.TemperatureInF != 66 || switches.state("fridge") != ControlOff {
+		t.Fatalf("expected the chamber to hold the fridge off: %+v, %v", ret.tmplog, ret.err)
+	}
+	expected := "beer /beer-1 66.00|beer /beer-2 66.50|chamber /chamber 50.00|ambient /garage error"
+	if ret.tmplog.SensorReadings != expected {
+		t.Errorf("expected %#v, got %#v", expected, ret.tmplog.SensorReadings)
+	}
+
+	//the primary beer sensor fails and the other drifts away from it
+	thermometers["/chamber"] = 60
+	delete(thermometers, "/beer-1")
+	ret = cl.temperatureControl(context.Background(), &controller)
+	if ret.err != nil || ret.tmplog.TemperatureInF != 66.5 || switches.state("fridge") != ControlOn {
+		t.Fatalf("expected to fail over to the second beer sensor: %+v, %v", ret.tmplog, ret.err)
+	}
+	thermometers["/beer-1"] = 70
+	cl.temperatureControl(context.Background(), &controller)
+	cl.temperatureControl(context.Background(), &controller)
+	thermometers["/beer-1"] = 67
+	cl.temperatureControl(context.Background(), &controller)
+	if strings.Count(notifications.String(), "disagree by more than 2.00°F") != 1 || !strings.Contains(notifications.String(), "agree again") {
+		t.Errorf("expected one notification when the sensors started disagreeing and one when they stopped: %s", notifications.String())
+	}
+
+	//with none of the beer or chamber sensors readable we turn everything off
+	cl.TemperatureReader = partialThermometer{"/garage": 80}
+	ret = cl.temperatureControl(context.Background(), &controller)
+	if !errors.Is(ret.err, TemperatureReadError) || !errors.Is(ret.err, ErrNoSensorReadings) || switches.state("fridge") != ControlOff {
+		t.Errorf("expected the fridge off and a read error: %v", ret.err)
+	}
+}
+
+func TestValidateConfig_Sensors(t *testing.T) {
+	config := ControllersConfig{Controllers: []Controller{
+		{Name: "single", ThermometerPath: "/sys/bus/w1/devices/28-1/temperature", ControlType: "heat"},
+		{Name: "multi", ControlType: "cool", Sensors: []ControllerSensor{{Path: "w1:28-1"}, {Path: "w1:28-2", Role: SensorRoleChamber}}, SensorPolicy: &SensorPolicy{Mode: SensorPolicyCascade}},
+		{Name: "both", ThermometerPath: "w1:28-1", ControlType: "cool", Sensors: []ControllerSensor{{Path: "w1:28-2"}}},
+		{Name: "ambient", ControlType: "cool", Sensors: []ControllerSensor{{Path: "w1:28-1", Role: SensorRoleAmbient}}},
+		{Name: "wrong", ControlType: "cool", Sensors: []ControllerSensor{{Path: "w1:28-1", Role: "wort"}}, SensorPolicy: &SensorPolicy{Mode: "median"}},
+		{Name: "cascade", ControlType: "cool", Sensors: []ControllerSensor{{Path: "w1:28-1"}}, SensorPolicy: &SensorPolicy{Mode: SensorPolicyCascade}},
+	}}
+	var paths []string
+	for _, err := range validateConfigSemantics(config) {
+		paths = append(paths, err.Path)
+	}
+	expected := "/controllers/2/thermometerPath /controllers/3/sensors /controllers/4/sensors/0/role /controllers/4/sensors /controllers/4/sensorPolicy/mode /controllers/5/sensorPolicy/mode"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("expected errors at %s, got %s", expected, strings.Join(paths, " "))
+	}
+}
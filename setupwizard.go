@@ -0,0 +1,342 @@
+package tmpcontrol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ThermometerEnumerator lists the thermometers attached to this machine, e.g. DS18B20Reader
+type ThermometerEnumerator interface {
+	Enumerate(ctx context.Context) ([]ThermometerInfo, error)
+}
+
+// ErrSetupAborted the user's input ended before the setup wizard was done
+var ErrSetupAborted = errors.New("the setup was aborted")
+
+// SetupWizard asks its way to a ControllersConfig: it has the user warm each controller's thermometer to tell them
+// apart, offers the plugs it discovers, and clicks each switch host on and off so the user can check it's the right one
+type SetupWizard struct {
+	In                io.Reader
+	Out               io.Writer
+	Thermometers      ThermometerEnumerator
+	TemperatureReader TemperatureReader
+	Switches          HeatOrCoolController
+	//DiscoverPlugs optional, offers the plugs it finds as switch hosts
+	DiscoverPlugs func(ctx context.Context) ([]KasaDevice, error)
+	//WarmingRise how many °F a thermometer must rise for us to believe it's the one being warmed. We watch for
+	//WarmingTimeout, reading every PollInterval
+	WarmingRise    float32
+	WarmingTimeout time.Duration
+	PollInterval   time.Duration
+	//ToggleDuration how long a switch host stays on while we test it
+	ToggleDuration time.Duration
+
+	scanner *bufio.Scanner
+}
+
+func NewSetupWizard(in io.Reader, out io.Writer, thermometers ThermometerEnumerator, reader TemperatureReader, switches HeatOrCoolController) *SetupWizard {
+	return &SetupWizard{
+		In:                in,
+		Out:               out,
+		Thermometers:      thermometers,
+		TemperatureReader: reader,
+		Switches:          switches,
+		WarmingRise:       1,
+		WarmingTimeout:    2 * time.Minute,
+		PollInterval:      2 * time.Second,
+		ToggleDuration:    3 * time.Second,
+	}
+}
+
+// Run returns a config that passed ValidateConfig, or ErrSetupAborted if the input ended first
+func (w *SetupWizard) Run(ctx context.Context) (ControllersConfig, error) {
+	w.scanner = bufio.NewScanner(w.In)
+	thermometers := w.findThermometers(ctx)
+	plugs := w.findPlugs(ctx)
+
+	var config ControllersConfig
+	usedThermometers := make(map[string]bool)
+	for {
+		name, err := w.ask("\nName of the controller, e.g. fermenter (blank when you're done)")
+		if err != nil {
+			return config, err
+		}
+		if name == "" {
+			if len(config.Controllers) > 0 {
+				break
+			}
+			w.printf("We need at least one controller\n")
+			continue
+		}
+		if !ClientIdentifiersRegex.MatchString(name) || slices.ContainsFunc(config.Controllers, func(c Controller) bool { return c.Name == name }) {
+			w.printf("The name must be unique and match %s\n", ClientIdentifiersRegex.String())
+			continue
+		}
+
+		controller := Controller{Name: name}
+		if controller.ControlType, err = w.askChoice("Does it heat or cool?", "heat", "cool"); err != nil {
+			return config, err
+		}
+		if controller.ThermometerPath, err = w.chooseThermometer(ctx, thermometers, usedThermometers); err != nil {
+			return config, err
+		}
+		usedThermometers[controller.ThermometerPath] = true
+		if controller.SwitchHosts, err = w.chooseSwitchHosts(ctx, plugs); err != nil {
+			return config, err
+		}
+		temperature, err := w.askTemperature()
+		if err != nil {
+			return config, err
+		}
+		controller.TemperatureSchedule = map[time.Time]float32{time.Now().UTC().Truncate(time.Minute): temperature}
+		config.Controllers = append(config.Controllers, controller)
+	}
+	if err := ValidateConfig(config); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func (w *SetupWizard) printf(format string, v ...interface{}) {
+	_, _ = fmt.Fprintf(w.Out, format, v...)
+}
+
+// ask returns the trimmed answer, or ErrSetupAborted
+func (w *SetupWizard) ask(question string) (string, error) {
+	w.printf("%s: ", question)
+	if !w.scanner.Scan() {
+		w.printf("\n")
+		return "", ErrSetupAborted
+	}
+	return strings.TrimSpace(w.scanner.Text()), nil
+}
+
+func (w *SetupWizard) askChoice(question string, choices ...string) (string, error) {
+	for {
+		answer, err := w.ask(fmt.Sprintf("%s [%s]", question, strings.Join(choices, "/")))
+		if err != nil {
+			return "", err
+		}
+		if slices.Contains(choices, strings.ToLower(answer)) {
+			return strings.ToLower(answer), nil
+		}
+	}
+}
+
+// askYesNo an empty answer is byDefault
+func (w *SetupWizard) askYesNo(question string, byDefault bool) (bool, error) {
+	options := "[y/N]"
+	if byDefault {
+		options = "[Y/n]"
+	}
+	answer, err := w.ask(question + " " + options)
+	if err != nil {
+		return false, err
+	}
+	if answer == "" {
+		return byDefault, nil
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+func (w *SetupWizard) askTemperature() (float32, error) {
+	for {
+		answer, err := w.ask("What temperature should it hold, in °F?")
+		if err != nil {
+			return 0, err
+		}
+		temperature, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSuffix(answer, "F"), "°"), 32)
+		if err == nil && temperature >= minValidFahrenheitTemperature && temperature <= maxValidFahrenheitTemperature {
+			return float32(temperature), nil
+		}
+		w.printf("That should be a number of °F between %d and %d\n", minValidFahrenheitTemperature, maxValidFahrenheitTemperature)
+	}
+}
+
+// findThermometers the thermometers we could read
+func (w *SetupWizard) findThermometers(ctx context.Context) []string {
+	if w.Thermometers == nil {
+		return nil
+	}
+	found, err := w.Thermometers.Enumerate(ctx)
+	if err != nil {
+		w.printf("We couldn't look for thermometers: %s\n", err)
+		return nil
+	}
+	var paths []string
+	for _, thermometer := range found {
+		if thermometer.Err != "" {
+			w.printf("We found %s, but couldn't read it: %s\n", thermometer.Path, thermometer.Err)
+			continue
+		}
+		w.printf("We found %s (%s), reading %.2f°F\n", thermometer.Path, thermometer.Family, thermometer.TemperatureInF)
+		paths = append(paths, thermometer.Path)
+	}
+	if len(paths) == 0 {
+		w.printf("We didn't find any thermometers we can read, so you'll have to type their paths\n")
+	}
+	return paths
+}
+
+func (w *SetupWizard) findPlugs(ctx context.Context) []KasaDevice {
+	if w.DiscoverPlugs == nil {
+		return nil
+	}
+	plugs, err := w.DiscoverPlugs(ctx)
+	if err != nil {
+		w.printf("We couldn't look for plugs: %s\n", err)
+	}
+	return plugs
+}
+
+// chooseThermometer offers the one thermometer left, or has the user warm theirs. A typed path is always accepted if
+// it's valid
+func (w *SetupWizard) chooseThermometer(ctx context.Context, thermometers []string, used map[string]bool) (string, error) {
+	var candidates []string
+	for _, path := range thermometers {
+		if !used[path] {
+			candidates = append(candidates, path)
+		}
+	}
+	for {
+		var question string
+		switch len(candidates) {
+		case 0:
+			question = "The thermometer's path, e.g. w1:28-0000000000 or mqtt:zigbee2mqtt/fridge"
+		case 1:
+			question = fmt.Sprintf("Press Enter to use %s, or type another thermometer's path", candidates[0])
+		default:
+			question = "Press Enter, then warm this controller's thermometer in your hand. Or type its path"
+		}
+		answer, err := w.ask(question)
+		if err != nil {
+			return "", err
+		}
+		if answer != "" {
+			if err := validateThermometerPath(answer); err != nil {
+				w.printf("%s\n", err)
+				continue
+			}
+			return answer, nil
+		}
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			return candidates[0], nil
+		}
+		path, err := w.identifyWarmedThermometer(ctx, candidates)
+		if err != nil {
+			w.printf("%s\n", err)
+			continue
+		}
+		return path, nil
+	}
+}
+
+// identifyWarmedThermometer watches the thermometers until one has risen by WarmingRise
+func (w *SetupWizard) identifyWarmedThermometer(ctx context.Context, paths []string) (string, error) {
+	sensors := make([]ControllerSensor, len(paths))
+	for i, path := range paths {
+		sensors[i] = ControllerSensor{Path: path}
+	}
+	baseline := readSensors(ctx, w.TemperatureReader, sensors)
+	w.printf("Watching %d thermometers for up to %s...\n", len(paths), w.WarmingTimeout)
+	ctx, cancel := context.WithTimeout(ctx, w.WarmingTimeout)
+	defer cancel()
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("none of the thermometers rose by %.1f°F", w.WarmingRise)
+		case <-ticker.C:
+		}
+		var warmest string
+		var warmestRise float32
+		for i, reading := range readSensors(ctx, w.TemperatureReader, sensors) {
+			if reading.err != nil || baseline[i].err != nil {
+				continue
+			}
+			if rise := reading.temperature - baseline[i].temperature; rise >= w.WarmingRise && rise > warmestRise {
+				warmest, warmestRise = reading.Path, rise
+			}
+		}
+		if warmest != "" {
+			w.printf("%s rose by %.1f°F, so that's the one\n", warmest, warmestRise)
+			return warmest, nil
+		}
+	}
+}
+
+// chooseSwitchHosts asks until we have at least one host the user has seen switch
+func (w *SetupWizard) chooseSwitchHosts(ctx context.Context, plugs []KasaDevice) ([]string, error) {
+	for i, plug := range plugs {
+		w.printf("%d) %s %s (%s, %s)\n", i+1, plug.Host, plug.Alias, plug.Model, plug.Mac)
+	}
+	question := "Switch hosts, separated by commas, e.g. 192.168.1.20 or gpio:17"
+	if len(plugs) > 0 {
+		question = "Switch hosts, separated by commas: numbers from the list, or hosts like 192.168.1.20 or gpio:17"
+	}
+	for {
+		answer, err := w.ask(question)
+		if err != nil {
+			return nil, err
+		}
+		var hosts []string
+		for _, host := range strings.Split(answer, ",") {
+			host = strings.TrimSpace(host)
+			if n, err := strconv.Atoi(host); err == nil && n >= 1 && n <= len(plugs) {
+				host = plugs[n-1].Host
+			}
+			if host == "" {
+				continue
+			}
+			if err := validateSwitchHost(host); err != nil {
+				w.printf("%s\n", err)
+				continue
+			}
+			ok, err := w.testSwitchHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) > 0 {
+			return hosts, nil
+		}
+		w.printf("We need at least one switch host\n")
+	}
+}
+
+// testSwitchHost turns the host on for ToggleDuration and asks whether the user saw it. The error is only
+// ErrSetupAborted
+func (w *SetupWizard) testSwitchHost(ctx context.Context, host string) (bool, error) {
+	w.printf("We're turning %s on for %s, watch (or listen) for it\n", host, w.ToggleDuration)
+	err := controlDevice(ctx, w.Switches, host, ControlOn)
+	if err == nil {
+		select {
+		case <-time.After(w.ToggleDuration):
+		case <-ctx.Done():
+		}
+		err = controlDevice(ctx, w.Switches, host, ControlOff)
+	}
+	if err != nil {
+		w.printf("We couldn't switch %s: %s\n", host, err)
+		return w.askYesNo(fmt.Sprintf("Keep %s anyway?", host), false)
+	}
+	keep, err := w.askYesNo(fmt.Sprintf("Did %s turn on and back off?", host), true)
+	if err == nil && !keep {
+		w.printf("We'll leave %s out\n", host)
+	}
+	return keep, err
+}
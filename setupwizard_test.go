@@ -0,0 +1,97 @@
+package tmpcontrol
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeEnumerator []ThermometerInfo
+
+func (f fakeEnumerator) Enumerate(ctx context.Context) ([]ThermometerInfo, error) {
+	return f, nil
+}
+
+// warmingThermometer the warmed path rises half a degree every time it's read
+type warmingThermometer struct {
+	mu     sync.Mutex
+	warmed string
+	reads  int
+}
+
+func (w *warmingThermometer) ReadTemperatureInF(path string) (float32, error) {
+	if path != w.warmed {
+		return 65, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reads++
+	return 65 + float32(w.reads)/2, nil
+}
+
+func TestSetupWizard(t *testing.T) {
+	input := strings.Join([]string{
+		"",           //we need at least one controller
+		"fermenter",  //
+		"lukewarm",   //asked again
+		"cool",       //
+		"",           //warm the thermometer
+		"1, gpio:17", //
+		"",           //the plug clicked
+		"n",          //the relay didn't
+		"64",         //
+		"kegerator",  //
+		"cool",       //
+		"",           //the one thermometer left
+		"10.0.0.30",  //
+		"y",          //
+		"38°F",       //
+		"",           //done
+	}, "\n") + "\n"
+	var output strings.Builder
+	switches := &recordingSwitch{}
+	thermometers := fakeEnumerator{
+		{Path: "w1:28-0000000001", Family: "DS18B20", TemperatureInF: 65},
+		{Path: "w1:28-0000000002", Family: "DS18B20", TemperatureInF: 65},
+		{Path: "w1:28-0000000003", Family: "DS18B20", Err: "the 1-Wire CRC check failed"},
+	}
+	wizard := NewSetupWizard(strings.NewReader(input), &output, thermometers, &warmingThermometer{warmed: "w1:28-0000000002"}, switches)
+	wizard.DiscoverPlugs = func(ctx context.Context) ([]KasaDevice, error) {
+		return []KasaDevice{{Host: "10.0.0.20", Alias: "Fermentation fridge", Model: "HS103", Mac: "50:C7:BF:00:00:01"}}, nil
+	}
+	wizard.PollInterval, wizard.WarmingTimeout, wizard.ToggleDuration = time.Millisecond, time.Second, time.Millisecond
+
+	config, err := wizard.Run(context.Background())
+	if err != nil {
+		t.Fatalf("%s\n%s", err, output.String())
+	}
+	if len(config.Controllers) != 2 {
+		t.Fatalf("expected two controllers: %+v", config)
+	}
+	fermenter, kegerator := config.Controllers[0], config.Controllers[1]
+	if fermenter.Name != "fermenter" || fermenter.ControlType != "cool" || fermenter.ThermometerPath != "w1:28-0000000002" || strings.Join(fermenter.SwitchHosts, ",") != "10.0.0.20" {
+		t.Errorf("unexpected fermenter: %+v", fermenter)
+	}
+	if temperature, ok := fermenter.GetCurrentDesiredTemperature(); !ok || temperature != 64 {
+		t.Errorf("expected the fermenter to hold 64°F from now, got %.2f, %t", temperature, ok)
+	}
+	if temperature, ok := kegerator.GetCurrentDesiredTemperature(); !ok || temperature != 38 || kegerator.ThermometerPath != "w1:28-0000000001" || strings.Join(kegerator.SwitchHosts, ",") != "10.0.0.30" {
+		t.Errorf("unexpected kegerator: %+v", kegerator)
+	}
+	if switches.calls != 6 || switches.state("10.0.0.20") != ControlOff || switches.state("gpio:17") != ControlOff {
+		t.Errorf("expected each switch host to be turned on and back off, got %d calls", switches.calls)
+	}
+	if !strings.Contains(output.String(), "w1:28-0000000002 rose by") || !strings.Contains(output.String(), "We'll leave gpio:17 out") {
+		t.Errorf("unexpected output:\n%s", output.String())
+	}
+}
+
+func TestSetupWizard_Aborted(t *testing.T) {
+	var output strings.Builder
+	wizard := NewSetupWizard(strings.NewReader("fermenter\nheat\n"), &output, fakeEnumerator{}, fixedThermometer{}, &recordingSwitch{})
+	if _, err := wizard.Run(context.Background()); err != ErrSetupAborted {
+		t.Errorf("expected ErrSetupAborted when the input ends, got %v", err)
+	}
+}
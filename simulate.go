@@ -0,0 +1,357 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ThermalModel a first-order model of what a controller controls. Left alone it drifts toward Ambient, closing 63% of
+// the gap every TimeConstant; while its switch hosts are on it also heats at HeatingRate, or cools at CoolingRate,
+// starting Lag after they switch
+type ThermalModel struct {
+	InitialTemperature float32  `json:"initialTemperature"`
+	Ambient            float32  `json:"ambient"`
+	TimeConstant       Duration `json:"timeConstant"`
+	//HeatingRate and CoolingRate in °F an hour
+	HeatingRate float32 `json:"heatingRate"`
+	CoolingRate float32 `json:"coolingRate"`
+	//Lag e.g. how long a carboy takes to feel the fridge's compressor
+	Lag Duration `json:"lag"`
+}
+
+// DefaultThermalModel about a 5 gallon carboy in a fridge with a heat wrap, in a 68°F basement
+func DefaultThermalModel() ThermalModel {
+	return ThermalModel{
+		InitialTemperature: 68,
+		Ambient:            68,
+		TimeConstant:       Duration(12 * time.Hour),
+		HeatingRate:        4,
+		CoolingRate:        4,
+		Lag:                Duration(10 * time.Minute),
+	}
+}
+
+func (m ThermalModel) validate() error {
+	if m.TimeConstant <= 0 {
+		return fmt.Errorf("the time constant must be positive")
+	}
+	if m.HeatingRate < 0 || m.CoolingRate < 0 || m.Lag < 0 {
+		return fmt.Errorf("the heating and cooling rates and the lag can't be negative")
+	}
+	return nil
+}
+
+// simulationStep the longest we integrate a ThermalModel over at once
+const simulationStep = 10 * time.Second
+
+// simulatedBatch what one controller controls
+type simulatedBatch struct {
+	model       ThermalModel
+	controlType string
+	hosts       []string
+	temperature float64
+	//switched when the batch's hosts went on or off, oldest first
+	switched []simulatedSwitch
+}
+
+type simulatedSwitch struct {
+	at time.Time
+	on bool
+}
+
+// poweredAt whether the hosts were on at t
+func (b *simulatedBatch) poweredAt(t time.Time) bool {
+	powered := false
+	for _, s := range b.switched {
+		if s.at.After(t) {
+			break
+		}
+		powered = s.on
+	}
+	return powered
+}
+
+// advance integrates the model from..to, exactly over each simulationStep in which the power is constant
+func (b *simulatedBatch) advance(from, to time.Time) {
+	tau := time.Duration(b.model.TimeConstant).Hours()
+	for t := from; t.Before(to); {
+		step := min(to.Sub(t), simulationStep)
+		var rate float64
+		if b.poweredAt(t.Add(-time.Duration(b.model.Lag))) {
+			if b.controlType == "cool" {
+				rate = -float64(b.model.CoolingRate)
+			} else {
+				rate = float64(b.model.HeatingRate)
+			}
+		}
+		equilibrium := float64(b.model.Ambient) + rate*tau
+		b.temperature = equilibrium + (b.temperature-equilibrium)*math.Exp(-step.Hours()/tau)
+		t = t.Add(step)
+	}
+	//we only need to know the power as far back as the lag
+	cutoff := to.Add(-time.Duration(b.model.Lag))
+	for len(b.switched) > 1 && !b.switched[1].at.After(cutoff) {
+		b.switched = b.switched[1:]
+	}
+}
+
+// simulatedEnvironment the TemperatureReader and HeatOrCoolController of a Simulation. Each controller's thermometers
+// read its batch, and its switch hosts power its batch
+type simulatedEnvironment struct {
+	mu         sync.Mutex
+	clock      Clock
+	batches    map[string]*simulatedBatch
+	pathOwners map[string]string
+	hostStates map[string]bool
+}
+
+func (e *simulatedEnvironment) ReadTemperatureInF(path string) (float32, error) {
+	return e.ReadTemperatureInFContext(context.Background(), path)
+}
+
+// ReadTemperatureInFContext and ControlDeviceContext spare us a goroutine per call, see readTemperature
+func (e *simulatedEnvironment) ReadTemperatureInFContext(ctx context.Context, path string) (float32, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	owner, ok := e.pathOwners[path]
+	if !ok {
+		return 0, fmt.Errorf("%s isn't simulated", path)
+	}
+	return float32(e.batches[owner].temperature), nil
+}
+
+func (e *simulatedEnvironment) ControlDevice(host string, action Control) error {
+	return e.ControlDeviceContext(context.Background(), host, action)
+}
+
+func (e *simulatedEnvironment) ControlDeviceContext(ctx context.Context, host string, action Control) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hostStates[host] = action == ControlOn
+	now := e.clock.Now()
+	for _, batch := range e.batches {
+		powered := false
+		for _, batchHost := range batch.hosts {
+			powered = powered || e.hostStates[batchHost]
+		}
+		if powered != batch.poweredAt(now) {
+			batch.switched = append(batch.switched, simulatedSwitch{at: now, on: powered})
+		}
+	}
+	return nil
+}
+
+func (e *simulatedEnvironment) advance(from, to time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, batch := range e.batches {
+		batch.advance(from, to)
+	}
+}
+
+// SimulationSample one controller iteration of a Simulation
+type SimulationSample struct {
+	Time           time.Time
+	Controller     string
+	TemperatureInF float32
+	//DesiredTemperatureInF only if Scheduled
+	DesiredTemperatureInF float32
+	Scheduled             bool
+	On                    bool
+}
+
+// SimulationResult how well one controller held its schedule, over the iterations it had one
+type SimulationResult struct {
+	Controller string
+	Iterations int
+	//SwitchCycles how many times the switch hosts went on
+	SwitchCycles int
+	//DutyCycle the fraction of iterations the switch hosts were on
+	DutyCycle    float64
+	MeanAbsError float32
+	MaxAbsError  float32
+}
+
+func (r SimulationResult) String() string {
+	return fmt.Sprintf("%s: %d switch cycles, on %.0f%% of the time, off by %.2f°F on average and %.2f°F at most", r.Controller, r.SwitchCycles, r.DutyCycle*100, r.MeanAbsError, r.MaxAbsError)
+}
+
+// Simulation runs Config's controllers against ThermalModels on a SimulatedClock, so a two week schedule takes seconds
+type Simulation struct {
+	Config ControllersConfig
+	//Models by controller name; the others use DefaultModel
+	Models       map[string]ThermalModel
+	DefaultModel ThermalModel
+	//Start defaults to the earliest entry of any schedule
+	Start time.Time
+	//Duration defaults to a day past the latest entry of any schedule
+	Duration time.Duration
+	//Logger the control loop's logging, discarded if nil
+	Logger Logger
+}
+
+func NewSimulation(config ControllersConfig) *Simulation {
+	return &Simulation{Config: config, DefaultModel: DefaultThermalModel()}
+}
+
+// span Start and Duration, or the schedules' defaults
+func (s *Simulation) span() (time.Time, time.Time) {
+	var first, last time.Time
+	for _, controller := range s.Config.Controllers {
+		for at := range controller.TemperatureSchedule {
+			if first.IsZero() || at.Before(first) {
+				first = at
+			}
+			if at.After(last) {
+				last = at
+			}
+		}
+	}
+	start := s.Start
+	if start.IsZero() {
+		start = first
+	}
+	end := start.Add(s.Duration)
+	if s.Duration == 0 {
+		end = last.Add(24 * time.Hour)
+	}
+	return start, end
+}
+
+func (s *Simulation) model(controllerName string) ThermalModel {
+	if model, ok := s.Models[controllerName]; ok {
+		return model
+	}
+	return s.DefaultModel
+}
+
+// Run calls record with every controller iteration, in time order, and returns how each controller did
+func (s *Simulation) Run(ctx context.Context, record func(SimulationSample) error) ([]SimulationResult, error) {
+	if err := ValidateConfig(s.Config); err != nil {
+		return nil, err
+	}
+	start, end := s.span()
+	if !end.After(start) {
+		return nil, errors.New("the simulation must run for a while")
+	}
+	clock := NewSimulatedClock(start)
+	environment := &simulatedEnvironment{clock: clock, batches: make(map[string]*simulatedBatch), pathOwners: make(map[string]string), hostStates: make(map[string]bool)}
+	for _, controller := range s.Config.Controllers {
+		model := s.model(controller.Name)
+		if err := model.validate(); err != nil {
+			return nil, fmt.Errorf("the model of %s: %w", controller.Name, err)
+		}
+		environment.batches[controller.Name] = &simulatedBatch{model: model, controlType: controller.ControlType, hosts: controller.SwitchHosts, temperature: float64(model.InitialTemperature)}
+		for _, sensor := range controller.sensors() {
+			if _, ok := environment.pathOwners[sensor.Path]; !ok {
+				environment.pathOwners[sensor.Path] = controller.Name
+			}
+		}
+	}
+	logger := s.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	cl := NewControlLooper(&ConfigGopher{}, environment, logger)
+	cl.TemperatureReader = environment
+	cl.Clock = clock
+
+	controllers := s.Config.Controllers
+	results := make([]SimulationResult, len(controllers))
+	next := make([]time.Time, len(controllers))
+	wasOn := make([]bool, len(controllers))
+	onIterations := make([]int, len(controllers))
+	totalError := make([]float64, len(controllers))
+	for i := range controllers {
+		results[i].Controller = controllers[i].Name
+		next[i] = start
+	}
+	now := start
+	for {
+		//the controllers that are due next run together, like they would on their own goroutines
+		due := next[0]
+		for _, t := range next {
+			if t.Before(due) {
+				due = t
+			}
+		}
+		if !due.Before(end) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		environment.advance(now, due)
+		now = due
+		clock.Set(now)
+		for i := range controllers {
+			if !next[i].Equal(now) {
+				continue
+			}
+			controller := &controllers[i]
+			next[i] = now.Add(cl.timingFor(s.Config, *controller).interval)
+			ret := cl.temperatureControl(ctx, controller)
+			temperature, _ := environment.ReadTemperatureInF(controller.sensors()[0].Path)
+			sample := SimulationSample{Time: now, Controller: controller.Name, TemperatureInF: temperature}
+			if !ret.noSchedulesAreActive {
+				sample.Scheduled = true
+				sample.DesiredTemperatureInF, _ = controller.DesiredTemperatureAt(now)
+				sample.On = ret.tmplog.TurningOnNotOff
+				result := &results[i]
+				result.Iterations++
+				if sample.On {
+					onIterations[i]++
+					if !wasOn[i] {
+						result.SwitchCycles++
+					}
+				}
+				wasOn[i] = sample.On
+				absError := float32(math.Abs(float64(temperature - sample.DesiredTemperatureInF)))
+				totalError[i] += float64(absError)
+				result.MaxAbsError = max(result.MaxAbsError, absError)
+			}
+			if err := record(sample); err != nil {
+				return results, err
+			}
+		}
+	}
+	for i := range results {
+		if results[i].Iterations > 0 {
+			results[i].DutyCycle = float64(onIterations[i]) / float64(results[i].Iterations)
+			results[i].MeanAbsError = float32(totalError[i] / float64(results[i].Iterations))
+		}
+	}
+	return results, nil
+}
+
+// WriteCsv runs the simulation and writes every controller iteration to w as CSV, with a header row
+func (s *Simulation) WriteCsv(ctx context.Context, w io.Writer) ([]SimulationResult, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"time", "controller", "temperatureInF", "desiredTemperatureInF", "switch"}); err != nil {
+		return nil, err
+	}
+	results, err := s.Run(ctx, func(sample SimulationSample) error {
+		desired, state := "", ""
+		if sample.Scheduled {
+			desired = strconv.FormatFloat(float64(sample.DesiredTemperatureInF), 'f', 2, 32)
+			state = "off"
+			if sample.On {
+				state = "on"
+			}
+		}
+		return writer.Write([]string{sample.Time.UTC().Format(time.RFC3339), sample.Controller, strconv.FormatFloat(float64(sample.TemperatureInF), 'f', 2, 32), desired, state})
+	})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	return results, err
+}
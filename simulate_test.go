@@ -0,0 +1,96 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSimulatedBatch_Advance(t *testing.T) {
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	model := ThermalModel{Ambient: 68, TimeConstant: Duration(12 * time.Hour), CoolingRate: 4, Lag: Duration(time.Hour)}
+	batch := &simulatedBatch{model: model, controlType: "cool", temperature: 80}
+	batch.advance(start, start.Add(12*time.Hour))
+	if expected := 68 + 12/math.E; math.Abs(batch.temperature-expected) > 0.01 {
+		t.Errorf("expected to close 63%% of the gap to ambient, got %.2f instead of %.2f", batch.temperature, expected)
+	}
+
+	//the cooler comes on, but the batch doesn't feel it for an hour
+	batch.temperature = 68
+	batch.switched = []simulatedSwitch{{at: start, on: true}}
+	batch.advance(start, start.Add(time.Hour))
+	if batch.temperature != 68 {
+		t.Errorf("expected the lag to hold the temperature, got %.2f", batch.temperature)
+	}
+	batch.advance(start.Add(time.Hour), start.Add(2*time.Hour))
+	if expected := 68 - 48*(1-math.Exp(-1.0/12)); math.Abs(batch.temperature-expected) > 0.01 {
+		t.Errorf("expected %.2f after an hour of cooling, got %.2f", expected, batch.temperature)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	start := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	config := ControllersConfig{Controllers: []Controller{
+		{
+			Name:            "fermenter",
+			ControlType:     "cool",
+			ThermometerPath: "/fermenter",
+			SwitchHosts:     []string{"fridge"},
+			//ferment at 64°F, then cold crash
+			TemperatureSchedule: map[time.Time]float32{start: 64, start.Add(10 * 24 * time.Hour): 34},
+			Timing:              &ControlTiming{Interval: Duration(time.Minute)},
+		},
+		{
+			Name:                "mash-water",
+			ControlType:         "heat",
+			ThermometerPath:     "/mash-water",
+			SwitchHosts:         []string{"heater"},
+			TemperatureSchedule: map[time.Time]float32{start.Add(13 * 24 * time.Hour): 165},
+		},
+	}}
+	simulation := NewSimulation(config)
+	simulation.Models = map[string]ThermalModel{
+		"mash-water": {InitialTemperature: 60, Ambient: 60, TimeConstant: Duration(6 * time.Hour), HeatingRate: 60},
+	}
+
+	var output bytes.Buffer
+	results, err := simulation.WriteCsv(context.Background(), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//until a day past the mash water's schedule: the fermenter every minute, and the mash water every 15 seconds
+	if expected := 1 + 14*24*60 + 14*24*60*4; len(rows) != expected {
+		t.Errorf("expected %d rows, got %d", expected, len(rows))
+	}
+	if rows[0][0] != "time" || rows[1][0] != "2026-03-01T00:00:00Z" || rows[1][3] != "" {
+		t.Errorf("unexpected first rows: %v", rows[:2])
+	}
+
+	fermenter, mashWater := results[0], results[1]
+	if fermenter.Iterations != 14*24*60-1 || fermenter.SwitchCycles < 10 || fermenter.MeanAbsError > 1 {
+		t.Errorf("expected the fermenter to hold its schedule: %s", fermenter)
+	}
+	if fermenter.MaxAbsError < 25 {
+		t.Errorf("expected the cold crash to take a while: %s", fermenter)
+	}
+	if mashWater.Iterations != 24*60*4-1 || mashWater.DutyCycle == 0 || mashWater.MaxAbsError < 100 {
+		t.Errorf("expected the mash water to be heated from 60°F: %s", mashWater)
+	}
+
+	//lag makes a controller overshoot
+	simulation.DefaultModel.Lag = Duration(time.Hour)
+	lagged, err := simulation.Run(context.Background(), func(SimulationSample) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lagged[0].MeanAbsError <= fermenter.MeanAbsError {
+		t.Errorf("expected more lag to hold the temperature less well: %s vs %s", lagged[0], fermenter)
+	}
+}
@@ -0,0 +1,343 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrControllerCrashed and ErrControllerStuck are reported in a ControllerResult when we had to restart its controller
+var ErrControllerCrashed = errors.New("the controller crashed")
+var ErrControllerStuck = errors.New("the controller got stuck")
+
+// StepResult what one Step of the control loop did
+type StepResult struct {
+	//Time what the Clock said when the Step started
+	Time time.Time
+	//ConfigFetched whether we fetched new config from ConfigSource this Step. ConfigErr is set if we tried and failed
+	ConfigFetched bool
+	ConfigSource  ConfigSource
+	ConfigErr     error
+	//Controllers the controllers that were due this Step, in config order
+	Controllers []ControllerResult
+	//Alerts the notifications we sent the server during this Step
+	Alerts []Alert
+}
+
+// ControllerResult one iteration of a controller
+type ControllerResult struct {
+	Name string
+	//Sleeping none of its schedules have come to pass, so we didn't read or switch anything
+	Sleeping bool
+	Readings []SensorReading
+	//TemperatureInF what we controlled on, unless Err wraps TemperatureReadError
+	TemperatureInF        float32
+	DesiredTemperatureInF float32
+	//Decision what we switched the hosts to
+	Decision Control
+	Hosts    []HostOutcome
+	//TmpLog what we logged; it's zero if we didn't have a temperature to log
+	TmpLog   TmpLog
+	TimedOut bool
+	Err      error
+}
+
+// SensorReading what one of a controller's sensors said, after calibration. Err is set if we couldn't read it
+type SensorReading struct {
+	ControllerSensor
+	TemperatureInF    float32
+	RawTemperatureInF float32
+	Err               error
+}
+
+// HostOutcome whether we managed to switch a host
+type HostOutcome struct {
+	Host string
+	Err  error
+}
+
+// Alert a notification we sent the server
+type Alert struct {
+	Message string
+	Urgency ServerNotificationUrgency
+}
+
+// alertCollector the alerts raised since the last Step. Controllers raise them from their own goroutines
+type alertCollector struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (c *alertCollector) add(alert Alert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.alerts = append(c.alerts, alert)
+}
+
+func (c *alertCollector) take() []Alert {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	alerts := c.alerts
+	c.alerts = nil
+	return alerts
+}
+
+// notify sends the server a notification and keeps it for the StepResult
+func (cl *ControlLooper) notify(message string, urgency ServerNotificationUrgency) {
+	cl.Cg.NotifyServer(message, urgency)
+	cl.alerts.add(Alert{Message: message, Urgency: urgency})
+}
+
+// Run runs the control loop until ctx is done, then drives every switch host to ShutdownState and returns. Unlike
+// Step, it gives each controller a goroutine of its own that iterates at the controller's interval, so a hung
+// thermometer or switch host only holds up its own controller; every ControlInterval it checks up on the config,
+// controllers, thermometers and switch hosts. An error is only returned if we couldn't get started. Don't call Step
+// while Run is running
+func (cl *ControlLooper) Run(ctx context.Context) error {
+	if !cl.started {
+		if err := cl.start(); err != nil {
+			return err
+		}
+	}
+	defer cl.Shutdown()
+	cl.supervisor.runInBackground(ctx, cl.Clock.Now())
+
+	//a local config file is watched so edits are applied right away instead of at the next poll
+	var localConfigUpdates <-chan ControllersConfig
+	if cl.configSource == ConfigSourceLocalFile || cl.configSource == ConfigSourceLayered {
+		var err error
+		localConfigUpdates, err = cl.Cg.WatchLocalConfig(ctx)
+		if err != nil {
+			cl.Logger.Printf("%s We couldn't watch %s for changes, we'll keep polling it: %s\n", cl.timestamp(), cl.Cg.LocalConfigPath, err)
+		}
+	}
+
+	ticker := cl.Clock.NewTicker(cl.ControlInterval)
+	defer ticker.Stop()
+	// Loop until we're asked to stop
+	for {
+		select {
+		case <-ctx.Done():
+			cl.Logger.Printf("%s We've been asked to stop: %s\n", cl.timestamp(), context.Cause(ctx))
+			return nil
+		case newConfig, ok := <-localConfigUpdates:
+			if !ok {
+				//the watch stopped; we'll still poll the file
+				localConfigUpdates = nil
+				continue
+			}
+			cl.Logger.Printf("%s %s changed, applying it now\n", cl.timestamp(), cl.Cg.LocalConfigPath)
+			cl.applyConfig(newConfig, cl.Clock.Now())
+		case <-cl.supervisor.ready:
+			cl.collectIterations()
+		case <-ticker.C():
+			loopStart := cl.Clock.Now()
+			cl.fetchConfigIfDue(loopStart)
+			cl.checkUp(cl.supervisor.checkForStuckControllers(cl.Clock.Now()))
+			cl.Logger.Printf("This iteration of the control loop took %s\n", cl.Clock.Now().Sub(loopStart).String())
+		}
+		//the server has already been notified; only Step reports the alerts
+		cl.alerts.take()
+	}
+}
+
+// StartControlLoop is Run, for callers from before there was one
+//
+// Deprecated: use Run
+func (cl *ControlLooper) StartControlLoop(ctx context.Context) error {
+	return cl.Run(ctx)
+}
+
+// Step runs one iteration of the control loop: it fetches config if that's due, runs every controller that's due and
+// checks up on the controllers, thermometers and switch hosts. The due controllers run at once, each under ctx with
+// its own timeout, and Step waits for them. The first Step fetches the initial config and opens the database. Step
+// only returns an error if that failed; everything else is reported in the StepResult. Step isn't safe to call
+// concurrently, nor while Run is running, and Shutdown should be called once we're done stepping
+func (cl *ControlLooper) Step(ctx context.Context) (StepResult, error) {
+	if !cl.started {
+		if err := cl.start(); err != nil {
+			return StepResult{}, err
+		}
+	}
+	loopStart := cl.Clock.Now()
+	result := StepResult{Time: loopStart}
+	result.ConfigFetched, result.ConfigSource, result.ConfigErr = cl.fetchConfigIfDue(loopStart)
+
+	stuck := cl.supervisor.runDue(ctx, loopStart)
+	result.Controllers = append(cl.collectIterations(), cl.checkUp(stuck)...)
+	//in config order, rather than the order they happened to finish in
+	order := make(map[string]int, len(cl.config.Controllers))
+	for i, controller := range cl.config.Controllers {
+		order[controller.Name] = i
+	}
+	slices.SortStableFunc(result.Controllers, func(a, b ControllerResult) int {
+		return order[a.Name] - order[b.Name]
+	})
+	result.Alerts = cl.alerts.take()
+	cl.Logger.Printf("This iteration of the control loop took %s\n", cl.Clock.Now().Sub(loopStart).String())
+	return result, nil
+}
+
+// fetchConfigIfDue fetches config if it's been more than the configured interval since we last did. It returns
+// whether it fetched, and ConfigErr is set if it tried and failed
+func (cl *ControlLooper) fetchConfigIfDue(now time.Time) (fetched bool, source ConfigSource, err error) {
+	if !cl.health.lastConfigFetched.Add(cl.Cg.ConfigFetchInterval).Before(now) {
+		return false, 0, nil
+	}
+	source, err = cl.refetchConfig()
+	return err == nil, source, err
+}
+
+// collectIterations finishes the iterations the controllers have reported since it was last called
+func (cl *ControlLooper) collectIterations() []ControllerResult {
+	var results []ControllerResult
+	for _, event := range cl.supervisor.take() {
+		returnValue, finished, crashed := cl.supervisor.handle(event, cl.Clock.Now())
+		if crashed {
+			results = append(results, ControllerResult{Name: event.name, Err: fmt.Errorf("%w: %v", ErrControllerCrashed, event.panicValue)})
+		} else if finished {
+			results = append(results, cl.finishIteration(returnValue, event.timedOut))
+		}
+	}
+	return results
+}
+
+// checkUp reports the controllers we found stuck, by how long they'd been running, and checks up on the thermometers
+// and switch hosts
+func (cl *ControlLooper) checkUp(stuck map[string]time.Duration) []ControllerResult {
+	var results []ControllerResult
+	for _, controller := range cl.config.Controllers {
+		if running, ok := stuck[controller.Name]; ok {
+			results = append(results, ControllerResult{Name: controller.Name, Err: fmt.Errorf("%w for %s", ErrControllerStuck, running.Round(time.Second))})
+		}
+	}
+	nowRef := cl.Clock.Now()
+	cl.checkThermometerHealth(cl.health, cl.config, nowRef)
+	cl.checkSwitchHostHealth(cl.health, cl.config, nowRef)
+	return results
+}
+
+// start fetches the initial config and sets up what the loop carries from one iteration to the next
+func (cl *ControlLooper) start() error {
+	cl.alerts.take() //whatever was raised while we were shut down
+	cl.Logger.Printf("%s Fetching initial config\n", cl.timestamp())
+	config, source, err := cl.Cg.FetchConfig()
+	if err != nil {
+		//if the config couldn't be fetched the first time, the application will exit; later on, config reads will be tolerated
+		return fmt.Errorf("fetching initial config: %w", err)
+	}
+	cl.Logger.Printf("%s Successfully fetched initial config from %s; we'll continue to poll every %d seconds\n%+v\n", cl.timestamp(), source, cl.Cg.ConfigFetchInterval, config)
+	cl.notify(fmt.Sprintf("%s: we got some config and we're starting up", cl.Cg.ClientId), InfoNotification)
+	cl.Logger.Printf("%s Beginning control loop for %d controller(s)\n", cl.timestamp(), len(config.Controllers))
+
+	now := cl.Clock.Now()
+	cl.config = config
+	cl.configSource = source
+	//enumerate hosts to track if too much time has passed and failingState
+	cl.health = newLoopHealth(config, now)
+	cl.db, err = NewSqliteDbFromFilename(cl.dbFileName, cl.Logger)
+	if err != nil {
+		cl.Logger.Printf("Error creating sqlite dbo: %s\n", err)
+		cl.notify(fmt.Sprintf("Error creating sqlite dbo: %s\n", err), SeriousNotification)
+	}
+	cl.supervisor = newControllerSupervisor(cl)
+	cl.supervisor.reconcile(config, now)
+	cl.started = true
+	return nil
+}
+
+// Shutdown stops the controllers Run started, drives every switch host to ShutdownState, flushes pending notifications and closes
+// the database. A Step after Shutdown starts over by fetching the initial config
+func (cl *ControlLooper) Shutdown() {
+	if !cl.started {
+		return
+	}
+	cl.supervisor.stopAll()
+	//while the db is still open
+	cl.shutdown(&cl.config)
+	if cl.db.db != nil {
+		if err := cl.db.Close(); err != nil {
+			cl.Logger.Printf("%s Error closing sqlite dbo: %s\n", cl.timestamp(), err)
+		}
+	}
+	cl.db = SqliteClientDb{}
+	cl.started = false
+}
+
+// refetchConfig fetches the config again, keeping the config we have if that fails
+func (cl *ControlLooper) refetchConfig() (ConfigSource, error) {
+	newConfig, source, err := cl.Cg.FetchConfig()
+	if err != nil {
+		//TODO Factor out this function call
+		configSource, ok := cl.Cg.GetSourceKind()
+		if ok {
+			cl.Logger.Printf("%s We failed to get new config from %s: %#v", cl.timestamp(), configSource, err)
+		} else {
+			//TODO Notify the server if the error was malformed config, they may have to update it!
+			cl.Logger.Printf("%s We failed to get new config: %#v", cl.timestamp(), err)
+		}
+		//see if we need to notify the server of issues
+		cl.configFetchFailed(cl.health, cl.config, cl.Clock.Now())
+		return 0, err
+	}
+	cl.Logger.Printf("%s We successfully fetched config from %s\n", cl.timestamp(), source)
+	cl.applyConfig(newConfig, cl.Clock.Now())
+	return source, nil
+}
+
+// applyConfig switches to newConfig; the controllers whose config changed start over right away
+func (cl *ControlLooper) applyConfig(newConfig ControllersConfig, now time.Time) {
+	if !AreConfigsEqual(cl.config, newConfig) {
+		cl.Logger.Printf("NEW config!")
+		cl.Logger.Printf("%+v\n", newConfig)
+		cl.notify("We just got some updated config", InfoNotification)
+	}
+	cl.config = newConfig
+	cl.health.trackHosts(newConfig, now)
+	cl.supervisor.reconcile(newConfig, now)
+	cl.configFetched(cl.health, now)
+}
+
+// finishIteration logs and persists what a controller's iteration did and tells the loop's health about it
+func (cl *ControlLooper) finishIteration(returnValue temperatureControlReturn, timedOut bool) ControllerResult {
+	result := ControllerResult{Name: returnValue.controllerConfig.Name, TimedOut: timedOut}
+
+	if returnValue.err != nil {
+		cl.Logger.Printf("%s [%s] Error in temperatureControl loop: %s\n", cl.timestamp(), returnValue.controllerConfig.Name, returnValue.err.Error())
+	}
+
+	if (TmpLog{}) != returnValue.tmplog && cl.Telemetry != nil {
+		cl.Telemetry.PublishTelemetry(returnValue.tmplog)
+	}
+
+	//log 'em if you got 'em
+	if (TmpLog{}) != returnValue.tmplog && cl.db.db != nil {
+		err := cl.db.PersistTmpLog(returnValue.tmplog)
+		if err != nil {
+			cl.Logger.Printf("%s [%s] Error persisting log to sqlite dbo: %s", cl.timestamp(), returnValue.controllerConfig.Name, err)
+			cl.notify("We couldn't save a TmpLog to the sqlite dbo", ProblemNotification)
+		}
+	}
+
+	cl.health.iterationFinished(returnValue)
+
+	result.Sleeping = returnValue.noSchedulesAreActive
+	for _, reading := range returnValue.readings {
+		result.Readings = append(result.Readings, SensorReading{
+			ControllerSensor:  reading.ControllerSensor,
+			TemperatureInF:    reading.temperature,
+			RawTemperatureInF: reading.raw,
+			Err:               reading.err,
+		})
+	}
+	result.TemperatureInF = returnValue.temperatureInF
+	result.DesiredTemperatureInF = returnValue.desiredTemperatureInF
+	result.Decision = returnValue.decision
+	result.Hosts = returnValue.hosts
+	result.TmpLog = returnValue.tmplog
+	result.Err = returnValue.err
+	return result
+}
@@ -0,0 +1,117 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unreachableSwitch fails to switch the hosts listed in unreachable
+type unreachableSwitch struct {
+	recordingSwitch
+	unreachable map[string]bool
+}
+
+func (s *unreachableSwitch) ControlDevice(host string, action Control) error {
+	if s.unreachable[host] {
+		return errors.New("no route to host")
+	}
+	return s.recordingSwitch.ControlDevice(host, action)
+}
+
+// byName the controllers' results by controller name
+func byName(controllers []ControllerResult) map[string]ControllerResult {
+	named := make(map[string]ControllerResult, len(controllers))
+	for _, controller := range controllers {
+		named[controller.Name] = controller
+	}
+	return named
+}
+
+func TestControlLooper_Step(t *testing.T) {
+	configPath := writeTestConfig(t, `{"controllers": [
+		{"name": "fermenter", "thermometerPath": "/fermenter", "controlType": "cool", "switchHosts": ["fridge", "garage"], "temperatureSchedule": {"2024-01-01T00:00:00Z": 40}},
+		{"name": "lager", "thermometerPath": "/lager", "controlType": "cool", "switchHosts": ["keezer"], "temperatureSchedule": {"2030-01-01T00:00:00Z": 34}},
+		{"name": "crashy", "thermometerPath": "panic", "controlType": "heat", "switchHosts": ["heater"], "temperatureSchedule": {"2024-01-01T00:00:00Z": 68}}
+	]}`)
+	notifications := &syncBuffer{}
+	cg := &ConfigGopher{LocalConfigPath: configPath, ConfigFetchInterval: time.Hour, NotifyOutput: notifications}
+	switches := &unreachableSwitch{unreachable: map[string]bool{"garage": true}}
+	cl := NewControlLooper(cg, switches, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = fixedThermometer{"/fermenter": 70}
+	cl.dbFileName = filepath.Join(t.TempDir(), "tmplog.dbo")
+	clock := NewSimulatedClock(time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC))
+	cl.Clock = clock
+	ctx := context.Background()
+
+	//the first step starts up and runs every controller
+	result, err := cl.Step(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Controllers) != 3 || result.Controllers[0].Name != "fermenter" || result.Controllers[1].Name != "lager" || result.Controllers[2].Name != "crashy" {
+		t.Fatalf("expected every controller to run, in config order, got %d", len(result.Controllers))
+	}
+	controllers, alerts := byName(result.Controllers), result.Alerts
+	fermenter, lager, crashy := controllers["fermenter"], controllers["lager"], controllers["crashy"]
+	if fermenter.Name != "fermenter" || fermenter.Sleeping || fermenter.TemperatureInF != 70 || fermenter.DesiredTemperatureInF != 40 || fermenter.Decision != ControlOn {
+		t.Errorf("expected the fermenter to cool from 70 to 40, got %.2f to %.2f", fermenter.TemperatureInF, fermenter.DesiredTemperatureInF)
+	}
+	if len(fermenter.Readings) != 1 || fermenter.Readings[0].Path != "/fermenter" || fermenter.Readings[0].TemperatureInF != 70 {
+		t.Errorf("expected the fermenter's reading, got %+v", fermenter.Readings)
+	}
+	if len(fermenter.Hosts) != 2 || fermenter.Hosts[0].Err != nil || fermenter.Hosts[1].Err == nil || !errors.Is(fermenter.Err, AtLeastOneHostControlFailed) {
+		t.Errorf("expected the garage to fail and the fridge not to, got %+v, %v", fermenter.Hosts, fermenter.Err)
+	}
+	if fermenter.TmpLog.HostsPipeSeparated != "fridge" || !fermenter.TmpLog.TurningOnNotOff {
+		t.Errorf("expected the fridge to be logged, got %+v", fermenter.TmpLog)
+	}
+	if !lager.Sleeping || lager.Hosts != nil || switches.state("keezer") != 0 {
+		t.Errorf("expected the lager to sleep, got %+v", lager.Hosts)
+	}
+	if !errors.Is(crashy.Err, ErrControllerCrashed) {
+		t.Errorf("expected crashy to crash, got %v", crashy.Err)
+	}
+	if len(alerts) < 2 || !strings.Contains(alerts[0].Message, "starting up") || !strings.Contains(alerts[1].Message, "controller crashy crashed") {
+		t.Errorf("expected the startup and crash alerts, got %+v", alerts)
+	}
+
+	//nothing runs until the interval has passed, crashy's restart included
+	if result, _ = cl.Step(ctx); len(result.Controllers) != 0 || len(result.Alerts) != 0 {
+		t.Errorf("expected nothing to run, got %d controllers and %+v", len(result.Controllers), result.Alerts)
+	}
+	clock.Advance(cl.ControlInterval)
+	if result, _ = cl.Step(ctx); len(result.Controllers) != 3 || !errors.Is(result.Controllers[2].Err, ErrControllerCrashed) {
+		t.Errorf("expected every controller to run again, got %d", len(result.Controllers))
+	}
+
+	//the garage is reported once we haven't heard from it for the startup grace period
+	reported := false
+	for i := 0; i < 4 && !reported; i++ {
+		clock.Advance(cl.ControlInterval)
+		result, _ = cl.Step(ctx)
+		for _, alert := range result.Alerts {
+			reported = reported || strings.Contains(alert.Message, "still haven't heard from host garage") && alert.Urgency == ProblemNotification
+		}
+	}
+	if !reported {
+		t.Errorf("expected the garage to be reported, got %#v", notifications.String())
+	}
+
+	cl.Shutdown()
+	for _, host := range []string{"fridge", "keezer", "heater"} {
+		if state := switches.state(host); state != ControlOff {
+			t.Errorf("expected %s to be turned off on shutdown, got %s", host, state)
+		}
+	}
+	//and the next step starts over
+	if result, _ = cl.Step(ctx); len(result.Controllers) != 3 || len(result.Alerts) == 0 || !strings.Contains(result.Alerts[0].Message, "starting up") {
+		t.Errorf("expected to start over, got %d controllers and %+v", len(result.Controllers), result.Alerts)
+	}
+	cl.Shutdown()
+}
@@ -0,0 +1,326 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// controllerStuckGrace how long past its timeout an iteration may run before we declare the controller stuck
+	controllerStuckGrace = 5 * time.Second
+	// maxConsecutiveControllerTimeouts after this many iterations in a row hit their timeout, the controller is restarted
+	maxConsecutiveControllerTimeouts = 3
+)
+
+type controllerEventKind int
+
+const (
+	controllerStarted controllerEventKind = iota + 1
+	controllerFinished
+	controllerPanicked
+)
+
+// controllerEvent what an iteration of a controller reports back to the control loop
+type controllerEvent struct {
+	name       string
+	generation int
+	kind       controllerEventKind
+	at         time.Time
+	ret        temperatureControlReturn
+	timedOut   bool
+	panicValue interface{}
+}
+
+type controllerWorker struct {
+	controller Controller
+	timing     effectiveTiming
+	generation int
+	//nextRun when Step runs the controller next
+	nextRun time.Time
+	//cancel and done stop the controller's goroutine, and tell when it has, once Run has started it
+	cancel              context.CancelFunc
+	done                chan struct{}
+	runningSince        time.Time //zero when the controller is between iterations
+	consecutiveTimeouts int
+	//restarts in a row without a clean iteration in between; we only notify the server about the first one
+	restarts int
+}
+
+// controllerSupervisor runs each controller's iterations on their own goroutines, each with its own timeout, so a hung
+// thermometer or switch host only stalls its own controller. Step runs the controllers that are due and waits for them
+// (see runDue); Run gives each controller a goroutine of its own that iterates at the controller's interval (see
+// runInBackground). Either way the iterations queue what they did as events, and a controller that panics, gets stuck,
+// or keeps timing out is reported and restarted. Apart from the goroutines it starts, it's only meant to be used from
+// the control loop's goroutine
+type controllerSupervisor struct {
+	cl *ControlLooper
+	//ctx the controllers' own goroutines run under; nil until runInBackground
+	ctx context.Context
+	//pending the events queued since the last take; ready gets a value when there are some
+	mu      sync.Mutex
+	pending []controllerEvent
+	ready   chan struct{}
+	//workers by controller name, and their names in the order they're configured
+	workers map[string]*controllerWorker
+	order   []string
+	//generation is bumped for every worker we start so we can ignore events from ones we've replaced
+	generation int
+}
+
+func newControllerSupervisor(cl *ControlLooper) *controllerSupervisor {
+	return &controllerSupervisor{
+		cl:      cl,
+		ready:   make(chan struct{}, 1),
+		workers: make(map[string]*controllerWorker),
+	}
+}
+
+// reconcile starts workers for new controllers, restarts those whose config changed and stops the ones that were removed
+func (s *controllerSupervisor) reconcile(config ControllersConfig, now time.Time) {
+	configured := make(map[string]bool, len(config.Controllers))
+	s.order = s.order[:0]
+	for _, controller := range config.Controllers {
+		configured[controller.Name] = true
+		s.order = append(s.order, controller.Name)
+		timing := s.cl.timingFor(config, controller)
+		worker, ok := s.workers[controller.Name]
+		if ok && reflect.DeepEqual(worker.controller, controller) && worker.timing == timing {
+			continue
+		}
+		if ok {
+			worker.stop()
+		}
+		s.start(controller, timing, now, 0, 0)
+	}
+	for name, worker := range s.workers {
+		if !configured[name] {
+			worker.stop()
+			delete(s.workers, name)
+		}
+	}
+}
+
+// start schedules the controller's first iteration after delay, on a goroutine of its own if Run has started them
+func (s *controllerSupervisor) start(controller Controller, timing effectiveTiming, now time.Time, delay time.Duration, restarts int) {
+	s.generation++
+	worker := &controllerWorker{
+		controller: controller,
+		timing:     timing,
+		generation: s.generation,
+		nextRun:    now.Add(delay),
+		restarts:   restarts,
+	}
+	s.workers[controller.Name] = worker
+	if s.ctx != nil {
+		s.startGoroutine(worker, delay)
+	}
+}
+
+func (s *controllerSupervisor) startGoroutine(worker *controllerWorker, delay time.Duration) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	worker.cancel = cancel
+	worker.done = make(chan struct{})
+	go s.run(ctx, worker.controller, worker.timing, worker.generation, delay, worker.done)
+}
+
+// stop cancels the worker's goroutine, if it has one
+func (w *controllerWorker) stop() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// restart abandons the controller's iteration and starts it over after its interval, so a controller that crashes
+// every time doesn't spin
+func (s *controllerSupervisor) restart(name string, reason string, now time.Time) {
+	worker, ok := s.workers[name]
+	if !ok {
+		return
+	}
+	worker.stop()
+	s.start(worker.controller, worker.timing, now, worker.timing.interval, worker.restarts+1)
+	s.cl.Logger.Printf("%s [%s] Restarting the controller: %s\n", s.cl.timestamp(), name, reason)
+	if worker.restarts == 0 {
+		s.cl.notify(fmt.Sprintf("%s: controller %s %s, so we restarted it", s.cl.Cg.ClientId, name, reason), ProblemNotification)
+	}
+}
+
+// runInBackground gives every controller a goroutine of its own under ctx, which iterates at its interval until it's
+// stopped
+func (s *controllerSupervisor) runInBackground(ctx context.Context, now time.Time) {
+	s.ctx = ctx
+	for _, worker := range s.workers {
+		s.startGoroutine(worker, max(worker.nextRun.Sub(now), 0))
+	}
+}
+
+// run a controller's own goroutine: an iteration after delay and then one every interval
+func (s *controllerSupervisor) run(ctx context.Context, controller Controller, timing effectiveTiming, generation int, delay time.Duration, done chan<- struct{}) {
+	defer close(done)
+	defer s.recoverIteration(controller.Name, generation)
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.cl.Clock.After(delay):
+		}
+	}
+	ticker := s.cl.Clock.NewTicker(timing.interval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		s.iterate(ctx, controller, timing.timeout, generation)
+		select {
+		case <-ctx.Done():
+		case <-ticker.C():
+		}
+	}
+}
+
+// runDue runs an iteration of every controller that's due at now, at once, and waits for them. An iteration that's
+// still running controllerStuckGrace past its timeout is abandoned and its controller restarted; runDue returns how
+// long each of those had been running. Like each iteration's timeout, that's wall clock time: it guards against real
+// hangs, even with a SimulatedClock
+func (s *controllerSupervisor) runDue(ctx context.Context, now time.Time) map[string]time.Duration {
+	var due []*controllerWorker
+	for _, name := range s.order {
+		if worker := s.workers[name]; !worker.nextRun.After(now) {
+			due = append(due, worker)
+		}
+	}
+	finished := make([]chan struct{}, len(due))
+	started := time.Now()
+	for i, worker := range due {
+		finished[i] = make(chan struct{})
+		go func(controller Controller, timeout time.Duration, generation int, done chan<- struct{}) {
+			defer close(done)
+			defer s.recoverIteration(controller.Name, generation)
+			s.iterate(ctx, controller, timeout, generation)
+		}(worker.controller, worker.timing.timeout, worker.generation, finished[i])
+		//like a time.Ticker, we skip the iterations we fell behind on
+		worker.nextRun = worker.nextRun.Add(worker.timing.interval)
+		if !worker.nextRun.After(now) {
+			worker.nextRun = now.Add(worker.timing.interval)
+		}
+	}
+	stuck := make(map[string]time.Duration)
+	for i, worker := range due {
+		select {
+		case <-finished[i]:
+		case <-time.After(worker.timing.timeout + controllerStuckGrace - time.Since(started)):
+			running := time.Since(started)
+			s.restart(worker.controller.Name, fmt.Sprintf("has been stuck for %s", running.Round(time.Second)), now)
+			stuck[worker.controller.Name] = running
+		}
+	}
+	return stuck
+}
+
+// iterate runs one iteration of the controller, with its timeout
+func (s *controllerSupervisor) iterate(ctx context.Context, controller Controller, timeout time.Duration, generation int) {
+	s.send(controllerEvent{name: controller.Name, generation: generation, kind: controllerStarted, at: s.cl.Clock.Now()})
+	iterationCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ret := s.cl.temperatureControl(iterationCtx, &controller)
+	timedOut := errors.Is(iterationCtx.Err(), context.DeadlineExceeded)
+	s.send(controllerEvent{name: controller.Name, generation: generation, kind: controllerFinished, at: s.cl.Clock.Now(), ret: ret, timedOut: timedOut})
+}
+
+// recoverIteration reports a panicking iteration; it's deferred by the goroutines that iterate
+func (s *controllerSupervisor) recoverIteration(name string, generation int) {
+	if r := recover(); r != nil {
+		s.send(controllerEvent{name: name, generation: generation, kind: controllerPanicked, at: s.cl.Clock.Now(), panicValue: r})
+	}
+}
+
+// send queues the event for the control loop without waiting for it
+func (s *controllerSupervisor) send(event controllerEvent) {
+	s.mu.Lock()
+	s.pending = append(s.pending, event)
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the events queued since it was last called, in the order they were sent
+func (s *controllerSupervisor) take() []controllerEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.pending
+	s.pending = nil
+	return events
+}
+
+// handle returns the result of a finished iteration, if the event carried one that's still relevant. A crash is
+// reported as crashed
+func (s *controllerSupervisor) handle(event controllerEvent, now time.Time) (ret temperatureControlReturn, finished bool, crashed bool) {
+	worker, ok := s.workers[event.name]
+	if !ok || worker.generation != event.generation {
+		return temperatureControlReturn{}, false, false //an event from a controller we've replaced or removed
+	}
+	switch event.kind {
+	case controllerStarted:
+		worker.runningSince = event.at
+	case controllerFinished:
+		worker.runningSince = time.Time{}
+		if event.timedOut {
+			worker.consecutiveTimeouts++
+			s.cl.Logger.Printf("%s [%s] The iteration didn't finish within %s\n", s.cl.timestamp(), event.name, worker.timing.timeout)
+			if worker.consecutiveTimeouts >= maxConsecutiveControllerTimeouts {
+				s.restart(event.name, fmt.Sprintf("timed out %d times in a row", worker.consecutiveTimeouts), now)
+			}
+		} else {
+			worker.consecutiveTimeouts = 0
+			worker.restarts = 0
+		}
+		return event.ret, true, false
+	case controllerPanicked:
+		s.restart(event.name, fmt.Sprintf("crashed (%v)", event.panicValue), now)
+		return temperatureControlReturn{}, false, true
+	}
+	return temperatureControlReturn{}, false, false
+}
+
+// checkForStuckControllers restarts any controller whose iteration has been running well past its timeout on its own
+// goroutine, returning how long each of them had been running
+func (s *controllerSupervisor) checkForStuckControllers(now time.Time) map[string]time.Duration {
+	stuck := make(map[string]time.Duration)
+	for name, worker := range s.workers {
+		if worker.runningSince.IsZero() {
+			continue
+		}
+		if running := now.Sub(worker.runningSince); running > worker.timing.timeout+controllerStuckGrace {
+			s.restart(name, fmt.Sprintf("has been stuck for %s", running.Round(time.Second)), now)
+			stuck[name] = running
+		}
+	}
+	return stuck
+}
+
+// stopAll stops every controller's goroutine and waits up to their longest timeout for them to finish, so none of
+// them switches a host after we've started shutting down. Like each iteration's timeout, this is wall clock time: it
+// guards against real hangs, even with a SimulatedClock
+func (s *controllerSupervisor) stopAll() {
+	longestTimeout := s.cl.ControllerTimeout
+	for _, worker := range s.workers {
+		worker.stop()
+		longestTimeout = max(longestTimeout, worker.timing.timeout)
+	}
+	deadline := time.After(longestTimeout)
+	for name, worker := range s.workers {
+		if worker.done == nil {
+			continue
+		}
+		select {
+		case <-worker.done:
+		case <-deadline:
+			s.cl.Logger.Printf("%s [%s] The controller didn't stop in time\n", s.cl.timestamp(), name)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package tmpcontrol
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hangingSwitch never returns for hosts listed in hang, until the test ends
+type hangingSwitch struct {
+	recordingSwitch
+	hang    map[string]bool
+	release chan struct{}
+}
+
+func (s *hangingSwitch) ControlDevice(host string, action Control) error {
+	if s.hang[host] {
+		<-s.release
+	}
+	return s.recordingSwitch.ControlDevice(host, action)
+}
+
+type fixedThermometer map[string]float32
+
+func (f fixedThermometer) ReadTemperatureInF(path string) (float32, error) {
+	if path == "panic" {
+		panic("the thermometer exploded")
+	}
+	return f[path], nil
+}
+
+func TestControlLooper_ControllersRunIndependently(t *testing.T) {
+	configPath := writeTestConfig(t, `{"controllers": [
+		{"name": "stuck", "thermometerPath": "/a", "controlType": "cool", "switchHosts": ["10.0.0.1"], "temperatureSchedule": {"2024-01-01T00:00:00Z": 33}},
+		{"name": "healthy", "thermometerPath": "/b", "controlType": "heat", "switchHosts": ["10.0.0.2"], "temperatureSchedule": {"2024-01-01T00:00:00Z": 150}},
+		{"name": "crashy", "thermometerPath": "panic", "controlType": "heat", "switchHosts": ["10.0.0.3"], "temperatureSchedule": {"2024-01-01T00:00:00Z": 150}}
+	]}`)
+	switches := &hangingSwitch{hang: map[string]bool{"10.0.0.1": true}, release: make(chan struct{})}
+	notifications := &syncBuffer{}
+	cg := &ConfigGopher{LocalConfigPath: configPath, ConfigFetchInterval: time.Minute, NotifyOutput: notifications}
+	cl := NewControlLooper(cg, switches, log.New(io.Discard, "", 0))
+	cl.TemperatureReader = fixedThermometer{"/a": 40, "/b": 120}
+	cl.dbFileName = filepath.Join(t.TempDir(), "tmplog.dbo")
+	//every iteration of the stuck controller hangs on its host until it times out, 15 of the healthy one's intervals
+	cl.ControlInterval = 20 * time.Millisecond
+	cl.ControllerTimeout = 300 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	started := time.Now()
+	go func() {
+		done <- cl.Run(ctx)
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for !strings.Contains(notifications.String(), "stuck timed out 3 times in a row") || !strings.Contains(notifications.String(), "crashy crashed") {
+		select {
+		case <-deadline:
+			t.Fatalf("expected the stuck and crashy controllers to be restarted; notifications %#v", notifications.String())
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	//only the healthy controller's host has been switched: the stuck one's never returns and crashy never gets that far.
+	//Had it waited on the stuck controller, it would have run about once per timeout
+	elapsed := time.Since(started)
+	switches.mu.Lock()
+	calls := switches.calls
+	switches.mu.Unlock()
+	if expected := int(elapsed / cl.ControlInterval / 3); calls < expected {
+		t.Errorf("expected the healthy controller to keep running every %s, but it only switched its host %d times in %s", cl.ControlInterval, calls, elapsed)
+	}
+	if switches.state("10.0.0.2") != ControlOn {
+		t.Errorf("expected the healthy controller to turn its heater on, got %s", switches.state("10.0.0.2"))
+	}
+
+	//let the stuck host go so shutting down doesn't have to wait on it
+	close(switches.release)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
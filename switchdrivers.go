@@ -0,0 +1,179 @@
+package tmpcontrol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ErrDeviceStateUnsupported returned by a DeviceStateReader that dispatches to drivers which can't read state back
+var ErrDeviceStateUnsupported = errors.New("the driver can't read the state of its hosts")
+
+// switchHostScheme how a scheme's hosts are handed to its driver and checked during config validation
+type switchHostScheme struct {
+	//stripScheme the driver gets "192.168.1.20" for "kasa://192.168.1.20" rather than the whole host
+	stripScheme bool
+	//validate optional, checks the host as it's written in the config
+	validate func(host string) error
+}
+
+// switchHostSchemes every scheme a switch host can have. Hosts without one (a bare address, MAC or "alias:") are for
+// the default driver, which is Kasa
+var switchHostSchemes = map[string]switchHostScheme{
+	"kasa": {stripScheme: true, validate: func(host string) error {
+		if strings.TrimPrefix(host, "kasa://") == "" {
+			return errors.New("kasa:// needs the plug's address, MAC or alias after it")
+		}
+		return nil
+	}},
+	"gpio": {validate: func(host string) error {
+		_, err := parseGpioHost(host)
+		return err
+	}},
+	"http":  {validate: validateHttpSwitchHost},
+	"https": {validate: validateHttpSwitchHost},
+	"mqtt": {validate: func(host string) error {
+		_, err := parseMqttTopic(host)
+		return err
+	}},
+	"exec": {validate: func(host string) error {
+		if len(strings.Fields(strings.TrimPrefix(host, execHostPrefix))) == 0 {
+			return errors.New("exec: needs a command after it")
+		}
+		return nil
+	}},
+}
+
+func validateHttpSwitchHost(host string) error {
+	_, err := parseHttpSwitchHost(host)
+	return err
+}
+
+var switchHostSchemeRegex = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):(//)?`)
+
+var switchHostPortRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9.-]*:[0-9]+$`)
+
+// SwitchHostScheme the scheme of a switch host, e.g. "kasa" for "kasa://192.168.1.20" and "gpio" for "gpio:17".
+// Returns "" for hosts without a scheme. Unless it's a scheme we know, a host name followed by a port, like
+// "fridge-plug.local:9999", is a Kasa plug with a port; anything else before the first colon is a scheme, known or not
+func SwitchHostScheme(host string) string {
+	if macAddressRegex.MatchString(host) || strings.HasPrefix(host, kasaAliasPrefix) {
+		return ""
+	}
+	match := switchHostSchemeRegex.FindStringSubmatch(host)
+	if match == nil {
+		return ""
+	}
+	scheme := strings.ToLower(match[1])
+	if _, ok := switchHostSchemes[scheme]; !ok && switchHostPortRegex.MatchString(host) {
+		return ""
+	}
+	return scheme
+}
+
+func validateSwitchHost(host string) error {
+	scheme := SwitchHostScheme(host)
+	if scheme == "" {
+		return nil
+	}
+	s, ok := switchHostSchemes[scheme]
+	if !ok {
+		return fmt.Errorf("unknown switch host scheme %#v", scheme)
+	}
+	if s.validate != nil {
+		return s.validate(host)
+	}
+	return nil
+}
+
+// SwitchDrivers a HeatOrCoolController that dispatches each switch host to the driver registered for its scheme, so
+// one Pi can run a Kasa fridge and a GPIO heater side by side
+type SwitchDrivers struct {
+	//DefaultScheme whose driver gets the hosts without a scheme
+	DefaultScheme string
+	drivers       map[string]HeatOrCoolController
+}
+
+func NewSwitchDrivers(defaultScheme string) *SwitchDrivers {
+	return &SwitchDrivers{DefaultScheme: defaultScheme, drivers: make(map[string]HeatOrCoolController)}
+}
+
+// Register makes controller the driver of scheme's hosts, replacing any driver registered before
+func (d *SwitchDrivers) Register(scheme string, controller HeatOrCoolController) error {
+	if _, ok := switchHostSchemes[scheme]; !ok {
+		return fmt.Errorf("unknown switch host scheme %#v", scheme)
+	}
+	d.drivers[scheme] = controller
+	return nil
+}
+
+// driver returns the host's driver and the host as that driver expects it
+func (d *SwitchDrivers) driver(host string) (HeatOrCoolController, string, error) {
+	scheme := SwitchHostScheme(host)
+	driverHost := host
+	if scheme == "" {
+		scheme = d.DefaultScheme
+	} else if switchHostSchemes[scheme].stripScheme {
+		driverHost = strings.TrimPrefix(host[len(scheme):], "://")
+	}
+	driver, ok := d.drivers[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("%s: no driver is registered for %s hosts", host, scheme)
+	}
+	return driver, driverHost, nil
+}
+
+func (d *SwitchDrivers) ControlDevice(host string, action Control) error {
+	return d.ControlDeviceContext(context.Background(), host, action)
+}
+
+func (d *SwitchDrivers) ControlDeviceContext(ctx context.Context, host string, action Control) error {
+	driver, driverHost, err := d.driver(host)
+	if err != nil {
+		return err
+	}
+	return controlDevice(ctx, driver, driverHost, action)
+}
+
+func (d *SwitchDrivers) ReadDeviceState(ctx context.Context, host string) (Control, error) {
+	driver, driverHost, err := d.driver(host)
+	if err != nil {
+		return 0, err
+	}
+	reader, ok := driver.(DeviceStateReader)
+	if !ok {
+		return 0, ErrDeviceStateUnsupported
+	}
+	return reader.ReadDeviceState(ctx, driverHost)
+}
+
+// execHostPrefix switch hosts like "exec:/usr/local/bin/heater --zone 2" run the command with "on" or "off" appended
+const execHostPrefix = "exec:"
+
+// ExecController switches hosts by running the command in the host; a non-zero exit status is an error
+type ExecController struct{}
+
+func (e ExecController) ControlDevice(host string, action Control) error {
+	return e.ControlDeviceContext(context.Background(), host, action)
+}
+
+func (e ExecController) ControlDeviceContext(ctx context.Context, host string, action Control) error {
+	args := strings.Fields(strings.TrimPrefix(host, execHostPrefix))
+	if len(args) == 0 {
+		return fmt.Errorf("%#v doesn't have a command", host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, controlDeviceTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], action.String())...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", host, action, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
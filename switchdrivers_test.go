@@ -0,0 +1,93 @@
+package tmpcontrol
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSwitchHostScheme(t *testing.T) {
+	for host, expected := range map[string]string{
+		"192.168.1.20":              "",
+		"fridge-plug.local":         "",
+		"50:C7:BF:00:00:01":         "",
+		"alias:Fermentation fridge": "",
+		"kasa://192.168.1.20":       "kasa",
+		"gpio:17:low":               "gpio",
+		"HTTP://shelly.local":       "http",
+		"exec:/usr/local/bin/heat":  "exec",
+		"fridge-plug.local:9999":    "",
+		"192.168.1.20:9999":         "",
+		"zigbee://fridge":           "zigbee",
+		"zigbee:fridge":             "zigbee",
+		"shelly:plug1":              "shelly",
+	} {
+		if scheme := SwitchHostScheme(host); scheme != expected {
+			t.Errorf("%s: expected %#v, got %#v", host, expected, scheme)
+		}
+	}
+}
+
+func TestSwitchDrivers(t *testing.T) {
+	kasa := &recordingSwitch{}
+	gpio := &stickySwitch{}
+	drivers := NewSwitchDrivers("kasa")
+	if err := drivers.Register("kasa", kasa); err != nil {
+		t.Fatal(err)
+	}
+	if err := drivers.Register("gpio", gpio); err != nil {
+		t.Fatal(err)
+	}
+	if err := drivers.Register("carrier-pigeon", kasa); err == nil {
+		t.Error("expected an error registering an unknown scheme")
+	}
+
+	for _, host := range []string{"192.168.1.20", "kasa://192.168.1.21", "gpio:17"} {
+		if err := drivers.ControlDevice(host, ControlOn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kasa.state("192.168.1.20") != ControlOn || kasa.state("192.168.1.21") != ControlOn {
+		t.Errorf("expected both plugs to go to the kasa driver, without the scheme: %v", kasa.states)
+	}
+	if gpio.state("gpio:17") != ControlOn {
+		t.Errorf("expected the pin to go to the gpio driver, with its scheme: %v", gpio.states)
+	}
+
+	if state, err := drivers.ReadDeviceState(context.Background(), "gpio:17"); err != nil || state != ControlOn {
+		t.Errorf("expected to read the pin's state, got %s, %v", state, err)
+	}
+	if _, err := drivers.ReadDeviceState(context.Background(), "192.168.1.20"); !errors.Is(err, ErrDeviceStateUnsupported) {
+		t.Errorf("expected the kasa driver not to support reading state, got %v", err)
+	}
+	if err := drivers.ControlDevice("exec:/bin/true", ControlOn); err == nil {
+		t.Error("expected an error for a scheme without a registered driver")
+	}
+}
+
+func TestValidateConfig_SwitchHostSchemes(t *testing.T) {
+	config := ControllersConfig{Controllers: []Controller{{
+		Name:            "fridge",
+		ThermometerPath: "/tmp/t",
+		ControlType:     "cool",
+		SwitchHosts:     []string{"192.168.1.20", "fridge-plug.local:9999", "192.168.1.20:9999", "gpio:17:low", "kasa://", "gpio:seventeen", "zigbee://fridge", "zigbee:x"},
+	}}}
+	var paths []string
+	for _, err := range validateConfigSemantics(config) {
+		paths = append(paths, err.Path)
+	}
+	expected := "/controllers/0/switchHosts/4 /controllers/0/switchHosts/5 /controllers/0/switchHosts/6 /controllers/0/switchHosts/7"
+	if strings.Join(paths, " ") != expected {
+		t.Errorf("expected errors at %s, got %s", expected, strings.Join(paths, " "))
+	}
+}
+
+func TestExecController(t *testing.T) {
+	if err := (ExecController{}).ControlDevice("exec:true", ControlOn); err != nil {
+		t.Error(err)
+	}
+	if err := (ExecController{}).ControlDevice("exec:false", ControlOff); err == nil {
+		t.Error("expected an error for a command that fails")
+	}
+}
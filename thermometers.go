@@ -0,0 +1,349 @@
+package tmpcontrol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// thermometerScheme how a scheme's thermometer paths are handed to its reader and checked during config validation
+type thermometerScheme struct {
+	//stripScheme the reader gets "/tmp/fridge" for "file:/tmp/fridge" rather than the whole path
+	stripScheme bool
+	//validate optional, checks the path as it's written in the config
+	validate func(path string) error
+}
+
+// thermometerSchemes every scheme a thermometer path can have. Paths without one, like
+// "/sys/bus/w1/devices/28-0000000000/temperature", are for the default reader, which is the DS18B20's
+var thermometerSchemes = map[string]thermometerScheme{
+	"w1": {stripScheme: true, validate: func(path string) error {
+		if strings.TrimPrefix(path, "w1:") == "" {
+			return errors.New("w1: needs the sensor's ID or path after it, e.g. w1:28-0000000000")
+		}
+		return nil
+	}},
+	"file": {stripScheme: true, validate: func(path string) error {
+		if strings.TrimPrefix(strings.TrimPrefix(path, "file:"), "//") == "" {
+			return errors.New("file: needs a path after it")
+		}
+		return nil
+	}},
+	"i2c-bme280": {validate: validateI2cThermometerPath},
+	"i2c-sht3x":  {validate: validateI2cThermometerPath},
+	"http":       {validate: validateHttpThermometerPath},
+	"https":      {validate: validateHttpThermometerPath},
+	"mqtt": {validate: func(path string) error {
+		_, err := parseMqttTopic(path)
+		return err
+	}},
+	"tilt": {validate: func(path string) error {
+		color := strings.TrimPrefix(strings.ToLower(path), "tilt:")
+		for _, known := range tiltColors {
+			if color == known {
+				return nil
+			}
+		}
+		return fmt.Errorf("%#v should be a Tilt's color, like tilt:red", path)
+	}},
+	"ispindel": {validate: func(path string) error {
+		if len(path) == len("ispindel:") {
+			return errors.New("ispindel: needs the iSpindel's name after it")
+		}
+		return nil
+	}},
+}
+
+func validateI2cThermometerPath(path string) error {
+	_, err := parseI2cThermometerPath(path)
+	return err
+}
+
+func validateHttpThermometerPath(path string) error {
+	_, _, err := parseHttpThermometerPath(path)
+	return err
+}
+
+// ThermometerScheme the scheme of a thermometer path, e.g. "w1" for "w1:28-0000000000" and "i2c-bme280" for
+// "i2c-bme280:1:0x76". Returns "" for paths without a scheme
+func ThermometerScheme(path string) string {
+	match := switchHostSchemeRegex.FindStringSubmatch(path)
+	if match == nil {
+		return ""
+	}
+	return strings.ToLower(match[1])
+}
+
+func validateThermometerPath(path string) error {
+	scheme := ThermometerScheme(path)
+	if scheme == "" {
+		return nil
+	}
+	s, ok := thermometerSchemes[scheme]
+	if !ok {
+		return fmt.Errorf("unknown thermometer scheme %#v", scheme)
+	}
+	if s.validate != nil {
+		return s.validate(path)
+	}
+	return nil
+}
+
+// TemperatureReaders a TemperatureReader that hands each thermometer path to the reader registered for its scheme, so
+// each controller can use whichever kind of sensor it has
+type TemperatureReaders struct {
+	//DefaultScheme whose reader gets the paths without a scheme
+	DefaultScheme string
+	readers       map[string]TemperatureReader
+}
+
+func NewTemperatureReaders(defaultScheme string) *TemperatureReaders {
+	return &TemperatureReaders{DefaultScheme: defaultScheme, readers: make(map[string]TemperatureReader)}
+}
+
+// DefaultTemperatureReaders DS18B20s for paths without a scheme and w1:, and every other reader that doesn't need
+// configuring: file:, http:, https:, i2c-bme280: and i2c-sht3x:
+func DefaultTemperatureReaders(logger Logger) *TemperatureReaders {
+	readers := NewTemperatureReaders("w1")
+	_ = readers.Register("w1", NewDS18B20Reader(logger))
+	_ = readers.Register("file", FileTemperatureReader{})
+	httpReader := &HttpTemperatureReader{}
+	_ = readers.Register("http", httpReader)
+	_ = readers.Register("https", httpReader)
+	i2cReader := NewI2cThermometerReader()
+	_ = readers.Register("i2c-bme280", i2cReader)
+	_ = readers.Register("i2c-sht3x", i2cReader)
+	return readers
+}
+
+// Register makes reader the reader of scheme's paths, replacing any reader registered before
+func (r *TemperatureReaders) Register(scheme string, reader TemperatureReader) error {
+	if _, ok := thermometerSchemes[scheme]; !ok {
+		return fmt.Errorf("unknown thermometer scheme %#v", scheme)
+	}
+	r.readers[scheme] = reader
+	return nil
+}
+
+// reader returns the path's reader and the path as that reader expects it
+func (r *TemperatureReaders) reader(path string) (TemperatureReader, string, error) {
+	scheme := ThermometerScheme(path)
+	readerPath := path
+	if scheme == "" {
+		scheme = r.DefaultScheme
+	} else if thermometerSchemes[scheme].stripScheme {
+		readerPath = strings.TrimPrefix(path[len(scheme)+1:], "//")
+	}
+	reader, ok := r.readers[scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("%s: no reader is registered for %s thermometers", path, scheme)
+	}
+	return reader, readerPath, nil
+}
+
+func (r *TemperatureReaders) ReadTemperatureInF(connectionString string) (float32, error) {
+	return r.ReadTemperatureInFContext(context.Background(), connectionString)
+}
+
+func (r *TemperatureReaders) ReadTemperatureInFContext(ctx context.Context, connectionString string) (float32, error) {
+	reader, readerPath, err := r.reader(connectionString)
+	if err != nil {
+		return 0, err
+	}
+	return readTemperature(ctx, reader, readerPath)
+}
+
+// ReadSpecificGravity asks the path's reader, if it measures gravity
+func (r *TemperatureReaders) ReadSpecificGravity(connectionString string) (float64, bool) {
+	reader, readerPath, err := r.reader(connectionString)
+	if err != nil {
+		return 0, false
+	}
+	if gravityReader, ok := reader.(SpecificGravityReader); ok {
+		return gravityReader.ReadSpecificGravity(readerPath)
+	}
+	return 0, false
+}
+
+// ReadResolution asks the path's reader, if it knows
+func (r *TemperatureReaders) ReadResolution(connectionString string) (int, bool) {
+	reader, readerPath, err := r.reader(connectionString)
+	if err != nil {
+		return 0, false
+	}
+	if resolutionReader, ok := reader.(SensorResolutionReader); ok {
+		return resolutionReader.ReadResolution(readerPath)
+	}
+	return 0, false
+}
+
+// FileTemperatureReader reads a file holding a temperature, like "68.5" or "20.1C", or a JSON object with a
+// "temperature" field, see parseTemperaturePayload. Handy for tests, and for sensors another program reads
+type FileTemperatureReader struct{}
+
+func (FileTemperatureReader) ReadTemperatureInF(path string) (float32, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	temperature, err := parseTemperaturePayload(content, temperatureField{})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return temperature, nil
+}
+
+// HttpTemperatureReader GETs a thermometer path like "http://tiltbridge.local/json#Temp:F", for sensors behind an HTTP
+// bridge. The fragment picks the JSON field and its unit, see parseTemperatureField; without one the response is read
+// like a FileTemperatureReader's file
+type HttpTemperatureReader struct {
+	//Client defaults to http.DefaultClient; calls are bounded by controlDeviceTimeout either way
+	Client *http.Client
+}
+
+func parseHttpThermometerPath(path string) (*url.URL, temperatureField, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, temperatureField{}, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, temperatureField{}, fmt.Errorf("%#v should look like http://tiltbridge.local/json#Temp:F", u.Redacted())
+	}
+	field, err := parseTemperatureField(u.Fragment)
+	if err != nil {
+		return nil, temperatureField{}, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	u.Fragment = ""
+	return u, field, nil
+}
+
+func (h *HttpTemperatureReader) ReadTemperatureInF(connectionString string) (float32, error) {
+	return h.ReadTemperatureInFContext(context.Background(), connectionString)
+}
+
+func (h *HttpTemperatureReader) ReadTemperatureInFContext(ctx context.Context, connectionString string) (float32, error) {
+	u, field, err := parseHttpThermometerPath(connectionString)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, controlDeviceTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return 0, fmt.Errorf("%s answered %s", u.Redacted(), response.Status)
+	}
+	temperature, err := parseTemperaturePayload(body, field)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	return temperature, nil
+}
+
+// temperatureField where the temperature is in a JSON payload, and its unit ("C" or "F") when the payload doesn't say.
+// The zero value is a "temperature" field, see parseTemperaturePayload
+type temperatureField struct {
+	//path dotted, e.g. "DS18B20.Temperature"
+	path string
+	unit string
+}
+
+// parseTemperatureField parses "Temp", "Temp:F" or "DS18B20.Temperature:C"
+func parseTemperatureField(s string) (temperatureField, error) {
+	path, unit, hasUnit := strings.Cut(s, ":")
+	unit = strings.ToUpper(strings.TrimPrefix(unit, "°"))
+	if hasUnit && unit != "C" && unit != "F" {
+		return temperatureField{}, fmt.Errorf("%#v: the unit after the field should be C or F", s)
+	}
+	return temperatureField{path: path, unit: unit}, nil
+}
+
+var temperatureTextRegex = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?)\s*(°?[cCfF])?$`)
+
+// parseTemperaturePayload reads a number, in Fahrenheit unless it ends in C (e.g. "20.5C" or "20.5 °C"), or a JSON
+// object with the field's temperature ("temperature" if the field has no path). The JSON temperature is in the field's
+// unit if it has one, otherwise a "unit", "temperature_unit" or "TempUnit" field says which, otherwise it's Celsius, as
+// zigbee2mqtt and Tasmota publish it
+func parseTemperaturePayload(payload []byte, field temperatureField) (float32, error) {
+	text := strings.TrimSpace(string(payload))
+	var temperature float64
+	celsius := false
+	if match := temperatureTextRegex.FindStringSubmatch(text); match != nil && field.path == "" {
+		temperature, _ = strconv.ParseFloat(match[1], 64)
+		celsius = strings.EqualFold(strings.TrimPrefix(match[2], "°"), "c")
+	} else {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return 0, fmt.Errorf("%#v isn't a temperature or a JSON object", text)
+		}
+		var ok bool
+		if field.path == "" {
+			for _, name := range []string{"temperature", "Temperature"} {
+				if temperature, ok = fields[name].(float64); ok {
+					break
+				}
+			}
+		} else {
+			temperature, ok = jsonNumberAt(fields, field.path)
+		}
+		if !ok {
+			name := field.path
+			if name == "" {
+				name = "temperature"
+			}
+			return 0, fmt.Errorf("the JSON doesn't have a numeric %s field", name)
+		}
+		celsius = field.unit != "F"
+		if field.unit == "" {
+			for _, name := range []string{"unit", "temperature_unit", "TempUnit"} {
+				if unit, ok := fields[name].(string); ok {
+					celsius = !strings.EqualFold(strings.TrimPrefix(unit, "°"), "f")
+				}
+			}
+		}
+	}
+	if celsius {
+		temperature = temperature*9/5 + 32
+	}
+	if temperature < minValidFahrenheitTemperature || temperature > maxValidFahrenheitTemperature {
+		return 0, fmt.Errorf("%.2f°F is outside of the valid range", temperature)
+	}
+	return float32(temperature), nil
+}
+
+// jsonNumberAt the number at a dotted path like "DS18B20.Temperature"
+func jsonNumberAt(fields map[string]interface{}, path string) (float64, bool) {
+	name, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		number, ok := fields[name].(float64)
+		return number, ok
+	}
+	inner, ok := fields[name].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	return jsonNumberAt(inner, rest)
+}
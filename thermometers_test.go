@@ -0,0 +1,120 @@
+package tmpcontrol
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThermometerScheme(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/sys/bus/w1/devices/28-0000000000/temperature": "",
+		"w1:28-0000000000":             "w1",
+		"file:/tmp/fridge":             "file",
+		"i2c-bme280:1:0x76":            "i2c-bme280",
+		"HTTP://tiltbridge.local/json": "http",
+		"mqtt:zigbee2mqtt/fridge":      "mqtt",
+	} {
+		if scheme := ThermometerScheme(path); scheme != expected {
+			t.Errorf("%s: expected %#v, got %#v", path, expected, scheme)
+		}
+	}
+}
+
+func TestTemperatureReaders(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "fridge"), []byte("20C\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readers := NewTemperatureReaders("w1")
+	if err := readers.Register("w1", fixedThermometer{"/sys/bus/w1/devices/28-1/temperature": 70, "28-2": 71}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readers.Register("file", FileTemperatureReader{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := readers.Register("thermocouple", FileTemperatureReader{}); err == nil {
+		t.Error("expected an error registering an unknown scheme")
+	}
+
+	for path, expected := range map[string]float32{
+		"/sys/bus/w1/devices/28-1/temperature":   70,
+		"w1:28-2":                                71,
+		"file:" + filepath.Join(dir, "fridge"):   68,
+		"file://" + filepath.Join(dir, "fridge"): 68,
+	} {
+		if temperature, err := readers.ReadTemperatureInF(path); err != nil || temperature != expected {
+			t.Errorf("%s: expected %.2f, got %.2f, %v", path, expected, temperature, err)
+		}
+	}
+	if _, err := readers.ReadTemperatureInF("i2c-sht3x:1"); err == nil {
+		t.Error("expected an error for a scheme without a registered reader")
+	}
+}
+
+func TestHttpTemperatureReader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tilt":
+			fmt.Fprint(w, `{"Color":"Red","Temp":68.5,"SG":1.012}`)
+		case "/tasmota":
+			fmt.Fprint(w, `{"StatusSNS":{"DS18B20":{"Temperature":20}},"TempUnit":"C"}`)
+		case "/plain":
+			fmt.Fprint(w, "66.25\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	reader := &HttpTemperatureReader{}
+	for path, expected := range map[string]float32{
+		server.URL + "/tilt#Temp:F":                           68.5,
+		server.URL + "/tasmota#StatusSNS.DS18B20.Temperature": 68,
+		server.URL + "/plain":                                 66.25,
+	} {
+		if temperature, err := reader.ReadTemperatureInF(path); err != nil || temperature != expected {
+			t.Errorf("%s: expected %.2f, got %.2f, %v", path, expected, temperature, err)
+		}
+	}
+	for _, path := range []string{server.URL + "/tilt#Gravity:F", server.URL + "/missing", server.URL + "/tilt#Temp:K"} {
+		if _, err := reader.ReadTemperatureInF(path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestParseTemperaturePayload(t *testing.T) {
+	for payload, expected := range map[string]float32{
+		"68.5":                              68.5,
+		"20C":                               68,
+		"20.0 °C":                           68,
+		"-4F":                               -4,
+		`{"temperature":25}`:                77,
+		`{"Temperature":77,"TempUnit":"F"}`: 77,
+		`{"temperature":77,"unit":"°F"}`:    77,
+		`{"temperature":0,"battery":100}`:   32,
+	} {
+		if temperature, err := parseTemperaturePayload([]byte(payload), temperatureField{}); err != nil || temperature != expected {
+			t.Errorf("%s: expected %.2f, got %.2f, %v", payload, expected, temperature, err)
+		}
+	}
+	for _, payload := range []string{"", "warm", `{"humidity":50}`, "500"} {
+		if _, err := parseTemperaturePayload([]byte(payload), temperatureField{}); err == nil {
+			t.Errorf("%#v: expected an error", payload)
+		}
+	}
+}
+
+func TestValidateConfig_ThermometerPaths(t *testing.T) {
+	config := ControllersConfig{}
+	for i, path := range []string{"/sys/bus/w1/devices/28-1/temperature", "i2c-bme280:1:0x77", "w1:", "i2c-sht3x:one", "thermocouple:1", "zigbee:fridge"} {
+		config.Controllers = append(config.Controllers, Controller{Name: fmt.Sprintf("controller-%d", i), ThermometerPath: path, ControlType: "heat"})
+	}
+	errs := validateConfigSemantics(config)
+	if len(errs) != 4 || errs[0].Path != "/controllers/2/thermometerPath" || errs[1].Path != "/controllers/3/thermometerPath" || errs[2].Path != "/controllers/4/thermometerPath" || errs[3].Path != "/controllers/5/thermometerPath" {
+		t.Errorf("unexpected errors: %s", errs)
+	}
+}
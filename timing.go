@@ -0,0 +1,152 @@
+package tmpcontrol
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration a time.Duration written in config files as a string like "90s" or "5m", or as a number of seconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("a duration must be a string like \"90s\" or a number of seconds: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ControlTiming cadence and alert thresholds that can be set for the whole config and overridden per controller. A
+// zero value inherits from the config, and then from the ControlLooper
+type ControlTiming struct {
+	//Interval how often the controller reads its thermometer and switches its hosts
+	Interval Duration `json:"interval,omitempty"`
+	//Timeout how long one iteration may take before we give up on it
+	Timeout Duration `json:"timeout,omitempty"`
+	//TempReadAlertAfter how long the thermometer may fail before we notify the server
+	TempReadAlertAfter Duration `json:"tempReadAlertAfter,omitempty"`
+	//SwitchHostAlertAfter how long a switch host may be unreachable before we notify the server
+	SwitchHostAlertAfter Duration `json:"switchHostAlertAfter,omitempty"`
+	//StartupGracePeriod how long after starting we wait before worrying about switch hosts we've never reached
+	StartupGracePeriod Duration `json:"startupGracePeriod,omitempty"`
+}
+
+const (
+	defaultControlInterval       = 15 * time.Second
+	defaultControllerTimeout     = 12 * time.Second
+	defaultSwitchHostAlertAfter  = 5 * time.Minute
+	defaultConfigFetchAlertAfter = 15 * time.Minute
+	defaultTempReadAlertAfter    = 1 * time.Minute
+	defaultStartupGracePeriod    = 1 * time.Minute
+	minControlInterval           = time.Second
+)
+
+// effectiveTiming a ControlTiming with every value resolved
+type effectiveTiming struct {
+	interval             time.Duration
+	timeout              time.Duration
+	tempReadAlertAfter   time.Duration
+	switchHostAlertAfter time.Duration
+	startupGracePeriod   time.Duration
+}
+
+// timingFor resolves the timing of a controller: its own overrides, then the config's, then the ControlLooper's
+func (cl *ControlLooper) timingFor(config ControllersConfig, controller Controller) effectiveTiming {
+	t := effectiveTiming{
+		interval:             cl.ControlInterval,
+		timeout:              cl.ControllerTimeout,
+		tempReadAlertAfter:   cl.TempReadAlertAfter,
+		switchHostAlertAfter: cl.SwitchHostAlertAfter,
+		startupGracePeriod:   cl.StartupGracePeriod,
+	}
+	t.apply(config.Timing)
+	t.apply(controller.Timing)
+	return t
+}
+
+func (t *effectiveTiming) apply(overrides *ControlTiming) {
+	if overrides == nil {
+		return
+	}
+	for _, o := range []struct {
+		override Duration
+		target   *time.Duration
+	}{
+		{overrides.Interval, &t.interval},
+		{overrides.Timeout, &t.timeout},
+		{overrides.TempReadAlertAfter, &t.tempReadAlertAfter},
+		{overrides.SwitchHostAlertAfter, &t.switchHostAlertAfter},
+		{overrides.StartupGracePeriod, &t.startupGracePeriod},
+	} {
+		if o.override > 0 {
+			*o.target = time.Duration(o.override)
+		}
+	}
+}
+
+// configFetchAlertAfter the config's threshold if it has one, otherwise the ControlLooper's
+func (cl *ControlLooper) configFetchAlertAfter(config ControllersConfig) time.Duration {
+	if config.ConfigFetchAlertAfter > 0 {
+		return time.Duration(config.ConfigFetchAlertAfter)
+	}
+	return cl.ConfigFetchAlertAfter
+}
+
+// hostTimings a switch host can belong to several controllers; it's held to the strictest of their thresholds
+func (cl *ControlLooper) hostTimings(config ControllersConfig) map[string]effectiveTiming {
+	timings := make(map[string]effectiveTiming)
+	for _, controller := range config.Controllers {
+		controllerTiming := cl.timingFor(config, controller)
+		for _, host := range controller.SwitchHosts {
+			timing, ok := timings[host]
+			if !ok {
+				timings[host] = controllerTiming
+				continue
+			}
+			timing.switchHostAlertAfter = min(timing.switchHostAlertAfter, controllerTiming.switchHostAlertAfter)
+			timing.startupGracePeriod = min(timing.startupGracePeriod, controllerTiming.startupGracePeriod)
+			timings[host] = timing
+		}
+	}
+	return timings
+}
+
+func validateControlTiming(path string, timing *ControlTiming) ConfigErrors {
+	if timing == nil {
+		return nil
+	}
+	var errs ConfigErrors
+	for _, field := range []struct {
+		name  string
+		value Duration
+	}{
+		{"interval", timing.Interval},
+		{"timeout", timing.Timeout},
+		{"tempReadAlertAfter", timing.TempReadAlertAfter},
+		{"switchHostAlertAfter", timing.SwitchHostAlertAfter},
+		{"startupGracePeriod", timing.StartupGracePeriod},
+	} {
+		if field.value < 0 {
+			errs = append(errs, ConfigError{Path: path + "/" + field.name, Message: fmt.Sprintf("%s can't be negative", field.name)})
+		}
+	}
+	if timing.Interval > 0 && time.Duration(timing.Interval) < minControlInterval {
+		errs = append(errs, ConfigError{Path: path + "/interval", Message: fmt.Sprintf("interval must be at least %s", minControlInterval)})
+	}
+	return errs
+}
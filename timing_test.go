@@ -0,0 +1,79 @@
+package tmpcontrol
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDuration_UnmarshalJSON(t *testing.T) {
+	var timing ControlTiming
+	if err := json.Unmarshal([]byte(`{"interval": "90s", "timeout": 5, "tempReadAlertAfter": 0.5}`), &timing); err != nil {
+		t.Fatal(err)
+	}
+	if timing.Interval != Duration(90*time.Second) || timing.Timeout != Duration(5*time.Second) || timing.TempReadAlertAfter != Duration(500*time.Millisecond) {
+		t.Errorf("unexpected timing: %+v", timing)
+	}
+	if err := json.Unmarshal([]byte(`{"interval": "soon"}`), &timing); err == nil {
+		t.Error("expected an error for an unparseable duration")
+	}
+	b, err := json.Marshal(ControlTiming{Interval: Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"interval":"1m0s"}` {
+		t.Errorf("unexpected json: %s", b)
+	}
+}
+
+func TestControlLooper_timingFor(t *testing.T) {
+	cl := NewControlLooper(&ConfigGopher{}, nil, log.New(os.Stdout, "", 0))
+	cl.ControlInterval = 20 * time.Second
+	config := ControllersConfig{
+		Timing: &ControlTiming{Interval: Duration(30 * time.Second), SwitchHostAlertAfter: Duration(10 * time.Minute)},
+		Controllers: []Controller{
+			{Name: "fermenter", SwitchHosts: []string{"shared", "a"}, Timing: &ControlTiming{Interval: Duration(time.Minute), SwitchHostAlertAfter: Duration(2 * time.Minute)}},
+			{Name: "kegerator", SwitchHosts: []string{"shared", "b"}},
+		},
+	}
+
+	fermenter := cl.timingFor(config, config.Controllers[0])
+	if fermenter.interval != time.Minute || fermenter.switchHostAlertAfter != 2*time.Minute || fermenter.timeout != defaultControllerTimeout {
+		t.Errorf("expected the controller's overrides on top of the defaults, got %+v", fermenter)
+	}
+	kegerator := cl.timingFor(config, config.Controllers[1])
+	if kegerator.interval != 30*time.Second || kegerator.switchHostAlertAfter != 10*time.Minute {
+		t.Errorf("expected the config's overrides, got %+v", kegerator)
+	}
+	if cl.timingFor(ControllersConfig{}, Controller{}).interval != 20*time.Second {
+		t.Error("expected the ControlLooper's interval without any overrides")
+	}
+
+	hosts := cl.hostTimings(config)
+	if hosts["shared"].switchHostAlertAfter != 2*time.Minute || hosts["b"].switchHostAlertAfter != 10*time.Minute {
+		t.Errorf("expected a shared host to get the strictest threshold, got %+v", hosts)
+	}
+}
+
+func TestValidateConfig_Timing(t *testing.T) {
+	config := ControllersConfig{
+		Timing: &ControlTiming{Interval: Duration(100 * time.Millisecond)},
+		Controllers: []Controller{
+			{Name: "fridge", ThermometerPath: "/tmp/t", ControlType: "cool", Timing: &ControlTiming{TempReadAlertAfter: Duration(-time.Second)}},
+		},
+	}
+	errs := validateConfigSemantics(config)
+	if len(errs) != 2 || errs[0].Path != "/timing/interval" || errs[1].Path != "/controllers/0/timing/tempReadAlertAfter" {
+		t.Errorf("unexpected errors: %s", errs)
+	}
+
+	content := `{"timing": {"interval": "1m", "timeout": 10}, "controllers": [
+  {"name": "fridge", "thermometerPath": "/tmp/t", "controlType": "cool", "timing": {"interval": "often"}}
+]}`
+	errs = ValidateConfigFile("config.json", []byte(content))
+	if len(errs) != 1 || errs[0].Path != "/controllers/0/timing/interval" || errs[0].Line != 2 {
+		t.Errorf("expected a single error for the bad duration, got %s", errs)
+	}
+}
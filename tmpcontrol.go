@@ -20,6 +20,8 @@ type ConfigSource int
 const (
 	ConfigSourceLocalFile ConfigSource = iota + 1
 	ConfigSourceServer
+	// ConfigSourceLayered the server config with a local file applied on top of it
+	ConfigSourceLayered
 )
 
 func (c ConfigSource) String() string {
@@ -28,14 +30,19 @@ func (c ConfigSource) String() string {
 		return "local file"
 	case ConfigSourceServer:
 		return "server"
+	case ConfigSourceLayered:
+		return "server with local overrides"
 	default:
 		panic(fmt.Sprintf("Unknown config source: %#v", c))
 	}
-	return ""
 }
 
 type ControllersConfig struct {
 	Controllers []Controller `json:"controllers"`
+	//Timing defaults for every controller, see ControlTiming
+	Timing *ControlTiming `json:"timing,omitempty"`
+	//ConfigFetchAlertAfter how long fetching config may fail before we notify the server
+	ConfigFetchAlertAfter Duration `json:"configFetchAlertAfter,omitempty"`
 }
 
 type Controller struct {
@@ -45,6 +52,13 @@ type Controller struct {
 	SwitchHosts             []string              `json:"switchHosts"`
 	TemperatureSchedule     map[time.Time]float32 `json:"temperatureSchedule"`
 	DisableFreezeProtection bool                  `json:"disableFreezeProtection"`
+	Timing                  *ControlTiming        `json:"timing,omitempty"`
+	//Calibration and Filter correct the ThermometerPath's readings, like a ControllerSensor's
+	Calibration *SensorCalibration `json:"calibration,omitempty"`
+	Filter      *SensorFilter      `json:"filter,omitempty"`
+	//Sensors and SensorPolicy replace ThermometerPath for controllers with more than one thermometer
+	Sensors      []ControllerSensor `json:"sensors,omitempty"`
+	SensorPolicy *SensorPolicy      `json:"sensorPolicy,omitempty"`
 }
 
 type Control int
@@ -72,8 +86,55 @@ type HeatOrCoolController interface {
 	ControlDevice(host string, action Control) error
 }
 
+// ContextHeatOrCoolController optionally implemented by a HeatOrCoolController that can give up when ctx is done
+type ContextHeatOrCoolController interface {
+	ControlDeviceContext(ctx context.Context, host string, action Control) error
+}
+
+// controlDevice returns as soon as ctx is done. If the controller doesn't take a context, the call is left running in
+// the background and its result is discarded
+func controlDevice(ctx context.Context, controller HeatOrCoolController, host string, action Control) error {
+	if controller == nil {
+		panic("HeatOrCoolController is nil")
+	}
+	if c, ok := controller.(ContextHeatOrCoolController); ok {
+		return c.ControlDeviceContext(ctx, host, action)
+	}
+	type outcome struct {
+		err        error
+		panicValue interface{}
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		//a panic is handed back to our caller's goroutine, where the controllerSupervisor can recover it
+		defer func() {
+			if r := recover(); r != nil {
+				done <- outcome{panicValue: r}
+			}
+		}()
+		done <- outcome{err: controller.ControlDevice(host, action)}
+	}()
+	select {
+	case o := <-done:
+		if o.panicValue != nil {
+			panic(o.panicValue)
+		}
+		return o.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stdTimestampLayout how we timestamp log lines and notifications
+const stdTimestampLayout = "2006-01-02 15:04:05"
+
 func stdTimestamp() string {
-	return time.Now().Format("2006-01-02 15:04:05")
+	return time.Now().Format(stdTimestampLayout)
+}
+
+// timestamp like stdTimestamp, by the looper's Clock
+func (cl *ControlLooper) timestamp() string {
+	return cl.Clock.Now().Format(stdTimestampLayout)
 }
 
 type Logger interface {
@@ -88,6 +149,14 @@ type TmpLog struct {
 	IsHeatingNotCooling   bool
 	TurningOnNotOff       bool
 	HostsPipeSeparated    string
+	//DeviceStateDiscrepancies hosts that weren't in the state we commanded, see DeviceStateReader
+	DeviceStateDiscrepancies string
+	//SpecificGravity 0 unless the thermometer is a hydrometer, see SpecificGravityReader
+	SpecificGravity float64
+	//RawTemperatureInF TemperatureInF before the sensors' calibration and filters, see ControllerSensor
+	RawTemperatureInF float32
+	//SensorReadings every sensor of a controller with Sensors, e.g. "beer w1:28-1 66.20|chamber w1:28-2 error"
+	SensorReadings string
 
 	//these should be left blank unless we get this from the local dbo
 	DbAutoId            int
@@ -102,241 +171,157 @@ type TemperatureReader interface {
 	ReadTemperatureInF(connectionString string) (float32, error)
 }
 
+// ContextTemperatureReader optionally implemented by a TemperatureReader that can give up when ctx is done
+type ContextTemperatureReader interface {
+	ReadTemperatureInFContext(ctx context.Context, connectionString string) (float32, error)
+}
+
+// readTemperature returns as soon as ctx is done, see controlDevice
+func readTemperature(ctx context.Context, reader TemperatureReader, connectionString string) (float32, error) {
+	if r, ok := reader.(ContextTemperatureReader); ok {
+		return r.ReadTemperatureInFContext(ctx, connectionString)
+	}
+	type reading struct {
+		temperature float32
+		err         error
+		panicValue  interface{}
+	}
+	done := make(chan reading, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- reading{panicValue: r}
+			}
+		}()
+		temperature, err := reader.ReadTemperatureInF(connectionString)
+		done <- reading{temperature: temperature, err: err}
+	}()
+	select {
+	case r := <-done:
+		if r.panicValue != nil {
+			panic(r.panicValue)
+		}
+		return r.temperature, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
 type ControlLooper struct {
 	Cg                   *ConfigGopher
 	HeatOrCoolController HeatOrCoolController
 	TemperatureReader    TemperatureReader
 	dbFileName           string
 	Logger               Logger
+	//ShutdownState every configured switch host is driven to this state when the control loop stops. Defaults to ControlOff
+	ShutdownState Control
+	//ControlInterval how often each controller reads its thermometer and switches its hosts
+	ControlInterval time.Duration
+	//ControllerTimeout how long one iteration of a controller may take before we give up on it
+	ControllerTimeout time.Duration
+	//ConfigFetchAlertAfter, TempReadAlertAfter and SwitchHostAlertAfter how long each may fail before we notify the server
+	ConfigFetchAlertAfter time.Duration
+	TempReadAlertAfter    time.Duration
+	SwitchHostAlertAfter  time.Duration
+	//StartupGracePeriod how long after starting we wait before worrying about switch hosts we've never reached
+	StartupGracePeriod time.Duration
+	//the timing of the controllers and the config can override these, see ControlTiming
+
+	//Telemetry and SetpointOverrides are optional, see MqttBridge
+	Telemetry         TelemetryPublisher
+	SetpointOverrides SetpointOverrider
+	//Clock what time the controllers think it is. Defaults to the system clock, see SimulatedClock
+	Clock Clock
+
+	deviceStates        deviceStateTracker
+	sensorDisagreements sensorDisagreementTracker
+	sensorFilters       sensorFilterTracker
+	sensorHealth        sensorHealthTracker
+
+	//what Step carries from one iteration to the next. The first Step sets it up and Shutdown tears it down
+	started      bool
+	config       ControllersConfig
+	configSource ConfigSource
+	health       *loopHealth
+	supervisor   *controllerSupervisor
+	db           SqliteClientDb
+	alerts       alertCollector
 }
 
 func NewControlLooper(cg *ConfigGopher, HeatOrCoolController HeatOrCoolController, logger Logger) *ControlLooper {
 	//TODO maybe we can find the kasa path, test it, and suggest the user how to get it if they don't have it. Of course, it's not necessary if they want to supply a controlFunc
-	tmpReader := NewDS18B20Reader(logger)
 	cl := ControlLooper{
-		Cg:                   cg,
-		HeatOrCoolController: HeatOrCoolController,
-		TemperatureReader:    tmpReader,
-		dbFileName:           "tmplog.dbo",
-		Logger:               logger,
+		Cg:                    cg,
+		HeatOrCoolController:  HeatOrCoolController,
+		TemperatureReader:     DefaultTemperatureReaders(logger),
+		dbFileName:            defaultDbFileName,
+		Logger:                logger,
+		ShutdownState:         ControlOff,
+		ControlInterval:       defaultControlInterval,
+		ControllerTimeout:     defaultControllerTimeout,
+		ConfigFetchAlertAfter: defaultConfigFetchAlertAfter,
+		TempReadAlertAfter:    defaultTempReadAlertAfter,
+		SwitchHostAlertAfter:  defaultSwitchHostAlertAfter,
+		StartupGracePeriod:    defaultStartupGracePeriod,
+		Clock:                 systemClock{},
 	}
 	return &cl
 }
 
-func (cl *ControlLooper) StartControlLoop() {
-	var lastConfigFetched time.Time
-	cl.Logger.Printf("%s Fetching initial config\n", stdTimestamp())
-	config, source, err := cl.Cg.FetchConfig()
-	if err != nil {
-		//if the config couldn't be fetched the first time, the application will exit; later on, config reads will be tolerated
-		panic(fmt.Sprintf("%s", err.Error()))
-	}
-	lastConfigFetched = time.Now()
-	//isConfigFetchFailing used to track when to notify the server of issues
-	isConfigFetchFailing := false
-	cl.Logger.Printf("%s Successfully fetched initial config from %s; we'll continue to poll every %d seconds\n%+v\n", stdTimestamp(), source, cl.Cg.ConfigFetchInterval, config)
-	cl.Cg.NotifyServer(fmt.Sprintf("%s: we got some config and we're starting up", cl.Cg.ClientId), InfoNotification)
-	cl.Logger.Printf("%s Beginning control loop for %d controller(s)\n", stdTimestamp(), len(config.Controllers))
-
-	//enumerate hosts to track if too much time has passed and failingState
-	//TODO what happens when a host is removed from the config entirely?
-	successfulHostControlTimestamp := make(map[string]time.Time)
-	failingHostStates := make(map[string]bool)
-	for _, controller := range config.Controllers {
-		for _, host := range controller.SwitchHosts {
-			successfulHostControlTimestamp[host] = time.Time{}
-			failingHostStates[host] = false
-		}
+// shutdown drives every switch host in config to ShutdownState and flushes pending notifications. The loop's ctx is
+// already done by now, so each host gets its own short deadline
+func (cl *ControlLooper) shutdown(config *ControllersConfig) {
+	state := cl.ShutdownState
+	if state == 0 {
+		state = ControlOff
 	}
-
-	successfulTempReadByControllerName := make(map[string]time.Time) //controller name maps to last timestamp successful
-	failingTempReadStates := make(map[string]bool)                   //controller name maps to bool whether it's currently in a failing state
-
-	db, err := NewSqliteDbFromFilename(cl.dbFileName, cl.Logger)
-	if err != nil {
-		cl.Logger.Printf("Error creating sqlite dbo: %s\n", err)
-		cl.Cg.NotifyServer(fmt.Sprintf("Error creating sqlite dbo: %s\n", err), SeriousNotification)
-	}
-	defer db.Close()
-
-	start := time.Now()
-	oneMinuteAfterStart := start.Add(time.Minute) //start to worry if we haven't heard from hosts
-	returnChan := make(chan temperatureControlReturn)
-	timer := time.Tick(time.Second * 15)
-	// Loop forever
-	for range timer {
-		loopStart := time.Now()
-		//if it's been more than the configured interval between fetches, we'll check for new config (note: we start checking every 15 secs)
-		if lastConfigFetched.Add(cl.Cg.ConfigFetchInterval).Before(time.Now()) {
-			newConfig, source, err := cl.Cg.FetchConfig()
-			if err != nil {
-				//TODO Factor out this function call
-				configSource, ok := cl.Cg.GetSourceKind()
-				if ok {
-					cl.Logger.Printf("%s We failed to get new config from %s: %#v", stdTimestamp(), configSource, err)
-				} else {
-					//TODO Notify the server if the error was malformed config, they may have to update it!
-					//TODO Notify the server if it's been too long since receiving an up-to-date config
-					cl.Logger.Printf("%s We failed to get new config: %#v", stdTimestamp(), err)
-				}
-				//note: we never modified `config` so things should continue working with the previous config
-
-				//see if we need to notify the server of issues
-				if !isConfigFetchFailing && lastConfigFetched.Add(intervalNotifyServerForConfigFetch).Before(time.Now()) {
-					isConfigFetchFailing = true
-					cl.Cg.NotifyServer(fmt.Sprintf("%s: we haven't received config in %s", cl.Cg.ClientId, intervalNotifyServerForConfigFetch.String()), ProblemNotification)
-				}
-			} else {
-				cl.Logger.Printf("%s We successfully fetched config from %s\n", stdTimestamp(), source)
-				if !AreConfigsEqual(config, newConfig) {
-					cl.Logger.Printf("NEW config!")
-					cl.Logger.Printf("%+v\n", newConfig)
-					cl.Cg.NotifyServer("We just got some updated config", InfoNotification)
-				}
-				config = newConfig
-				timeElapsedSinceLastConfigFetched := time.Now().Sub(lastConfigFetched)
-				lastConfigFetched = time.Now()
-
-				if isConfigFetchFailing { //we just recovered from the config fetch failing
-					isConfigFetchFailing = false
-					cl.Cg.NotifyServer(fmt.Sprintf("%s: we have recovered from config retrieval issues after %s", cl.Cg.ClientId, timeElapsedSinceLastConfigFetched.String()), ProblemNotification)
-				}
-			}
-		}
-
-		//temp read errors won't be reported for sleeping controllers
-		sleepingControllers := make(map[string]bool) //controller name maps to bool whether their sleeping or not
-		sleepingHosts := make(map[string]bool)       //host maps to bool if they belong to no awake controller
-
-		for i := range config.Controllers {
-			//TODO set a timeout of 12 seconds
-			//TODO how can we notify the server when a new temperature rule has been applied for the first time
-			go cl.temperatureControl(returnChan, &config.Controllers[i])
-		}
-
-		//the idea behind this 2nd loop is to wait for each of the goroutines spun up to finish and report back
-		for range config.Controllers {
-			//How do we make it so if one loop fails, the other can keep on ticking?
-			returnValue := <-returnChan
-
-			//debug code TODO remove
-			//(*cl.Logger).Printf("[%s] just returned to main; err: %t, controller sleeping %t\n", returnValue.controllerConfig.Name, err != nil, returnValue.noSchedulesAreActive)
-
-			if returnValue.err != nil {
-				cl.Logger.Printf("%s [%s] Error in temperatureControl loop: %s\n", stdTimestamp(), returnValue.controllerConfig.Name, returnValue.err.Error())
-			}
-
-			//log 'em if you got 'em
-			if (TmpLog{}) != returnValue.tmplog {
-				err := db.PersistTmpLog(returnValue.tmplog)
-				if err != nil {
-					cl.Logger.Printf("%s [%s] Error persisting log to sqlite dbo: %s", stdTimestamp(), returnValue.controllerConfig.Name, err)
-					cl.Cg.NotifyServer("We couldn't save a TmpLog to the sqlite dbo", ProblemNotification)
-				}
-			}
-
-			//analyze which controllers and hosts are asleep
-			if returnValue.noSchedulesAreActive {
-				sleepingControllers[returnValue.controllerConfig.Name] = true
-				for _, host := range returnValue.controllerConfig.SwitchHosts {
-					hostSleeping, ok := sleepingHosts[host]
-					if !ok || hostSleeping { //be careful not to switch a value from false to true, because as long as the host is awake for one controller, it's generally awake
-						sleepingHosts[host] = true
-					}
-				}
-			} else { //controller isn't sleeping
-				for _, host := range returnValue.controllerConfig.SwitchHosts {
-					sleepingHosts[host] = false
-				}
-			}
-
-			if !returnValue.successfulTemperatureReadTimestamp.IsZero() {
-				successfulTempReadByControllerName[returnValue.controllerConfig.Name] = returnValue.successfulTemperatureReadTimestamp
-			}
-			successfulHostControlTimestamp = updateSuccessfulHostTimestamps(successfulHostControlTimestamp, returnValue.successfulHostControlTimestamp)
+	var failedHosts []string
+	for _, host := range uniqueSwitchHosts(*config) {
+		cl.Logger.Printf("%s Shutting down: turning %s %s\n", cl.timestamp(), state, host)
+		hostCtx, cancel := context.WithTimeout(context.Background(), controlDeviceTimeout)
+		err := controlDevice(hostCtx, cl.HeatOrCoolController, host, state)
+		cancel()
+		if err != nil {
+			cl.Logger.Printf("%s Shutting down: we couldn't turn %s %s: %s\n", cl.timestamp(), state, host, err)
+			failedHosts = append(failedHosts, host)
 		}
-		//debug code: TODO remove
-		//(*cl.Logger).Printf("Here are the sleeping controllers: {")
-		//for controller := range sleepingControllers {
-		//	(*cl.Logger).Printf("%s=%t,", controller, sleepingControllers[controller])
-		//}
-		//(*cl.Logger).Printf("}\nHere are the sleeping hosts: {")
-		//for host := range sleepingHosts {
-		//	(*cl.Logger).Printf("%s=%t,", host, sleepingHosts[host])
-		//}
-		//(*cl.Logger).Printf("}\n")
-
-		nowRef := time.Now()
-
-		//check up on temperature read health for each controller. Only notify the server if we are just entering into (or recovering from) the failing state
-		for i := range config.Controllers {
-			//see if
-			//no need to worry if the controller is asleep
-			isControllerAsleep, ok := sleepingControllers[config.Controllers[i].Name]
-			if ok && isControllerAsleep {
-				previouslyFailing, ok := failingTempReadStates[config.Controllers[i].Name]
-				if ok && previouslyFailing {
-					failingTempReadStates[config.Controllers[i].Name] = false
-					cl.Cg.NotifyServer(fmt.Sprintf("We previously informed that the thermometer for controller %s couldn't be read. Now that controller is sleeping, so we'll ignore the problem for now", config.Controllers[i].Name), SeriousNotification)
-				}
-				continue
-			}
-
-			lastSuccessfulTempRead, ok := successfulTempReadByControllerName[config.Controllers[i].Name]
-			if !ok || lastSuccessfulTempRead.IsZero() || lastSuccessfulTempRead.Add(intervalNotifyServerForTempRead).Before(nowRef) {
-				//we're failing to read this controller's thermometer
+	}
+	if len(failedHosts) > 0 {
+		cl.notify(fmt.Sprintf("%s: we're shutting down but couldn't turn %s these hosts: %s", cl.Cg.ClientId, state, strings.Join(failedHosts, ", ")), SeriousNotification)
+	} else {
+		cl.notify(fmt.Sprintf("%s: we're shutting down and turned every host %s", cl.Cg.ClientId, state), InfoNotification)
+	}
+	if err := cl.Cg.FlushNotifications(); err != nil {
+		cl.Logger.Printf("%s Shutting down: we couldn't flush pending notifications: %s\n", cl.timestamp(), err)
+	}
+}
 
-				//do we need to notify the server?
-				previouslyFailing, ok := failingTempReadStates[config.Controllers[i].Name]
-				if (ok && !previouslyFailing) || !ok {
-					failingTempReadStates[config.Controllers[i].Name] = true
-					cl.Cg.NotifyServer(fmt.Sprintf("We haven't had contact with the thermometer for controller %s for %s", config.Controllers[i].Name, intervalNotifyServerForTempRead.String()), SeriousNotification)
-				}
-			} else {
-				//we are successfully reading this controller's thermometer. Maybe we need to notify server we have recovered from a failing state
-				previouslyFailing, ok := failingTempReadStates[config.Controllers[i].Name]
-				if ok && previouslyFailing {
-					failingTempReadStates[config.Controllers[i].Name] = false
-					cl.Cg.NotifyServer(fmt.Sprintf("We recovered contact with the thermometer for controller %s", config.Controllers[i].Name), SeriousNotification)
-				}
-			}
+// findSleepingHosts a host is only asleep if every controller it belongs to is asleep
+func findSleepingHosts(config ControllersConfig, sleepingControllers map[string]bool) map[string]bool {
+	sleepingHosts := make(map[string]bool)
+	for _, controller := range config.Controllers {
+		for _, host := range controller.SwitchHosts {
+			hostSleeping, ok := sleepingHosts[host]
+			//be careful not to switch a value from false to true, because as long as the host is awake for one controller, it's generally awake
+			sleepingHosts[host] = sleepingControllers[controller.Name] && (!ok || hostSleeping)
 		}
+	}
+	return sleepingHosts
+}
 
-		//check up on host communication health to see if we should notify
-		for host := range successfulHostControlTimestamp {
-			//no need to worry if host is asleep
-			isHostAsleep, ok := sleepingHosts[host]
-			if ok && isHostAsleep {
-				previouslyFailing, ok := failingHostStates[host]
-				if ok && previouslyFailing {
-					failingHostStates[host] = false
-					cl.Cg.NotifyServer(fmt.Sprintf("We previously informed that the host %s couldn't be contacted. That switch-host is no longer associated with an active controller. We'll ignore the problem for now", host), ProblemNotification)
-				}
-				continue
-			}
-
-			//one minute after start is a special case since we won't have any successful timestamps before the first time
-			if successfulHostControlTimestamp[host].IsZero() && nowRef.After(oneMinuteAfterStart) {
-				if !failingHostStates[host] {
-					cl.Logger.Printf("%#v\n", successfulHostControlTimestamp)
-					failingHostStates[host] = true
-					cl.Cg.NotifyServer(fmt.Sprintf("We started the control loop over a minute ago and we still haven't heard from host %s", host), ProblemNotification)
-				}
-			} else if !successfulHostControlTimestamp[host].IsZero() && successfulHostControlTimestamp[host].Add(intervalNotifyServerForSwitchHostComm).Before(nowRef) {
-				if !failingHostStates[host] {
-					cl.Logger.Printf("%#v", successfulHostControlTimestamp)
-					failingHostStates[host] = true
-					cl.Cg.NotifyServer(fmt.Sprintf("We haven't had contact with switch-host %s since %s", host, successfulHostControlTimestamp[host].Format("2006-01-02 15:04:05")), ProblemNotification)
-				}
-			} else if failingHostStates[host] { //it seems this host has recovered
-				cl.Logger.Printf("%#v", successfulHostControlTimestamp)
-				failingHostStates[host] = false
-				//we maintain the problem notification urgency to make sure the admin was notified and through the same means
-				cl.Cg.NotifyServer(fmt.Sprintf("We recovered contact with switch-host %s at %s", host, successfulHostControlTimestamp[host].Format("2006-01-02 15:04:05")), ProblemNotification)
+// uniqueSwitchHosts every host in config once, in the order they're configured
+func uniqueSwitchHosts(config ControllersConfig) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, controller := range config.Controllers {
+		for _, host := range controller.SwitchHosts {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
 			}
 		}
-		cl.Logger.Printf("This iteration of the control loop took %s\n", time.Since(loopStart).String())
 	}
+	return hosts
 }
 
 func updateSuccessfulHostTimestamps(hsMaster map[string]time.Time, hsUpdatesToPerform map[string]time.Time) map[string]time.Time {
@@ -348,51 +333,74 @@ func updateSuccessfulHostTimestamps(hsMaster map[string]time.Time, hsUpdatesToPe
 	return hsMaster
 }
 
-// @TODO Maybe these should all be configurable with the ControlLooper
-const (
-	intervalNotifyServerForSwitchHostComm = 5 * time.Minute
-	intervalNotifyServerForConfigFetch    = 15 * time.Minute
-	intervalNotifyServerForTempRead       = 1 * time.Minute
-)
-
 type temperatureControlReturn struct {
-	controllerConfig                   *Controller
-	successfulTemperatureReadTimestamp time.Time
+	controllerConfig *Controller
 	//keys are the hostname and values are whether they succeeded or not
 	successfulHostControlTimestamp map[string]time.Time
 	noSchedulesAreActive           bool
-	tmplog                         TmpLog
-	err                            error
+	//what the iteration read, decided and did, see ControllerResult
+	readings              []sensorReading
+	temperatureInF        float32
+	desiredTemperatureInF float32
+	decision              Control
+	hosts                 []HostOutcome
+	tmplog                TmpLog
+	err                   error
 }
 
 var TemperatureReadError = errors.New("there was a problem reading the current temperature")
 var AtLeastOneHostControlFailed = fmt.Errorf("at least one host control failed")
 
-// we'll print directly from this function, prefixing the name of the controller
-func (cl *ControlLooper) temperatureControl(retChan chan<- temperatureControlReturn, controllerConfig *Controller) {
-	//prepare our channel response
+// we'll print directly from this function, prefixing the name of the controller. When ctx is done we stop waiting on
+// the thermometer and switch hosts
+func (cl *ControlLooper) temperatureControl(ctx context.Context, controllerConfig *Controller) temperatureControlReturn {
+	//prepare our response
 	ret := temperatureControlReturn{
 		controllerConfig:               controllerConfig,
 		successfulHostControlTimestamp: make(map[string]time.Time),
 	}
 
-	desiredTemperature, ok := controllerConfig.GetCurrentDesiredTemperature()
+	now := cl.Clock.Now()
+	desiredTemperature, ok := controllerConfig.DesiredTemperatureAt(now)
+	if cl.SetpointOverrides != nil {
+		if override, overridden := cl.SetpointOverrides.SetpointOverride(controllerConfig.Name); overridden {
+			desiredTemperature, ok = override, true
+			cl.Logger.Printf("%s [%s]: The schedule is overridden to %.2f\n", cl.timestamp(), controllerConfig.Name, override)
+		}
+	}
 	if !ok {
 		ret.noSchedulesAreActive = true
-		cl.Logger.Printf("%s [%s]: No temperature schedules have come to pass. We should wait around for a little\n", stdTimestamp(), controllerConfig.Name)
-		retChan <- ret
-		return
+		cl.Logger.Printf("%s [%s]: No temperature schedules have come to pass. We should wait around for a little\n", cl.timestamp(), controllerConfig.Name)
+		return ret
 	}
+	ret.desiredTemperatureInF = desiredTemperature
 	// Get the current temperature
 	weCouldntReadTempPleaseTurnOffControls := false
-	currentTemperature, err := cl.TemperatureReader.ReadTemperatureInF(controllerConfig.ThermometerPath)
+	sensors := controllerConfig.sensors()
+	policy := controllerConfig.sensorPolicy()
+	readings := readSensors(ctx, cl.TemperatureReader, sensors)
+	cl.recordSensorHealth(readings, now)
+	cl.correctReadings(controllerConfig.Name, readings, now)
+	temperatures, err := policy.apply(readings)
+	currentTemperature := temperatures.control
+	ret.readings = readings
+	ret.temperatureInF = currentTemperature
 	if err != nil {
-		cl.Logger.Printf("%s [%s]: We had a problem getting current temperature from %#v. Turning off controls just in case. We'll wait a second and try again: %s\n", stdTimestamp(), controllerConfig.Name, controllerConfig.ThermometerPath, err)
+		paths := make([]string, len(sensors))
+		for i, sensor := range sensors {
+			paths[i] = sensor.Path
+		}
+		cl.Logger.Printf("%s [%s]: We had a problem getting current temperature from %#v. Turning off controls just in case. We'll wait a second and try again: %s\n", cl.timestamp(), controllerConfig.Name, strings.Join(paths, ", "), err)
 		ret.err = errors.Join(TemperatureReadError, err)
 		weCouldntReadTempPleaseTurnOffControls = true
 	} else {
-		ret.successfulTemperatureReadTimestamp = time.Now()
-		cl.Logger.Printf("%s [%s]: The latest temperature is %.2f and desired temperature is %.2f\n", stdTimestamp(), controllerConfig.Name, currentTemperature, desiredTemperature)
+		for _, reading := range readings {
+			if reading.err != nil {
+				cl.Logger.Printf("%s [%s]: We couldn't read the %s sensor %#v, so we're going on without it: %s\n", cl.timestamp(), controllerConfig.Name, reading.Role, reading.Path, reading.err)
+			}
+		}
+		cl.Logger.Printf("%s [%s]: The latest temperature is %.2f and desired temperature is %.2f\n", cl.timestamp(), controllerConfig.Name, currentTemperature, desiredTemperature)
+		cl.checkSensorAgreement(controllerConfig.Name, readings, policy.MaxDisagreement)
 	}
 
 	//should we turn controls on or off?
@@ -416,34 +424,53 @@ func (cl *ControlLooper) temperatureControl(retChan chan<- temperatureControlRet
 			}
 		}
 	}
+	if limited, ok := policy.limitByChamber(temperatures, controllerConfig.ControlType, newState); ok {
+		newState = limited
+		cl.Logger.Printf("%s [%s]: The chamber is already at %.2f, more than %.2f past the beer at %.2f, so we're holding off\n", cl.timestamp(), controllerConfig.Name, *temperatures.chamber, policy.ChamberLimit, currentTemperature)
+	}
 	if !controllerConfig.DisableFreezeProtection && currentTemperature < 33 && newState != ControlOff {
 		newState = ControlOff
-		cl.Logger.Printf("%s [%s]: FREEZE PROTECTION We're turning off all hosts since the temperature is %.2f\n", stdTimestamp(), controllerConfig.Name, currentTemperature)
+		cl.Logger.Printf("%s [%s]: FREEZE PROTECTION We're turning off all hosts since the temperature is %.2f\n", cl.timestamp(), controllerConfig.Name, currentTemperature)
 	}
 
+	ret.decision = newState
+
 	//communicate with the control hosts
 	var allHostsSuccessful = true
 	successfulHosts := make([]string, 0, len(controllerConfig.SwitchHosts))
+	var discrepancies []string
+	stateReader, canReadState := cl.HeatOrCoolController.(DeviceStateReader)
 	for _, host := range controllerConfig.SwitchHosts {
-		cl.Logger.Printf("%s [%s] Turning %s %s\n", stdTimestamp(), controllerConfig.Name, newState, host)
-		if cl.HeatOrCoolController == nil {
-			panic("HeatOrCoolController is nil")
+		var hostDiscrepancies []string
+		if canReadState {
+			if drift := cl.checkForDrift(ctx, stateReader, controllerConfig.Name, host); drift != "" {
+				hostDiscrepancies = append(hostDiscrepancies, drift)
+			}
 		}
-		err := cl.HeatOrCoolController.ControlDevice(host, newState)
+		cl.Logger.Printf("%s [%s] Turning %s %s\n", cl.timestamp(), controllerConfig.Name, newState, host)
+		err := controlDevice(ctx, cl.HeatOrCoolController, host, newState)
+		ret.hosts = append(ret.hosts, HostOutcome{Host: host, Err: err})
 		if err != nil {
 			//note: we don't want to send this error to the channel because it will be confusing if there are more hosts. Err is set later
 			allHostsSuccessful = false
 			ret.successfulHostControlTimestamp[host] = time.Time{}
 			var exitError *exec.ExitError
 			if errors.As(err, &exitError) { // is our error because it timed out?
-				cl.Logger.Printf("%s [%s] Our call to controlDevice timed out after 3 seconds\n", stdTimestamp(), controllerConfig.Name)
+				cl.Logger.Printf("%s [%s] Our call to controlDevice timed out after 3 seconds\n", cl.timestamp(), controllerConfig.Name)
 			} else {
-				cl.Logger.Printf("%s [%s] Our call to controlDevice returned an error: %s\n", stdTimestamp(), controllerConfig.Name, err.Error())
+				cl.Logger.Printf("%s [%s] Our call to controlDevice returned an error: %s\n", cl.timestamp(), controllerConfig.Name, err.Error())
 			}
 		} else {
-			ret.successfulHostControlTimestamp[host] = time.Now()
+			ret.successfulHostControlTimestamp[host] = cl.Clock.Now()
 			successfulHosts = append(successfulHosts, host)
+			if canReadState {
+				if mismatch := cl.verifyDeviceState(ctx, stateReader, controllerConfig.Name, host, newState); mismatch != "" {
+					hostDiscrepancies = append(hostDiscrepancies, mismatch)
+				}
+			}
+			cl.recordDeviceState(controllerConfig.Name, host, newState, hostDiscrepancies)
 		}
+		discrepancies = append(discrepancies, hostDiscrepancies...)
 
 		//TODO can we schedule a failsafe on the device in case we crash next iteration?
 	}
@@ -456,27 +483,48 @@ func (cl *ControlLooper) temperatureControl(retChan chan<- temperatureControlRet
 	}
 
 	if weCouldntReadTempPleaseTurnOffControls { //don't write to csv if we had issues getting the temperature
-		retChan <- ret
-		return
+		return ret
 	}
 
 	//pass on a pre-formatted log object so our caller can save it
 	ret.tmplog = TmpLog{
-		ControllerName:        controllerConfig.Name,
-		Timestamp:             time.Now(),
-		TemperatureInF:        currentTemperature,
-		DesiredTemperatureInF: desiredTemperature,
-		IsHeatingNotCooling:   controllerConfig.ControlType != "cool",
-		TurningOnNotOff:       newState == ControlOn,
-		HostsPipeSeparated:    strings.Join(successfulHosts, "|"),
+		ControllerName:           controllerConfig.Name,
+		Timestamp:                now,
+		TemperatureInF:           currentTemperature,
+		DesiredTemperatureInF:    desiredTemperature,
+		IsHeatingNotCooling:      controllerConfig.ControlType != "cool",
+		TurningOnNotOff:          newState == ControlOn,
+		HostsPipeSeparated:       strings.Join(successfulHosts, "|"),
+		DeviceStateDiscrepancies: strings.Join(discrepancies, "|"),
+	}
+	if rawTemperatures, err := policy.apply(uncorrected(readings)); err == nil {
+		ret.tmplog.RawTemperatureInF = rawTemperatures.control
+	}
+	if len(controllerConfig.Sensors) > 0 {
+		described := make([]string, len(readings))
+		for i, reading := range readings {
+			described[i] = reading.String()
+		}
+		ret.tmplog.SensorReadings = strings.Join(described, "|")
+	}
+	if gravityReader, ok := cl.TemperatureReader.(SpecificGravityReader); ok {
+		for _, sensor := range sensors {
+			if gravity, ok := gravityReader.ReadSpecificGravity(sensor.Path); ok {
+				ret.tmplog.SpecificGravity = gravity
+				break
+			}
+		}
 	}
 
-	retChan <- ret
+	return ret
 }
 
 func (controller *Controller) GetCurrentDesiredTemperature() (float32, bool) {
-	//we look for the newest entry before the current time
-	now := time.Now()
+	return controller.DesiredTemperatureAt(time.Now())
+}
+
+// DesiredTemperatureAt the temperature the schedule asks for at now: its newest entry before now
+func (controller *Controller) DesiredTemperatureAt(now time.Time) (float32, bool) {
 	var mostRecentSchedule time.Time
 	for k := range controller.TemperatureSchedule {
 		if k.Before(now) && k.After(mostRecentSchedule) {
@@ -502,7 +550,19 @@ func NewKasaHeatOrCoolController(kasaPath string) *KasaHeatOrCoolController {
 	}
 }
 
+// CheckKasaExecutable whether kasaPath, or the kasa it names in PATH, can be run
+func CheckKasaExecutable(kasaPath string) error {
+	if _, err := exec.LookPath(kasaPath); err != nil {
+		return fmt.Errorf("we can't execute kasa, install python-kasa (`pip install python-kasa`) or point -kasa-path at it: %w", err)
+	}
+	return nil
+}
+
 func (k *KasaHeatOrCoolController) ControlDevice(host string, action Control) error {
+	return k.ControlDeviceContext(context.Background(), host, action)
+}
+
+func (k *KasaHeatOrCoolController) ControlDeviceContext(ctx context.Context, host string, action Control) error {
 	var commandAction string
 	if action == ControlOn {
 		commandAction = "on"
@@ -511,7 +571,7 @@ func (k *KasaHeatOrCoolController) ControlDevice(host string, action Control) er
 	}
 
 	// Create a new Command instance
-	ctx, cancel := context.WithTimeout(context.Background(), controlDeviceTimeout)
+	ctx, cancel := context.WithTimeout(ctx, controlDeviceTimeout)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, k.kasaPath, "--host", host, "--type", "plug", commandAction)
 
@@ -1,7 +1,14 @@
 package tmpcontrol
 
 import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestConfigGopher_HasError(t *testing.T) {
@@ -29,3 +36,77 @@ func TestConfigGopher_HasError(t *testing.T) {
 		t.Error("expected error since spaces in the ClientId are prohibited")
 	}
 }
+
+// recordingSwitch a HeatOrCoolController that remembers the last state of each host
+type recordingSwitch struct {
+	mu     sync.Mutex
+	states map[string]Control
+	calls  int
+}
+
+func (s *recordingSwitch) ControlDevice(host string, action Control) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.states == nil {
+		s.states = make(map[string]Control)
+	}
+	s.states[host] = action
+	s.calls++
+	return nil
+}
+
+func (s *recordingSwitch) state(host string) Control {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[host]
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestControlLooper_StartControlLoopShutsDownSafely(t *testing.T) {
+	configPath := writeTestConfig(t, `{"controllers": [
+		{"name": "fridge", "thermometerPath": "/tmp/t", "controlType": "cool", "switchHosts": ["10.0.0.1", "10.0.0.2"]},
+		{"name": "heater", "thermometerPath": "/tmp/t", "controlType": "heat", "switchHosts": ["10.0.0.2"]}
+	]}`)
+	switches := &recordingSwitch{}
+	logger := log.New(io.Discard, "", 0)
+	cl := NewControlLooper(&ConfigGopher{LocalConfigPath: configPath, ConfigFetchInterval: time.Minute}, switches, logger)
+	cl.dbFileName = filepath.Join(t.TempDir(), "tmplog.dbo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- cl.StartControlLoop(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the control loop didn't stop after its context was cancelled")
+	}
+	for _, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		if state := switches.state(host); state != ControlOff {
+			t.Errorf("expected %s to be turned off on shutdown, got %s", host, state)
+		}
+	}
+	if switches.calls != 2 {
+		t.Errorf("expected each host to be switched once, got %d calls", switches.calls)
+	}
+
+	//without any config we shouldn't even start
+	cl = NewControlLooper(&ConfigGopher{LocalConfigPath: filepath.Join(t.TempDir(), "missing.json")}, switches, logger)
+	if err := cl.StartControlLoop(context.Background()); err == nil {
+		t.Error("expected an error since the config file doesn't exist")
+	}
+}
@@ -40,6 +40,7 @@ func NewServer(dbFileName string, l Logger) (*Server, error) {
 	mux.Handle("GET /", IndexCheck404Middleware(IndexCheckForFormGetSubmit(http.HandlerFunc(s.IndexHandler))))
 	mux.HandleFunc("GET /configuration/{clientId}", s.GetConfigurationHandler)
 	mux.HandleFunc("POST /configuration/{clientId}", s.PostConfigurationHandler)
+	mux.HandleFunc("GET "+ConfigSchemaPath, s.GetConfigSchemaHandler)
 
 	s.Mux = mux
 	return &s, nil
@@ -204,7 +205,7 @@ func (s *Server) PostConfigurationHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 	var config ControllersConfig
-	err = json.NewDecoder(r.Body).Decode(&config)
+	err = json.Unmarshal(data, &config)
 	if err != nil {
 		s.PostJsonConfigurationHandler(w, r, s.l, PostResult{config: ControllersConfig{}, err: PostUnmarshalableJson})
 		return
@@ -290,6 +291,15 @@ func (s *Server) GetConfigurationHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// GetConfigSchemaHandler serves the JSON Schema describing ControllersConfig, see ConfigJsonSchema
+func (s *Server) GetConfigSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, err := w.Write(ConfigJsonSchema())
+	if err != nil {
+		s.l.Printf("There was an issue writing the schema to the client: %s", err.Error())
+	}
+}
+
 func IsJSON(str []byte) bool {
 	var js json.RawMessage
 	return json.Unmarshal(str, &js) == nil